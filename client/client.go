@@ -108,7 +108,7 @@ func (self *Client) Connect() error {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 
-	if self.Connection.State == STATE_CONNECTING || self.Connection.State == STATE_CONNECTED {
+	if state := self.Connection.GetState(); state == STATE_CONNECTING || state == STATE_CONNECTED {
 		// 接続中, 試行中なのでなにもしない
 		return nil
 	}
@@ -151,7 +151,7 @@ func (self *Client) Connect() error {
 		msg.Password = self.Option.Password
 	}
 
-	self.Connection.State = STATE_CONNECTING
+	self.Connection.SetState(STATE_CONNECTING)
 	self.wg.Add(1)
 	self.Connection.WriteMessageQueue(msg)
 	log.Debug("CONNECT PROCESS")
@@ -159,7 +159,7 @@ func (self *Client) Connect() error {
 }
 
 func (self *Client) WaitConnection() {
-	if self.Connection.State == STATE_CONNECTING {
+	if self.Connection.GetState() == STATE_CONNECTING {
 		self.wg.Wait()
 	}
 }
@@ -169,7 +169,7 @@ func (self *Client) Terminate() {
 	defer self.mu.Unlock()
 
 	self.once.Do(func() {
-		if self.Connection.State != STATE_CLOSED {
+		if self.Connection.GetState() != STATE_CLOSED {
 			self.term <- true
 			self.Connection.Close()
 		}
@@ -191,7 +191,7 @@ func (self *Client) Loop() {
 			//			return
 		default:
 			// TODO: move this function to connect (実際にReadするやつ)
-			switch self.Connection.State {
+			switch self.Connection.GetState() {
 			case STATE_CONNECTED, STATE_CONNECTING:
 				_, err := self.Connection.ParseMessage()
 				if err != nil {
@@ -6,6 +6,7 @@ package common
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	codec "github.com/chobie/momonga/encoding/mqtt"
 	"github.com/chobie/momonga/flags"
@@ -14,11 +15,15 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const defaultBufferSize = 16 * 1024
 
+var ErrQueueFull = errors.New("outbound queue is full")
+var ErrInflightFull = errors.New("inflight window is full")
+
 type MyConnection struct {
 	MyConnection     io.ReadWriteCloser
 	Events           map[string]interface{}
@@ -30,11 +35,13 @@ type MyConnection struct {
 	SubscribeHistory map[string]int
 	PingCounter      int
 	Reconnect        bool
-	Mutex            sync.RWMutex
-	Kicker           *time.Timer
-	Keepalive        int
-	Id               string
-	Qlobber          *util.Qlobber
+	// guards State, Kicker, Last and OfflineQueue.
+	Mutex     sync.RWMutex
+	Kicker    *time.Timer
+	Keepalive int
+	Id        string
+	// topic filters this client subscribed to.
+	Subscriptions    *util.SubscriptionTrie[string]
 	WillMessage      *codec.WillMessage
 	SubscribedTopics map[string]int
 	Opaque           interface{}
@@ -46,7 +53,23 @@ type MyConnection struct {
 	Reader           *bufio.Reader
 	Writer           *bufio.Writer
 	KeepLoop         bool
-	guid             util.Guid
+	// why the server closed this connection. "" when the client went away.
+	DisconnectReason string
+	// the listener which accepted this connection ("tcp", "unix" or "websocket")
+	Listener string
+	// outbound queue limits for TryWriteMessageQueue. 0 means unlimited (up to the capacity of Queue).
+	MaxQueuedMessages int
+	MaxQueuedBytes    int
+	queuedBytes       int64
+	// how many QoS 1 and 2 messages can be unacknowledged. 0 means unlimited (up to 65535 packet identifiers).
+	MaxInflightMessages int
+	// QoS 1 and 2 messages in Queue. they don't have a packet identifier yet.
+	queuedInflight int64
+	// when the last control packet was received (unix nano). writes don't count as activity.
+	received int64
+	// serializes writes to Writer. Mutex isn't held while writing, so a blocked write doesn't block Close.
+	writeLock sync.Mutex
+	guid      util.Guid
 }
 
 func (self *MyConnection) SetOpaque(opaque interface{}) {
@@ -68,22 +91,23 @@ func NewMyConnection() *MyConnection {
 		InflightTable:    util.NewMessageTable(),
 		SubscribeHistory: make(map[string]int),
 		Mutex:            sync.RWMutex{},
-		Qlobber:          util.NewQlobber(),
+		Subscriptions:    util.NewSubscriptionTrie[string](),
 		SubscribedTopics: make(map[string]int),
 		Last:             time.Now(),
+		received:         time.Now().UnixNano(),
 		CleanSession:     true,
 		Keepalive:        0,
 		State:            STATE_INIT,
-		Closed:           make(chan bool),
+		Closed:           make(chan bool, 1),
 	}
 
 	c.Events["connected"] = func() {
-		c.State = STATE_CONNECTED
+		c.SetState(STATE_CONNECTED)
 	}
 
 	c.Events["connack"] = func(result uint8) {
 		if result == 0 {
-			c.State = STATE_CONNECTED
+			c.SetState(STATE_CONNECTED)
 			if c.Reconnect {
 				for key, qos := range c.SubscribeHistory {
 					c.Subscribe(key, qos)
@@ -91,22 +115,20 @@ func NewMyConnection() *MyConnection {
 			}
 
 			//TODO: このアホっぽい実装はあとでちゃんとなおす。なおしたい
-			if len(c.OfflineQueue) > 0 {
-				c.Mutex.Lock()
-				var targets []codec.Message
-				for len(c.OfflineQueue) > 0 {
-					targets = append(targets, c.OfflineQueue[0])
-					c.OfflineQueue = c.OfflineQueue[1:]
-				}
-				c.Mutex.Unlock()
+			c.Mutex.Lock()
+			var targets []codec.Message
+			for len(c.OfflineQueue) > 0 {
+				targets = append(targets, c.OfflineQueue[0])
+				c.OfflineQueue = c.OfflineQueue[1:]
+			}
+			c.Mutex.Unlock()
 
-				for i := 0; i < len(targets); i++ {
-					c.Queue <- targets[i]
-				}
+			for i := 0; i < len(targets); i++ {
+				c.WriteMessageQueue(targets[i])
 			}
 			c.setupKicker()
 		} else {
-			c.State = STATE_CLOSED
+			c.SetState(STATE_CLOSED)
 		}
 	}
 
@@ -167,6 +189,7 @@ func NewMyConnection() *MyConnection {
 		if err == nil {
 			if v, ok := mm.(*codec.UnsubscribeMessage); ok {
 				delete(c.SubscribeHistory, v.TopicName)
+				c.Subscriptions.RemoveFilter(v.TopicName)
 			}
 		}
 
@@ -183,6 +206,7 @@ func NewMyConnection() *MyConnection {
 	c.Events["unsubscribe"] = func(messageId uint16, granted int, payload []codec.SubscribePayload) {
 		for i := 0; i < len(payload); i++ {
 			delete(c.SubscribeHistory, payload[i].TopicPath)
+			c.Subscriptions.RemoveFilter(payload[i].TopicPath)
 		}
 	}
 
@@ -199,7 +223,7 @@ func NewMyConnection() *MyConnection {
 
 	c.Events["disconnect"] = func() {
 		// nothing to do ?
-		c.State = STATE_CLOSED
+		c.SetState(STATE_CLOSED)
 	}
 
 	c.Events["error"] = func(err error) {
@@ -242,7 +266,12 @@ func NewMyConnection() *MyConnection {
 
 				c.invalidateTimer()
 			case msg := <-c.Queue:
-				if c.State == STATE_CONNECTED || c.State == STATE_CONNECTING {
+				atomic.AddInt64(&c.queuedBytes, -queuedSize(msg))
+				if isInflight(msg) {
+					// from now on, InflightTable counts the message.
+					atomic.AddInt64(&c.queuedInflight, -1)
+				}
+				if state := c.GetState(); state == STATE_CONNECTED || state == STATE_CONNECTING {
 					if msg.GetType() == codec.PACKET_TYPE_PUBLISH {
 						sb := msg.(*codec.PublishMessage)
 						if sb.QosLevel < 0 {
@@ -250,9 +279,11 @@ func NewMyConnection() *MyConnection {
 							break
 						}
 						if sb.QosLevel > 0 {
-							id := c.InflightTable.NewId()
-							sb.PacketIdentifier = id
-							c.InflightTable.Register(id, sb, nil)
+							if _, err := c.InflightTable.Add(sb, 1, nil); err != nil {
+								// TryWriteMessageQueue keeps the window below 65535 messages. WriteMessageQueue doesn't.
+								log.Error("discard a message to %s: %s", c.Id, err)
+								break
+							}
 						}
 						//log.Info("sending PUBLISH [id:%d, qos:%d] %s %s to %s", sb.PacketIdentifier, sb.QosLevel, sb.TopicName, sb.Payload, c.GetId())
 					}
@@ -260,7 +291,9 @@ func NewMyConnection() *MyConnection {
 					c.writeMessage(msg)
 					c.invalidateTimer()
 				} else {
+					c.Mutex.Lock()
 					c.OfflineQueue = append(c.OfflineQueue, msg)
+					c.Mutex.Unlock()
 				}
 			case <-c.Closed:
 				if c.KeepLoop {
@@ -280,7 +313,7 @@ func (self *MyConnection) SetMyConnection(c io.ReadWriteCloser) {
 		self.Reconnect = true
 	}
 
-	self.State = STATE_CONNECTED
+	self.SetState(STATE_CONNECTED)
 	self.MyConnection = c
 	self.Writer = bufio.NewWriterSize(self.MyConnection, defaultBufferSize)
 	self.Reader = bufio.NewReaderSize(self.MyConnection, defaultBufferSize)
@@ -293,10 +326,13 @@ func (self *MyConnection) Subscribe(topic string, QoS int) error {
 		RequestedQos: uint8(QoS),
 	})
 
-	id := self.InflightTable.NewId()
-	sb.PacketIdentifier = id
-	self.InflightTable.Register(id, sb, nil)
+	if _, err := self.InflightTable.Add(sb, 1, nil); err != nil {
+		return err
+	}
 	self.SubscribeHistory[topic] = QoS
+	// a subscription to the same filter replaces the existing one.
+	self.Subscriptions.RemoveFilter(topic)
+	self.Subscriptions.Add(topic, topic)
 
 	if v, ok := self.Events["subscribe"]; ok {
 		if cb, ok := v.(func(*codec.SubscribeMessage, Connection)); ok {
@@ -308,6 +344,9 @@ func (self *MyConnection) Subscribe(topic string, QoS int) error {
 }
 
 func (self *MyConnection) setupKicker() {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
 	if self.Kicker != nil {
 		self.Kicker.Stop()
 	}
@@ -315,13 +354,13 @@ func (self *MyConnection) setupKicker() {
 	if self.Keepalive > 0 {
 		self.Kicker = time.AfterFunc(time.Second*time.Duration(self.Keepalive), func() {
 			self.Ping()
-			self.Kicker.Reset(time.Second * time.Duration(self.Keepalive))
+			self.invalidateTimer()
 		})
 	}
 }
 
 func (self *MyConnection) Ping() {
-	if self.State == STATE_CLOSED {
+	if self.GetState() == STATE_CLOSED {
 		return
 	}
 
@@ -504,7 +543,7 @@ func (self *MyConnection) Publish(TopicName string, Payload []byte, QosLevel int
 		sb.Retain = 1
 	}
 
-	self.Queue <- sb
+	self.WriteMessageQueue(sb)
 }
 
 func (self *MyConnection) HasMyConnection() bool {
@@ -529,13 +568,14 @@ func (self *MyConnection) SetGuid(id util.Guid) {
 func (self *MyConnection) ParseMessage() (codec.Message, error) {
 	if self.Keepalive > 0 {
 		if cn, ok := self.MyConnection.(net.Conn); ok {
-			cn.SetReadDeadline(self.Last.Add(time.Duration(int(float64(self.Keepalive)*1.5)) * time.Second))
+			cn.SetReadDeadline(self.LastReceived().Add(time.Duration(int(float64(self.Keepalive)*1.5)) * time.Second))
 		}
 	}
 
 	message, err := codec.ParseMessage(self.MyConnection, 8192)
 	if err == nil {
 		log.Debug("Read Message: [%s] %+v", message.GetTypeAsString(), message)
+		atomic.StoreInt64(&self.received, time.Now().UnixNano())
 
 		if v, ok := self.Events["parsed"]; ok {
 			if cb, ok := v.(func()); ok {
@@ -677,7 +717,9 @@ func (self *MyConnection) ParseMessage() (codec.Message, error) {
 		}
 	}
 
+	self.Mutex.Lock()
 	self.Last = time.Now()
+	self.Mutex.Unlock()
 	return message, err
 }
 
@@ -690,16 +732,95 @@ func (self *MyConnection) Write(b []byte) (int, error) {
 }
 
 func (self *MyConnection) Close() error {
-	self.State = STATE_CLOSED
-	self.Closed <- true
+	self.SetState(STATE_CLOSED)
+
+	// Close might be called more than once (e.g. takeover, then the disconnect path).
+	// don't block when the write loop already has a pending close request or has finished.
+	select {
+	case self.Closed <- true:
+	default:
+	}
 
 	return self.MyConnection.Close()
 }
 
 func (self *MyConnection) WriteMessageQueue(request codec.Message) {
+	atomic.AddInt64(&self.queuedBytes, queuedSize(request))
+	if isInflight(request) {
+		atomic.AddInt64(&self.queuedInflight, 1)
+	}
 	self.Queue <- request
 }
 
+// TryWriteMessageQueue enqueues request without blocking. it returns ErrQueueFull when
+// the outbound queue already holds MaxQueuedMessages messages or MaxQueuedBytes bytes,
+// and ErrInflightFull when request is a QoS 1 or 2 message and the inflight window is full.
+func (self *MyConnection) TryWriteMessageQueue(request codec.Message) error {
+	inflight := isInflight(request)
+	if inflight && self.InflightMessages() >= self.inflightWindow() {
+		return ErrInflightFull
+	}
+	if self.MaxQueuedMessages > 0 && len(self.Queue) >= self.MaxQueuedMessages {
+		return ErrQueueFull
+	}
+
+	size := queuedSize(request)
+	// a message larger than MaxQueuedBytes still goes out when the queue is empty.
+	if self.MaxQueuedBytes > 0 && len(self.Queue) > 0 && atomic.LoadInt64(&self.queuedBytes)+size > int64(self.MaxQueuedBytes) {
+		return ErrQueueFull
+	}
+
+	atomic.AddInt64(&self.queuedBytes, size)
+	if inflight {
+		atomic.AddInt64(&self.queuedInflight, 1)
+	}
+	select {
+	case self.Queue <- request:
+		return nil
+	default:
+		atomic.AddInt64(&self.queuedBytes, -size)
+		if inflight {
+			atomic.AddInt64(&self.queuedInflight, -1)
+		}
+		return ErrQueueFull
+	}
+}
+
+// InflightMessages returns the number of unacknowledged QoS 1 and 2 messages, including queued ones.
+func (self *MyConnection) InflightMessages() int {
+	return self.InflightTable.Len() + int(atomic.LoadInt64(&self.queuedInflight))
+}
+
+func (self *MyConnection) inflightWindow() int {
+	if self.MaxInflightMessages <= 0 || self.MaxInflightMessages > 65535 {
+		return 65535
+	}
+	return self.MaxInflightMessages
+}
+
+// QueuedMessages returns the number of messages waiting in the outbound queue.
+func (self *MyConnection) QueuedMessages() int {
+	return len(self.Queue)
+}
+
+// QueuedBytes returns the payload and topic bytes of PUBLISH messages waiting in the outbound queue.
+func (self *MyConnection) QueuedBytes() int64 {
+	return atomic.LoadInt64(&self.queuedBytes)
+}
+
+// isInflight reports whether msg occupies the inflight window until it is acknowledged.
+func isInflight(msg codec.Message) bool {
+	p, ok := msg.(*codec.PublishMessage)
+	return ok && p.QosLevel > 0
+}
+
+func queuedSize(msg codec.Message) int64 {
+	if p, ok := msg.(*codec.PublishMessage); ok {
+		return int64(len(p.TopicName) + len(p.Payload))
+	}
+	return 0
+}
+
 func (self *MyConnection) WriteMessageQueue2(msg []byte) {
 	self.Queue2 <- msg
 }
@@ -713,14 +834,18 @@ func (self *MyConnection) Disconnect() {
 func (self *MyConnection) Unsubscribe(topic string) {
 	sb := codec.NewUnsubscribeMessage()
 	sb.Payload = append(sb.Payload, codec.SubscribePayload{TopicPath: topic})
-	id := self.InflightTable.NewId()
-	sb.PacketIdentifier = id
-	self.InflightTable.Register(id, sb, nil)
+	if _, err := self.InflightTable.Add(sb, 1, nil); err != nil {
+		log.Error("can't unsubscribe %s: %s", topic, err)
+		return
+	}
 
 	self.Queue <- sb
 }
 
 func (self *MyConnection) invalidateTimer() {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
 	if self.Kicker != nil {
 		self.Kicker.Reset(time.Second * time.Duration(self.Keepalive))
 	}
@@ -742,7 +867,23 @@ func (self *MyConnection) GetId() string {
 	}
 }
 
+// LastReceived returns when the last control packet was received from the client.
+func (self *MyConnection) LastReceived() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.received))
+}
+
+// LastActivity returns when a control packet was last received from or written to the client.
+func (self *MyConnection) LastActivity() time.Time {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
+	return self.Last
+}
+
 func (self *MyConnection) SetKeepaliveInterval(interval int) {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
 	self.Keepalive = interval
 }
 
@@ -759,15 +900,21 @@ func (self *MyConnection) GetOutGoingTable() *util.MessageTable {
 }
 
 func (self *MyConnection) SetState(state State) {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
 	self.State = state
 }
 
 func (self *MyConnection) GetState() State {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
 	return self.State
 }
 
 func (self *MyConnection) ResetState() {
-	self.State = 0
+	self.SetState(0)
 }
 
 func (self *MyConnection) GetSubscribedTopics() map[string]*SubscribeSet {
@@ -802,12 +949,20 @@ func (self *MyConnection) IsAlived() bool {
 	return true
 }
 
+// WriteMessage writes msg immediately, bypassing the outbound queue (e.g. a CONNACK refusing the connection).
+func (self *MyConnection) WriteMessage(msg codec.Message) error {
+	return self.writeMessage(msg)
+}
+
 func (self *MyConnection) writeMessage(msg codec.Message) error {
 	log.Debug("Write Message [%s]: %+v", msg.GetTypeAsString(), msg)
 
-	self.Mutex.Lock()
+	self.writeLock.Lock()
 	codec.WriteMessageTo(msg, self.Writer)
 	self.Writer.Flush()
+	self.writeLock.Unlock()
+
+	self.Mutex.Lock()
 	self.Last = time.Now()
 	self.Mutex.Unlock()
 	return nil
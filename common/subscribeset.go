@@ -5,12 +5,21 @@ package common
 
 import (
 	"encoding/json"
+	"github.com/chobie/momonga/util"
 )
 
 type SubscribeSet struct {
 	ClientId    string `json:"client_id"`
 	TopicFilter string `json:"topic_filter"`
 	QoS         int    `json:"qos"`
+	// the filter the client subscribed to when TopicFilter has been rewritten.
+	OriginalFilter string `json:"original_filter,omitempty"`
+	// the tenant mountpoint TopicFilter is prefixed with.
+	Mountpoint string `json:"mountpoint,omitempty"`
+	// receives messages of tenants as well. see MmuxConnection.Admin
+	Admin bool `json:"admin,omitempty"`
+	// removes this subscription from the subscription trie of the engine.
+	Handle *util.TrieHandle[*SubscribeSet] `json:"-"`
 }
 
 func (self *SubscribeSet) String() string {
@@ -7,34 +7,117 @@ package configuration
 import (
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/chobie/momonga/encoding/mqtt"
 	"io/ioutil"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	Server Server `toml:"server"`
-	Engine Engine `toml:"engine"`
+	Server  Server   `toml:"server"`
+	Engine  Engine   `toml:"engine"`
+	Tenants []Tenant `toml:"tenant"`
 }
 
 type Engine struct {
-	QueueSize         int    `toml:queue_size`
-	AcceptorCount     string `toml:acceptor_count`
-	LockPoolSize      int    `toml:lock_pool_size`
-	EnableSys         bool   `toml:"enable_sys"`
-	FanoutWorkerCount string `toml:fanout_worker_count`
+	QueueSize                int           `toml:queue_size`
+	AcceptorCount            string        `toml:acceptor_count`
+	LockPoolSize             int           `toml:lock_pool_size`
+	EnableSys                bool          `toml:"enable_sys"`
+	FanoutWorkerCount        string        `toml:fanout_worker_count`
+	MaxQos                   int           `toml:"max_qos"`
+	QosLimits                []QosLimit    `toml:"qos_limit"`
+	OverlappingSubscriptions string        `toml:"overlapping_subscriptions"`
+	MaxQueuedMessages        int           `toml:"max_queued_messages"`
+	MaxQueuedBytes           int           `toml:"max_queued_bytes"`
+	MaxInflightMessages      int           `toml:"max_inflight_messages"`
+	SlowConsumerPolicy       string        `toml:"slow_consumer_policy"`
+	RewriteRules             []RewriteRule `toml:"rewrite"`
+	ClientEvents             bool          `toml:"client_events"`
+	Schemas                  []Schema      `toml:"schema"`
+	DeadLetterTopic          string        `toml:"dead_letter_topic"`
+	KeepaliveOverride        int           `toml:"keepalive_override"`
+	MaxKeepalive             int           `toml:"max_keepalive"`
+	SessionExpiry            int           `toml:"session_expiry"`
+	MatchCacheSize           int           `toml:"match_cache_size"`
+	Datastore                string        `toml:"datastore"`
+	DatastoreDir             string        `toml:"datastore_dir"`
+	DatastoreSync            string        `toml:"datastore_sync"`
+	DatastoreCompaction      int           `toml:"datastore_compaction"`
+}
+
+// QosLimit lowers the maximum QoS for subscriptions which match Topic (a topic filter)
+// and / or User. MaxQos -1 refuses the subscription.
+type QosLimit struct {
+	Topic  string `toml:"topic"`
+	User   string `toml:"user"`
+	MaxQos int    `toml:"max_qos"`
+}
+
+// RewriteRule rewrites topic names of inbound PUBLISH and topic filters of SUBSCRIBE.
+//
+// From / To are topic filters: "+" and "#" in From capture levels which are put into
+// the wildcards of To in the same order. these rules are reversible, so subscribers
+// receive messages with the topic they subscribed to.
+//
+// Regexp / Replacement rewrite with regexp.ReplaceAllString. these rules are one-way.
+type RewriteRule struct {
+	From        string `toml:"from"`
+	To          string `toml:"to"`
+	Regexp      string `toml:"regexp"`
+	Replacement string `toml:"replacement"`
+}
+
+// Schema validates payloads of PUBLISH messages whose topic matches Topic (a topic filter).
+// the first matching schema is used.
+//
+// Schema (or SchemaFile) is a JSON Schema. Fields is a shorthand for a JSON object with typed fields:
+// field name -> "string", "number", "integer", "boolean", "object", "array" or "null".
+// a type followed by "?" makes the field optional.
+//
+// rejected messages are forwarded to DeadLetterTopic (or the engine dead_letter_topic) when it is set.
+type Schema struct {
+	Topic           string            `toml:"topic"`
+	Schema          string            `toml:"schema"`
+	SchemaFile      string            `toml:"schema_file"`
+	Fields          map[string]string `toml:"fields"`
+	DeadLetterTopic string            `toml:"dead_letter_topic"`
+}
+
+// Tenant isolates its clients in their own topic namespace. every topic and topic filter of
+// the clients is prefixed with Mountpoint ("$tenant/<name>/" by default), so they can't reach
+// other namespaces even with wildcards.
+//
+// a client belongs to the first tenant which lists its username in Users, then the first tenant
+// whose UserPrefix its username starts with, then the first tenant of the listener
+// ("tcp", "unix" or "websocket") it connected to.
+type Tenant struct {
+	Name           string   `toml:"name"`
+	Mountpoint     string   `toml:"mountpoint"`
+	Users          []string `toml:"users"`
+	UserPrefix     string   `toml:"user_prefix"`
+	Listener       string   `toml:"listener"`
+	MaxConnections int      `toml:"max_connections"`
+	// nil means the engine max_qos. -1 refuses every subscription.
+	MaxQos *int `toml:"max_qos"`
 }
 
 type Server struct {
-	LogFile        string `toml:"log_file"`
-	LogLevel       string `toml:"log_level"`
-	PidFile        string `toml:"pid_file"`
-	BindAddress    string `toml:"bind_address"`
-	Port           int    `toml:"port"`
-	Socket         string `toml:"socket"`
-	HttpPort       int    `toml:"http_port"`
-	WebSocketMount string `toml:"websocket_mount"`
+	LogFile         string `toml:"log_file"`
+	LogLevel        string `toml:"log_level"`
+	PidFile         string `toml:"pid_file"`
+	BindAddress     string `toml:"bind_address"`
+	Port            int    `toml:"port"`
+	Socket          string `toml:"socket"`
+	HttpPort        int    `toml:"http_port"`
+	WebSocketMount  string `toml:"websocket_mount"`
+	ShutdownTimeout int    `toml:"shutdown_timeout"`
+	AuditLog        string `toml:"audit_log"`
+	AuditLogSize    int    `toml:"audit_log_size"`
+	AuditLogFiles   int    `toml:"audit_log_files"`
+	AuditSys        bool   `toml:"audit_sys"`
 }
 
 func (self *Config) GetQueueSize() int {
@@ -53,6 +136,46 @@ func (self *Config) GetFanoutWorkerCount() int {
 	}
 }
 
+// GetMaxQos returns the maximum QoS the broker grants to user for topic filter.
+// a limit applies when some topic matches both its topic and filter, so wildcards can't bypass it.
+// when several limits apply, the lowest one wins.
+func (self *Config) GetMaxQos(user, filter string) int {
+	max := self.Engine.MaxQos
+	if max > 2 {
+		max = 2
+	}
+
+	for _, limit := range self.Engine.QosLimits {
+		if limit.User != "" && limit.User != user {
+			continue
+		}
+		if limit.Topic != "" && !mqtt.TopicFilterOverlap(limit.Topic, filter) {
+			continue
+		}
+		if limit.MaxQos < max {
+			max = limit.MaxQos
+		}
+	}
+
+	return max
+}
+
+// DeliverPerSubscription reports whether a client with overlapping subscriptions receives
+// one message for each matching subscription instead of one message with the highest QoS.
+func (self *Config) DeliverPerSubscription() bool {
+	return strings.ToLower(self.Engine.OverlappingSubscriptions) == "each"
+}
+
+// GetSlowConsumerPolicy returns "drop", "spill" or "disconnect".
+func (self *Config) GetSlowConsumerPolicy() string {
+	switch v := strings.ToLower(self.Engine.SlowConsumerPolicy); v {
+	case "spill", "disconnect":
+		return v
+	default:
+		return "drop"
+	}
+}
+
 func (self *Config) GetLockPoolSize() int {
 	return self.Engine.LockPoolSize
 }
@@ -83,6 +206,20 @@ func (self *Config) GetSSLListenAddress() string {
 	return fmt.Sprintf("%s:8883", self.Server.BindAddress)
 }
 
+func (self *Config) GetShutdownTimeout() time.Duration {
+	return time.Duration(self.Server.ShutdownTimeout) * time.Second
+}
+
+// GetSessionExpiry returns how long a disconnected persistent session is kept. 0 means forever.
+func (self *Config) GetSessionExpiry() time.Duration {
+	return time.Duration(self.Engine.SessionExpiry) * time.Second
+}
+
+// GetDatastoreCompaction returns how often the disk datastore checks whether its log needs compaction.
+func (self *Config) GetDatastoreCompaction() time.Duration {
+	return time.Duration(self.Engine.DatastoreCompaction) * time.Second
+}
+
 func (self *Config) GetSocketAddress() string {
 	return self.Server.Socket
 }
@@ -90,21 +227,37 @@ func (self *Config) GetSocketAddress() string {
 func DefaultConfiguration() *Config {
 	return &Config{
 		Engine: Engine{
-			QueueSize:         8192,
-			AcceptorCount:     "cpu",
-			FanoutWorkerCount: "cpu",
-			LockPoolSize:      64,
-			EnableSys:         true,
+			QueueSize:                8192,
+			AcceptorCount:            "cpu",
+			FanoutWorkerCount:        "cpu",
+			LockPoolSize:             64,
+			EnableSys:                true,
+			MaxQos:                   2,
+			OverlappingSubscriptions: "highest",
+			MaxQueuedMessages:        1000,
+			MaxQueuedBytes:           0,
+			MaxInflightMessages:      20,
+			SlowConsumerPolicy:       "drop",
+			ClientEvents:             false,
+			Datastore:                "memory",
+			DatastoreDir:             "/var/lib/momonga",
+			DatastoreSync:            "interval",
+			DatastoreCompaction:      300,
 		},
 		Server: Server{
-			LogFile:        "stdout",
-			LogLevel:       "debug",
-			PidFile:        "",
-			BindAddress:    "localhost",
-			Port:           1883,
-			Socket:         "",
-			HttpPort:       9000,
-			WebSocketMount: "/mqtt",
+			LogFile:         "stdout",
+			LogLevel:        "debug",
+			PidFile:         "",
+			BindAddress:     "localhost",
+			Port:            1883,
+			Socket:          "",
+			HttpPort:        9000,
+			WebSocketMount:  "/mqtt",
+			ShutdownTimeout: 30,
+			AuditLog:        "",
+			AuditLogSize:    100 * 1024 * 1024,
+			AuditLogFiles:   10,
+			AuditSys:        false,
 		},
 	}
 }
@@ -117,8 +270,8 @@ func LoadConfiguration(configFile string) (*Config, error) {
 		return config, err
 	}
 
-	if _, err2 := toml.Decode(string(data), config); err != nil {
-		return config, err2
+	if _, err := toml.Decode(string(data), config); err != nil {
+		return config, err
 	}
 
 	return config, nil
@@ -130,8 +283,8 @@ func LoadConfigurationTo(configFile string, to *Config) error {
 		return err
 	}
 
-	if _, err2 := toml.Decode(string(data), to); err != nil {
-		return err2
+	if _, err := toml.Decode(string(data), to); err != nil {
+		return err
 	}
 
 	return nil
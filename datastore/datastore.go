@@ -4,8 +4,19 @@
 
 package datastore
 
+import (
+	"errors"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Iterator iterates over keys in ascending order.
+// Seek moves to the first key which is equal to or greater than key. Next and Prev make the iterator
+// invalid when they pass the last or the first key.
 type Iterator interface {
 	Seek(key []byte)
+	SeekToFirst()
+	SeekToLast()
 	Key() []byte
 	Value() []byte
 	Next()
@@ -20,6 +31,7 @@ type Datastore interface {
 	Path() string
 	Put(key, value []byte) error
 	Get(key []byte) ([]byte, error)
+	// Del deletes keys from first to last (inclusive) at once.
 	Del(first, last []byte) error
 	Iterator() Iterator
 	Close() error
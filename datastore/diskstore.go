@@ -0,0 +1,482 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/chobie/momonga/skiplist"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	SYNC_ALWAYS   = "always"
+	SYNC_INTERVAL = "interval"
+	SYNC_NEVER    = "never"
+)
+
+const (
+	walPut byte = 1
+	walDel byte = 2
+
+	// crc32 (4) | op (1) | key length (4) | value length (4)
+	walHeaderSize = 13
+)
+
+var ErrClosed = errors.New("datastore is closed")
+
+// DiskstoreOptions controls durability and compaction of a Diskstore.
+type DiskstoreOptions struct {
+	// SYNC_ALWAYS fsyncs every write, SYNC_INTERVAL fsyncs every SyncInterval
+	// and SYNC_NEVER leaves it to the OS.
+	Sync         string
+	SyncInterval time.Duration
+	// how often the log is checked for compaction. 0 disables periodic compaction.
+	CompactionInterval time.Duration
+	// the log is compacted when it is larger than this and more than half of it is garbage.
+	CompactionMinSize int64
+}
+
+func DefaultDiskstoreOptions() DiskstoreOptions {
+	return DiskstoreOptions{
+		Sync:               SYNC_INTERVAL,
+		SyncInterval:       time.Second,
+		CompactionInterval: time.Minute * 5,
+		CompactionMinSize:  1024 * 1024,
+	}
+}
+
+// Diskstore is a Datastore which persists its contents in an append-only write-ahead log.
+// every key lives in memory as well (the same skiplist Memstore uses), so iteration doesn't touch the disk.
+// the log is replayed on open. a torn or corrupted tail (e.g. a crash while writing) is truncated.
+type Diskstore struct {
+	Storage *skiplist.SkipList
+	Mutex   *sync.RWMutex
+	options DiskstoreOptions
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	// bytes in the log and bytes of records which are still alive.
+	size  int64
+	live  int64
+	dirty bool
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func OpenDiskstore(path string, options DiskstoreOptions) (*Diskstore, error) {
+	switch options.Sync {
+	case "":
+		options.Sync = SYNC_INTERVAL
+	case SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NEVER:
+	default:
+		return nil, fmt.Errorf("unknown sync policy %q", options.Sync)
+	}
+	if options.Sync == SYNC_INTERVAL && options.SyncInterval <= 0 {
+		options.SyncInterval = time.Second
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// a leftover of a compaction which didn't finish. the log itself is still intact.
+	os.Remove(path + ".compact")
+
+	self := &Diskstore{
+		Storage: skiplist.NewSkipList(&skiplist.BytesComparator{}),
+		Mutex:   &sync.RWMutex{},
+		options: options,
+		path:    path,
+		quit:    make(chan struct{}),
+	}
+
+	if err := self.recover(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	self.file = file
+	self.writer = bufio.NewWriter(file)
+
+	if options.Sync == SYNC_INTERVAL || options.CompactionInterval > 0 {
+		self.wg.Add(1)
+		go self.background()
+	}
+	return self, nil
+}
+
+// recover replays the log into Storage.
+func (self *Diskstore) recover() error {
+	file, err := os.Open(self.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		op, key, value, n, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// everything after a broken record can't be trusted.
+			if err := os.Truncate(self.path, offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		self.apply(op, key, value, n)
+		offset += n
+	}
+	self.size = offset
+	return nil
+}
+
+func readRecord(reader io.Reader) (op byte, key, value []byte, n int64, err error) {
+	header := make([]byte, walHeaderSize)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("torn record")
+		}
+		return
+	}
+
+	op = header[4]
+	keyLen := binary.BigEndian.Uint32(header[5:9])
+	valueLen := binary.BigEndian.Uint32(header[9:13])
+	if (op != walPut && op != walDel) || keyLen > 1<<30 || valueLen > 1<<30 {
+		err = errors.New("corrupted record")
+		return
+	}
+
+	body := make([]byte, keyLen+valueLen)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		err = errors.New("torn record")
+		return
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[:4]) {
+		err = errors.New("checksum mismatch")
+		return
+	}
+
+	key = body[:keyLen]
+	value = body[keyLen:]
+	n = int64(walHeaderSize + len(body))
+	return
+}
+
+func encodeRecord(buffer *bytes.Buffer, op byte, key, value []byte) int64 {
+	header := make([]byte, walHeaderSize)
+	header[4] = op
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(value)))
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(key)
+	crc.Write(value)
+	binary.BigEndian.PutUint32(header[:4], crc.Sum32())
+
+	buffer.Write(header)
+	buffer.Write(key)
+	buffer.Write(value)
+	return int64(walHeaderSize + len(key) + len(value))
+}
+
+func recordSize(key, value []byte) int64 {
+	return int64(walHeaderSize + len(key) + len(value))
+}
+
+// apply updates Storage with a record of n bytes. the caller holds the lock (or owns self).
+func (self *Diskstore) apply(op byte, key, value []byte, n int64) {
+	itr := self.Storage.Iterator()
+	itr.Seek(key)
+	if itr.Valid() && bytes.Equal(itr.Key().([]byte), key) {
+		self.live -= recordSize(key, itr.Value().([]byte))
+		self.Storage.Delete(key)
+	}
+
+	if op == walPut {
+		self.Storage.Insert(key, value)
+		self.live += n
+	}
+}
+
+// write appends records in buffer to the log. the caller holds the write lock.
+func (self *Diskstore) write(buffer *bytes.Buffer) error {
+	n, err := self.writer.Write(buffer.Bytes())
+	self.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	switch self.options.Sync {
+	case SYNC_ALWAYS:
+		if err := self.writer.Flush(); err != nil {
+			return err
+		}
+		return self.file.Sync()
+	case SYNC_NEVER:
+		return self.writer.Flush()
+	}
+	self.dirty = true
+	return nil
+}
+
+func (self *Diskstore) Name() string {
+	return "diskstore"
+}
+
+func (self *Diskstore) Path() string {
+	return self.path
+}
+
+func (self *Diskstore) Put(key, value []byte) error {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	if self.file == nil {
+		return ErrClosed
+	}
+
+	// callers might reuse their buffers.
+	key = append([]byte(nil), key...)
+	value = append([]byte(nil), value...)
+
+	buffer := bytes.NewBuffer(nil)
+	n := encodeRecord(buffer, walPut, key, value)
+	if err := self.write(buffer); err != nil {
+		return err
+	}
+	self.apply(walPut, key, value, n)
+	return nil
+}
+
+func (self *Diskstore) Get(key []byte) ([]byte, error) {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
+	if self.file == nil {
+		return nil, ErrClosed
+	}
+
+	itr := self.Storage.Iterator()
+	itr.Seek(key)
+	if itr.Valid() && bytes.Equal(itr.Key().([]byte), key) {
+		return itr.Value().([]byte), nil
+	}
+	return nil, ErrNotFound
+}
+
+// Del deletes keys from first to last (inclusive).
+func (self *Diskstore) Del(first, last []byte) error {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	if self.file == nil {
+		return ErrClosed
+	}
+
+	var targets [][]byte
+	itr := self.Storage.Iterator()
+	for itr.Seek(first); itr.Valid(); itr.Next() {
+		key := itr.Key().([]byte)
+		if bytes.Compare(key, last) > 0 {
+			break
+		}
+		targets = append(targets, key)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	sizes := make([]int64, len(targets))
+	for i, key := range targets {
+		sizes[i] = encodeRecord(buffer, walDel, key, nil)
+	}
+	if err := self.write(buffer); err != nil {
+		return err
+	}
+	for i, key := range targets {
+		self.apply(walDel, key, nil, sizes[i])
+	}
+	return nil
+}
+
+// Iterator iterates over keys in order. like Memstore, it isn't safe to write while iterating.
+func (self *Diskstore) Iterator() Iterator {
+	return &MemstoreIterator{
+		Iterator: self.Storage.Iterator(),
+	}
+}
+
+// Sync flushes buffered records and fsyncs the log.
+func (self *Diskstore) Sync() error {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	return self.sync()
+}
+
+func (self *Diskstore) sync() error {
+	if self.file == nil {
+		return ErrClosed
+	}
+	if err := self.writer.Flush(); err != nil {
+		return err
+	}
+	self.dirty = false
+	return self.file.Sync()
+}
+
+// Compact rewrites the log with live records only.
+func (self *Diskstore) Compact() error {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	return self.compact()
+}
+
+func (self *Diskstore) compact() error {
+	if self.file == nil {
+		return ErrClosed
+	}
+	if err := self.writer.Flush(); err != nil {
+		return err
+	}
+
+	temp := self.path + ".compact"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	writer := bufio.NewWriter(file)
+	buffer := bytes.NewBuffer(nil)
+	itr := self.Storage.Iterator()
+	for ; itr.Valid(); itr.Next() {
+		buffer.Reset()
+		size += encodeRecord(buffer, walPut, itr.Key().([]byte), itr.Value().([]byte))
+		if _, err = writer.Write(buffer.Bytes()); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	// rename is atomic: a crash leaves either the old log or the compacted one.
+	if err := os.Rename(temp, self.path); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	syncDir(filepath.Dir(self.path))
+
+	self.file.Close()
+	self.file, err = os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		self.file = nil
+		return err
+	}
+	self.writer.Reset(self.file)
+	self.size = size
+	self.live = size
+	self.dirty = false
+	return nil
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func (self *Diskstore) shouldCompact() bool {
+	return self.size > self.options.CompactionMinSize && self.size-self.live > self.live
+}
+
+func (self *Diskstore) background() {
+	defer self.wg.Done()
+
+	var syncTick, compactTick <-chan time.Time
+	if self.options.Sync == SYNC_INTERVAL {
+		ticker := time.NewTicker(self.options.SyncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	if self.options.CompactionInterval > 0 {
+		ticker := time.NewTicker(self.options.CompactionInterval)
+		defer ticker.Stop()
+		compactTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-syncTick:
+			self.Mutex.Lock()
+			if self.dirty && self.file != nil {
+				self.sync()
+			}
+			self.Mutex.Unlock()
+		case <-compactTick:
+			self.Mutex.Lock()
+			if self.file != nil && self.shouldCompact() {
+				self.compact()
+			}
+			self.Mutex.Unlock()
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the log. the store can't be used after that.
+func (self *Diskstore) Close() error {
+	self.Mutex.Lock()
+	if self.file == nil {
+		self.Mutex.Unlock()
+		return nil
+	}
+	err := self.sync()
+	if e := self.file.Close(); err == nil {
+		err = e
+	}
+	self.file = nil
+	self.Mutex.Unlock()
+
+	close(self.quit)
+	self.wg.Wait()
+	return err
+}
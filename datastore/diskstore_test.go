@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"fmt"
+	. "gopkg.in/check.v1"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func openTestDiskstore(c *C, path string) *Diskstore {
+	options := DefaultDiskstoreOptions()
+	options.Sync = SYNC_NEVER
+	options.CompactionInterval = 0
+	store, err := OpenDiskstore(path, options)
+	c.Assert(err, IsNil)
+	return store
+}
+
+func (s *DatastoreSuite) TestDiskstore(c *C) {
+	dir := c.MkDir()
+	count := 0
+	testDatastore(c, func() Datastore {
+		count++
+		return openTestDiskstore(c, filepath.Join(dir, fmt.Sprintf("%d.wal", count)))
+	})
+}
+
+func (s *DatastoreSuite) TestDiskstoreRecovery(c *C) {
+	path := filepath.Join(c.MkDir(), "retained.wal")
+
+	store := openTestDiskstore(c, path)
+	store.Put([]byte("a/1"), []byte("one"))
+	store.Put([]byte("a/2"), []byte("two"))
+	store.Put([]byte("a/3"), []byte("three"))
+	store.Put([]byte("a/2"), []byte("zwei"))
+	store.Del([]byte("a/3"), []byte("a/3"))
+	c.Assert(store.Close(), IsNil)
+	_, err := store.Get([]byte("a/1"))
+	c.Assert(err, Equals, ErrClosed)
+
+	store = openTestDiskstore(c, path)
+	value, err := store.Get([]byte("a/2"))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("zwei"))
+	_, err = store.Get([]byte("a/3"))
+	c.Assert(err, Equals, ErrNotFound)
+
+	var keys []string
+	for itr := store.Iterator(); itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	c.Assert(keys, DeepEquals, []string{"a/1", "a/2"})
+
+	store.Put([]byte("a/4"), []byte("four"))
+	c.Assert(store.Close(), IsNil)
+
+	// a crash while appending leaves a torn record.
+	info, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(os.Truncate(path, info.Size()-2), IsNil)
+
+	store = openTestDiskstore(c, path)
+	_, err = store.Get([]byte("a/4"))
+	c.Assert(err, Equals, ErrNotFound)
+	value, err = store.Get([]byte("a/1"))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("one"))
+
+	// the torn tail is truncated, so new records are readable again.
+	store.Put([]byte("a/5"), []byte("five"))
+	c.Assert(store.Close(), IsNil)
+
+	// so is a corrupted one.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	file.Write([]byte("garbage which isn't a record"))
+	file.Close()
+
+	store = openTestDiskstore(c, path)
+	value, err = store.Get([]byte("a/5"))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("five"))
+	store.Close()
+}
+
+func (s *DatastoreSuite) TestDiskstoreCompaction(c *C) {
+	path := filepath.Join(c.MkDir(), "retained.wal")
+
+	store := openTestDiskstore(c, path)
+	for i := 0; i < 100; i++ {
+		store.Put([]byte("key"), []byte(fmt.Sprintf("value%d", i)))
+	}
+	store.Put([]byte("other"), []byte("value"))
+	store.Del([]byte("other"), []byte("other"))
+
+	before, _ := os.Stat(path)
+	c.Assert(store.Compact(), IsNil)
+	after, _ := os.Stat(path)
+	c.Assert(after.Size() < before.Size(), Equals, true)
+	c.Assert(after.Size(), Equals, recordSize([]byte("key"), []byte("value99")))
+
+	store.Put([]byte("next"), []byte("value"))
+	c.Assert(store.Close(), IsNil)
+
+	store = openTestDiskstore(c, path)
+	value, err := store.Get([]byte("key"))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("value99"))
+	value, err = store.Get([]byte("next"))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("value"))
+	store.Close()
+}
+
+func (s *DatastoreSuite) TestDiskstoreBackground(c *C) {
+	path := filepath.Join(c.MkDir(), "retained.wal")
+
+	store, err := OpenDiskstore(path, DiskstoreOptions{
+		Sync:               SYNC_INTERVAL,
+		SyncInterval:       time.Millisecond * 10,
+		CompactionInterval: time.Millisecond * 10,
+	})
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	for i := 0; i < 10; i++ {
+		store.Put([]byte("key"), []byte("value"))
+	}
+
+	// synced and compacted down to the live record.
+	expected := recordSize([]byte("key"), []byte("value"))
+	for i := 0; i < 100; i++ {
+		if info, _ := os.Stat(path); info.Size() == expected {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	info, _ := os.Stat(path)
+	c.Assert(info.Size(), Equals, expected)
+
+	_, err = OpenDiskstore(path, DiskstoreOptions{Sync: "sometimes"})
+	c.Assert(err, NotNil)
+}
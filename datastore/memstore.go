@@ -6,7 +6,6 @@ package datastore
 
 import (
 	"bytes"
-	"errors"
 	"github.com/chobie/momonga/skiplist"
 	"sync"
 )
@@ -40,7 +39,15 @@ func (self *MemstoreIterator) Next() {
 }
 
 func (self *MemstoreIterator) Prev() {
-	panic("prev is not supported yet")
+	self.Iterator.Prev()
+}
+
+func (self *MemstoreIterator) SeekToFirst() {
+	self.Iterator.Rewind()
+}
+
+func (self *MemstoreIterator) SeekToLast() {
+	self.Iterator.SeekToLast()
 }
 
 func (self *MemstoreIterator) Valid() bool {
@@ -95,17 +102,18 @@ func (self *Memstore) Get(key []byte) ([]byte, error) {
 
 	itr := self.Iterator()
 	itr.Seek(key)
-	if itr.Valid() {
+	if itr.Valid() && bytes.Equal(itr.Key(), key) {
 		return itr.Value(), nil
 	}
 
-	return nil, errors.New("not found")
+	return nil, ErrNotFound
 }
 
 func (self *Memstore) Del(first, last []byte) error {
-	self.Mutex.RLock()
-	itr := self.Iterator()
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
 
+	itr := self.Iterator()
 	var targets [][]byte
 	for itr.Seek(first); itr.Valid(); itr.Next() {
 		key := itr.Key()
@@ -115,14 +123,11 @@ func (self *Memstore) Del(first, last []byte) error {
 		}
 		targets = append(targets, key)
 	}
-	self.Mutex.RUnlock()
 
-	// MEMO: this is more safely.
-	self.Mutex.Lock()
+	// deleting the current node invalidates the iterator.
 	for i := range targets {
 		self.Storage.Delete(targets[i])
 	}
-	self.Mutex.Unlock()
 
 	return nil
 }
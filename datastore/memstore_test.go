@@ -13,51 +13,96 @@ type DatastoreSuite struct{}
 var _ = Suite(&DatastoreSuite{})
 
 func (s *DatastoreSuite) TestMemstore(c *C) {
-	memstore := NewMemstore()
+	testDatastore(c, func() Datastore {
+		return NewMemstore()
+	})
+}
+
+// testDatastore runs the common behaviour of Datastore implementations. open returns an empty store.
+func testDatastore(c *C, open func() Datastore) {
+	store := open()
 	var err error
 
-	err = memstore.Put([]byte("key1"), []byte("value1"))
+	err = store.Put([]byte("key1"), []byte("value1"))
 	c.Assert(err, Equals, nil)
-	err = memstore.Put([]byte("key2"), []byte("value2"))
+	err = store.Put([]byte("key2"), []byte("value2"))
 	c.Assert(err, Equals, nil)
-	err = memstore.Put([]byte("key3"), []byte("value3"))
+	err = store.Put([]byte("key3"), []byte("value3"))
 	c.Assert(err, Equals, nil)
 
-	value, err := memstore.Get([]byte("key1"))
+	value, err := store.Get([]byte("key1"))
 	c.Assert(err, Equals, nil)
 	c.Assert(value, DeepEquals, []byte("value1"))
 
-	memstore.Del([]byte("key1"), []byte("key1"))
+	store.Del([]byte("key1"), []byte("key1"))
 	//TopicA/C
 	//TopicA/B
 
-	memstore = NewMemstore()
-	memstore.Put([]byte("$SYS/broker/broker/version"), []byte("a"))
-	memstore.Put([]byte("Topic/C"), []byte("a"))
-	memstore.Put([]byte("TopicA/C"), []byte("a"))
-	memstore.Put([]byte("TopicA/B"), []byte("a"))
+	store = open()
+	store.Put([]byte("$SYS/broker/broker/version"), []byte("a"))
+	store.Put([]byte("Topic/C"), []byte("a"))
+	store.Put([]byte("TopicA/C"), []byte("a"))
+	store.Put([]byte("TopicA/B"), []byte("a"))
 
-	itr := memstore.Iterator()
+	itr := store.Iterator()
 	var targets []string
 	for ; itr.Valid(); itr.Next() {
 		x := itr.Key()
 		targets = append(targets, string(x))
 	}
 	for _, s := range targets {
-		memstore.Del([]byte(s), []byte(s))
+		store.Del([]byte(s), []byte(s))
 	}
 
-	_, err = memstore.Get([]byte("Topic/C"))
+	_, err = store.Get([]byte("Topic/C"))
 	c.Assert(err.Error(), Equals, "not found")
 
-	//	fmt.Printf("\n")
-	//	for itr := memstore.Iterator(); itr.Valid(); itr.Next() {
-	//		fmt.Printf("key: %s\n", itr.Key())
-	//	}
+	// Get doesn't return the value of the next key.
+	store.Put([]byte("key_other"), []byte("a"))
+	value, err = store.Get([]byte("key_nothing"))
+	c.Assert(err, Equals, ErrNotFound)
+	c.Assert(value, DeepEquals, []byte(nil))
+
+	store = open()
+	for _, key := range []string{"a", "b/1", "b/2", "b/3", "c"} {
+		store.Put([]byte(key), []byte("value of "+key))
+	}
+
+	// Seek moves to the key or the next one.
+	itr = store.Iterator()
+	itr.Seek([]byte("b/2"))
+	c.Assert(string(itr.Key()), Equals, "b/2")
+	c.Assert(string(itr.Value()), Equals, "value of b/2")
+	itr.Seek([]byte("b/25"))
+	c.Assert(string(itr.Key()), Equals, "b/3")
+	itr.Seek([]byte("d"))
+	c.Assert(itr.Valid(), Equals, false)
+
+	var keys []string
+	for itr.SeekToLast(); itr.Valid(); itr.Prev() {
+		keys = append(keys, string(itr.Key()))
+	}
+	c.Assert(keys, DeepEquals, []string{"c", "b/3", "b/2", "b/1", "a"})
+
+	itr.SeekToFirst()
+	c.Assert(string(itr.Key()), Equals, "a")
+	itr.Next()
+	itr.Next()
+	itr.Prev()
+	c.Assert(string(itr.Key()), Equals, "b/1")
+
+	// Del deletes the whole range.
+	c.Assert(store.Del([]byte("b"), []byte("b/2")), Equals, nil)
+	keys = nil
+	for itr = store.Iterator(); itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	c.Assert(keys, DeepEquals, []string{"a", "b/3", "c"})
 
-	//
-	//	value, err = memstore.Get([]byte("key_nothing"))
-	//	c.Assert(err.Error(), Equals, "not found")
-	//	c.Assert(value, DeepEquals, []byte(nil))
-	//
+	itr.SeekToLast()
+	c.Assert(string(itr.Key()), Equals, "c")
+	itr.Prev()
+	c.Assert(string(itr.Key()), Equals, "b/3")
+	itr.Prev()
+	c.Assert(string(itr.Key()), Equals, "a")
 }
@@ -0,0 +1,160 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"bytes"
+)
+
+// RangeIterator limits an Iterator to keys from First to Last (inclusive) which start with Prefix.
+// nil First / Last means unbounded.
+type RangeIterator struct {
+	Iterator Iterator
+	First    []byte
+	Last     []byte
+	Prefix   []byte
+}
+
+// Range iterates over keys of store from first to last (inclusive). the iterator starts at first.
+func Range(store Datastore, first, last []byte) Iterator {
+	itr := &RangeIterator{
+		Iterator: store.Iterator(),
+		First:    first,
+		Last:     last,
+	}
+	itr.SeekToFirst()
+	return itr
+}
+
+// Prefix iterates over keys of store which start with prefix. the iterator starts at the first one.
+func Prefix(store Datastore, prefix []byte) Iterator {
+	itr := &RangeIterator{
+		Iterator: store.Iterator(),
+		First:    prefix,
+		Prefix:   prefix,
+	}
+	itr.SeekToFirst()
+	return itr
+}
+
+// DelPrefix deletes keys of store which start with prefix and returns how many of them were deleted.
+// keys with the same prefix are contiguous, so they are deleted with one Del.
+func DelPrefix(store Datastore, prefix []byte) (int, error) {
+	var first, last []byte
+	count := 0
+	for itr := Prefix(store, prefix); itr.Valid(); itr.Next() {
+		if first == nil {
+			first = itr.Key()
+		}
+		last = itr.Key()
+		count++
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+	if err := store.Del(first, last); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// PrefixSuccessor returns the smallest key which is greater than every key starting with prefix.
+// nil means there is no such key (prefix is empty or consists of 0xff).
+func PrefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			limit := append([]byte(nil), prefix[:i+1]...)
+			limit[i]++
+			return limit
+		}
+	}
+	return nil
+}
+
+func (self *RangeIterator) Seek(key []byte) {
+	if self.First != nil && bytes.Compare(key, self.First) < 0 {
+		key = self.First
+	}
+	self.Iterator.Seek(key)
+}
+
+func (self *RangeIterator) SeekToFirst() {
+	if self.First != nil {
+		self.Iterator.Seek(self.First)
+	} else {
+		self.Iterator.SeekToFirst()
+	}
+}
+
+func (self *RangeIterator) SeekToLast() {
+	// the last key which is less than limit, or equal to Last.
+	limit := PrefixSuccessor(self.Prefix)
+	if self.Last != nil && (limit == nil || bytes.Compare(self.Last, limit) < 0) {
+		self.Iterator.Seek(self.Last)
+		if !self.Iterator.Valid() {
+			self.Iterator.SeekToLast()
+		} else if bytes.Compare(self.Iterator.Key(), self.Last) > 0 {
+			self.Iterator.Prev()
+		}
+		return
+	}
+
+	if limit == nil {
+		self.Iterator.SeekToLast()
+		return
+	}
+	self.Iterator.Seek(limit)
+	if self.Iterator.Valid() {
+		self.Iterator.Prev()
+	} else {
+		self.Iterator.SeekToLast()
+	}
+}
+
+func (self *RangeIterator) Key() []byte {
+	if !self.Valid() {
+		return nil
+	}
+	return self.Iterator.Key()
+}
+
+func (self *RangeIterator) Value() []byte {
+	if !self.Valid() {
+		return nil
+	}
+	return self.Iterator.Value()
+}
+
+func (self *RangeIterator) Next() {
+	self.Iterator.Next()
+}
+
+func (self *RangeIterator) Prev() {
+	self.Iterator.Prev()
+}
+
+func (self *RangeIterator) Valid() bool {
+	if !self.Iterator.Valid() {
+		return false
+	}
+
+	key := self.Iterator.Key()
+	if self.First != nil && bytes.Compare(key, self.First) < 0 {
+		return false
+	}
+	if self.Last != nil && bytes.Compare(key, self.Last) > 0 {
+		return false
+	}
+	return bytes.HasPrefix(key, self.Prefix)
+}
+
+func (self *RangeIterator) Error() error {
+	return self.Iterator.Error()
+}
+
+func (self *RangeIterator) Close() error {
+	return self.Iterator.Close()
+}
@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func keysOf(itr Iterator) []string {
+	keys := []string{}
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	return keys
+}
+
+func reverseKeysOf(itr Iterator) []string {
+	keys := []string{}
+	for itr.SeekToLast(); itr.Valid(); itr.Prev() {
+		keys = append(keys, string(itr.Key()))
+	}
+	return keys
+}
+
+func (s *DatastoreSuite) TestRange(c *C) {
+	store := NewMemstore()
+	for _, key := range []string{"a", "sport", "sport/tennis", "sport/tennis/player1", "sportx", "z"} {
+		store.Put([]byte(key), []byte("value"))
+	}
+
+	c.Assert(keysOf(Range(store, []byte("b"), []byte("sport/tennis"))), DeepEquals, []string{"sport", "sport/tennis"})
+	c.Assert(reverseKeysOf(Range(store, []byte("b"), []byte("sport/tennis"))), DeepEquals, []string{"sport/tennis", "sport"})
+	c.Assert(keysOf(Range(store, nil, []byte("b"))), DeepEquals, []string{"a"})
+	c.Assert(reverseKeysOf(Range(store, []byte("sportx"), nil)), DeepEquals, []string{"z", "sportx"})
+	c.Assert(keysOf(Range(store, []byte("b"), []byte("c"))), DeepEquals, []string{})
+
+	// Seek doesn't leave the range.
+	itr := Range(store, []byte("sport"), []byte("sportx"))
+	itr.Seek([]byte("a"))
+	c.Assert(string(itr.Key()), Equals, "sport")
+	itr.Seek([]byte("z"))
+	c.Assert(itr.Valid(), Equals, false)
+	c.Assert(itr.Key(), IsNil)
+
+	c.Assert(keysOf(Prefix(store, []byte("sport/"))), DeepEquals, []string{"sport/tennis", "sport/tennis/player1"})
+	c.Assert(reverseKeysOf(Prefix(store, []byte("sport"))), DeepEquals, []string{"sportx", "sport/tennis/player1", "sport/tennis", "sport"})
+	c.Assert(keysOf(Prefix(store, []byte("x"))), DeepEquals, []string{})
+	c.Assert(reverseKeysOf(Prefix(store, []byte("x"))), DeepEquals, []string{})
+	c.Assert(len(keysOf(Prefix(store, nil))), Equals, 6)
+
+	c.Assert(PrefixSuccessor([]byte("sport/")), DeepEquals, []byte("sport0"))
+	c.Assert(PrefixSuccessor([]byte{'a', 0xff}), DeepEquals, []byte("b"))
+	c.Assert(PrefixSuccessor([]byte{0xff}), IsNil)
+
+	n, err := DelPrefix(store, []byte("sport/"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(keysOf(store.Iterator()), DeepEquals, []string{"a", "sport", "sportx", "z"})
+
+	n, err = DelPrefix(store, nil)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4)
+	c.Assert(keysOf(store.Iterator()), DeepEquals, []string{})
+}
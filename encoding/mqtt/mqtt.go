@@ -239,7 +239,10 @@ func ParseMessage(reader io.Reader, max_length int) (Message, error) {
 		mm := &PublishMessage{
 			FixedHeader: header,
 		}
-		mm.decode(reader)
+		// the receiver closes the network connection when the topic name is malformed.
+		if err := mm.decode(reader); err != nil {
+			return nil, err
+		}
 		message = mm
 	case PACKET_TYPE_DISCONNECT:
 		mm := &DisconnectMessage{
@@ -47,6 +47,10 @@ func (self *PublishMessage) decode(reader io.Reader) error {
 	}
 
 	self.TopicName = string(buffer[0:length])
+	if err := ValidateTopicName(self.TopicName); err != nil {
+		return err
+	}
+
 	payload_offset := length
 	if self.FixedHeader.QosLevel > 0 {
 		binary.Read(bytes.NewReader(buffer[length:]), binary.BigEndian, &self.PacketIdentifier)
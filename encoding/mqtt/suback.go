@@ -45,17 +45,15 @@ func (self *SubackMessage) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (self *SubackMessage) decode(reader io.Reader) error {
-	var remaining uint8
-	remaining = uint8(self.FixedHeader.RemainingLength)
+	remaining := int(self.FixedHeader.RemainingLength)
 	binary.Read(reader, binary.BigEndian, &self.PacketIdentifier)
 
 	remaining -= 2
 	buffer := bytes.NewBuffer(nil)
-	for i := 0; i <= int(remaining); i++ {
+	for i := 0; i < remaining; i++ {
 		var value uint8 = 0
 		binary.Read(reader, binary.BigEndian, &value)
 		binary.Write(buffer, binary.BigEndian, value)
-		remaining -= 1
 	}
 
 	self.Qos = buffer.Bytes()
@@ -0,0 +1,132 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const MAX_TOPIC_LENGTH = 65535
+
+var (
+	ErrEmptyTopic          = errors.New("topic must be at least one character long")
+	ErrTopicTooLong        = errors.New("topic exceeds 65535 bytes")
+	ErrMalformedUTF8       = errors.New("topic is not well-formed UTF-8")
+	ErrNullCharacter       = errors.New("topic contains U+0000")
+	ErrWildcardInTopicName = errors.New("topic name must not contain wildcard characters")
+	ErrInvalidWildcard     = errors.New("wildcard characters must occupy an entire level")
+)
+
+func validateTopic(topic string) error {
+	// [MQTT-4.7.3-1] All Topic Names and Topic Filters MUST be at least one character long
+	if len(topic) == 0 {
+		return ErrEmptyTopic
+	}
+
+	// [MQTT-4.7.3-3] Topic Names and Topic Filters are UTF-8 encoded strings, they MUST NOT encode to more than 65535 bytes
+	if len(topic) > MAX_TOPIC_LENGTH {
+		return ErrTopicTooLong
+	}
+
+	// [MQTT-1.4.0-1] surrogates (U+D800 - U+DFFF) are also rejected by utf8.ValidString
+	if !utf8.ValidString(topic) {
+		return ErrMalformedUTF8
+	}
+
+	// [MQTT-1.4.0-2] [MQTT-4.7.3-2] Topic Names and Topic Filters MUST NOT include the null character (Unicode U+0000)
+	if strings.IndexRune(topic, 0) >= 0 {
+		return ErrNullCharacter
+	}
+
+	return nil
+}
+
+// ValidateTopicName checks the Topic Name of PUBLISH (and will) messages.
+func ValidateTopicName(topic string) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+
+	// [MQTT-3.3.2-2] The Topic Name in the PUBLISH Packet MUST NOT contain wildcard characters.
+	if strings.ContainsAny(topic, "+#") {
+		return ErrWildcardInTopicName
+	}
+
+	return nil
+}
+
+// ValidateTopicFilter checks the Topic Filter of SUBSCRIBE messages.
+func ValidateTopicFilter(filter string) error {
+	if err := validateTopic(filter); err != nil {
+		return err
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		// [MQTT-4.7.1-2] The multi-level wildcard character MUST be specified either on its own or following
+		// a topic level separator. In either case it MUST be the last character specified in the Topic Filter.
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return ErrInvalidWildcard
+		}
+
+		// [MQTT-4.7.1-3] The single-level wildcard can be used at any level in the Topic Filter,
+		// including first and last levels. Where it is used it MUST occupy an entire level of the filter.
+		if strings.Contains(level, "+") && level != "+" {
+			return ErrInvalidWildcard
+		}
+	}
+
+	return nil
+}
+
+// TopicFilterOverlap reports whether a topic exists which matches both filter a and b.
+func TopicFilterOverlap(a, b string) bool {
+	// [MQTT-4.7.2-1] filters starting with a wildcard character don't match $ topics.
+	if len(a) > 0 && len(b) > 0 && (a[0] == '+' || a[0] == '#') && b[0] == '$' ||
+		len(a) > 0 && len(b) > 0 && (b[0] == '+' || b[0] == '#') && a[0] == '$' {
+		return false
+	}
+
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+	for i := 0; ; i++ {
+		if i < len(as) && as[i] == "#" || i < len(bs) && bs[i] == "#" {
+			return true
+		}
+		if i >= len(as) || i >= len(bs) {
+			return len(as) == len(bs)
+		}
+		if as[i] != "+" && bs[i] != "+" && as[i] != bs[i] {
+			return false
+		}
+	}
+}
+
+// TopicMatch reports whether topic matches filter.
+func TopicMatch(filter, topic string) bool {
+	// [MQTT-4.7.2-1] The Server MUST NOT match Topic Filters starting with a wildcard character (# or +)
+	// with Topic Names beginning with a $ character
+	if len(topic) > 0 && topic[0] == '$' && len(filter) > 0 && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+
+	return len(fs) == len(ts)
+}
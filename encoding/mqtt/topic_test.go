@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"strings"
+)
+
+type TopicSuite struct{}
+
+var _ = Suite(&TopicSuite{})
+
+func (s *TopicSuite) TestValidateTopicName(c *C) {
+	c.Assert(ValidateTopicName("/debug/chobie"), Equals, nil)
+	c.Assert(ValidateTopicName("/"), Equals, nil)
+	c.Assert(ValidateTopicName("$SYS/broker/uptime"), Equals, nil)
+
+	c.Assert(ValidateTopicName(""), Equals, ErrEmptyTopic)
+	c.Assert(ValidateTopicName("a/+/b"), Equals, ErrWildcardInTopicName)
+	c.Assert(ValidateTopicName("a/#"), Equals, ErrWildcardInTopicName)
+	c.Assert(ValidateTopicName("a\x00b"), Equals, ErrNullCharacter)
+	c.Assert(ValidateTopicName("a\xed\xa0\x80"), Equals, ErrMalformedUTF8)
+	c.Assert(ValidateTopicName(strings.Repeat("a", MAX_TOPIC_LENGTH+1)), Equals, ErrTopicTooLong)
+}
+
+func (s *TopicSuite) TestValidateTopicFilter(c *C) {
+	for _, filter := range []string{"#", "+", "/#", "a/#", "+/+", "a/+/b", "/+", "+/tennis/#", "sport/tennis/player1"} {
+		c.Assert(ValidateTopicFilter(filter), Equals, nil, Commentf("%s", filter))
+	}
+
+	for _, filter := range []string{"a/#/b", "foo#", "a/b#", "#/", "sport+", "a/+b", "a/b+/c"} {
+		c.Assert(ValidateTopicFilter(filter), Equals, ErrInvalidWildcard, Commentf("%s", filter))
+	}
+
+	c.Assert(ValidateTopicFilter(""), Equals, ErrEmptyTopic)
+}
+
+func (s *TopicSuite) TestTopicMatch(c *C) {
+	c.Assert(TopicMatch("sport/tennis/#", "sport/tennis"), Equals, true)
+	c.Assert(TopicMatch("sport/tennis/#", "sport/tennis/player1/ranking"), Equals, true)
+	c.Assert(TopicMatch("sport/+", "sport/"), Equals, true)
+	c.Assert(TopicMatch("sport/+", "sport"), Equals, false)
+	c.Assert(TopicMatch("+/+", "/finance"), Equals, true)
+	c.Assert(TopicMatch("/+", "/finance"), Equals, true)
+	c.Assert(TopicMatch("+", "/finance"), Equals, false)
+	c.Assert(TopicMatch("a/b", "a/b/c"), Equals, false)
+
+	c.Assert(TopicMatch("#", "$SYS/broker"), Equals, false)
+	c.Assert(TopicMatch("+/broker", "$SYS/broker"), Equals, false)
+	c.Assert(TopicMatch("$SYS/#", "$SYS/broker"), Equals, true)
+}
+
+func (s *TopicSuite) TestTopicFilterOverlap(c *C) {
+	c.Assert(TopicFilterOverlap("sensors/#", "#"), Equals, true)
+	c.Assert(TopicFilterOverlap("sensors/#", "+/temp"), Equals, true)
+	c.Assert(TopicFilterOverlap("sensors/#", "sensors"), Equals, true)
+	c.Assert(TopicFilterOverlap("sensors/+", "+/+/x"), Equals, false)
+	c.Assert(TopicFilterOverlap("sensors/+", "+/temp"), Equals, true)
+	c.Assert(TopicFilterOverlap("sensors/1", "sensors/2"), Equals, false)
+	c.Assert(TopicFilterOverlap("a/b", "a/b"), Equals, true)
+	c.Assert(TopicFilterOverlap("a/b", "a"), Equals, false)
+
+	c.Assert(TopicFilterOverlap("$SYS/#", "#"), Equals, false)
+	c.Assert(TopicFilterOverlap("+/broker", "$SYS/broker"), Equals, false)
+	c.Assert(TopicFilterOverlap("$SYS/+", "$SYS/broker"), Equals, true)
+}
+
+func (s *TopicSuite) TestParseInvalidPublishTopic(c *C) {
+	m := NewPublishMessage()
+	m.TopicName = "/debug/#"
+	m.Payload = []byte("Hello World")
+	b, _ := Encode(m)
+
+	_, err := ParseMessage(bytes.NewReader(b), 0)
+	c.Assert(err, Equals, ErrWildcardInTopicName)
+}
@@ -40,7 +40,11 @@ func main() {
 
 	confpath, _ := filepath.Abs(*configFile)
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	app := server.NewApplication(confpath)
+	app, err := server.NewApplication(confpath)
+	if err != nil {
+		log.Error("failed to start momonga: %s", err)
+		os.Exit(1)
+	}
 	app.Start()
 	app.Loop()
 
@@ -12,7 +12,11 @@ import (
 	codec "github.com/chobie/momonga/encoding/mqtt"
 	"github.com/chobie/momonga/logger"
 	"github.com/codegangsta/cli"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"time"
 )
@@ -96,6 +100,101 @@ func subscribe(ctx *cli.Context) {
 	}
 }
 
+// admin calls the HTTP admin interface of momonga and copies the response to w.
+func admin(ctx *cli.Context, method, path string, params url.Values, body io.Reader, w io.Writer) {
+	req, err := http.NewRequest(method, ctx.String("admin")+path+"?"+params.Encode(), body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		fmt.Fprintf(os.Stderr, "%s: %s", res.Status, msg)
+		os.Exit(1)
+	}
+	io.Copy(w, res.Body)
+}
+
+func retainExport(ctx *cli.Context) {
+	w := io.Writer(os.Stdout)
+	if path := ctx.String("o"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	admin(ctx, "GET", "/retained", url.Values{"filter": {ctx.String("t")}}, nil, w)
+}
+
+func retainImport(ctx *cli.Context) {
+	r := io.Reader(os.Stdin)
+	if path := ctx.String("i"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	admin(ctx, "POST", "/retained/import", url.Values{}, r, os.Stdout)
+	fmt.Printf(" retained messages imported\n")
+}
+
+func retainDelete(ctx *cli.Context) {
+	filter := ctx.String("t")
+	if filter == "" {
+		fmt.Printf("Topic filter required\n")
+		os.Exit(1)
+	}
+
+	admin(ctx, "POST", "/retained/delete", url.Values{"filter": {filter}}, nil, os.Stdout)
+	fmt.Printf(" retained messages deleted\n")
+}
+
+func clients(ctx *cli.Context) {
+	params := url.Values{
+		"client_id": {ctx.String("c")},
+		"username":  {ctx.String("u,user")},
+		"tenant":    {ctx.String("tenant")},
+		"state":     {ctx.String("state")},
+	}
+	admin(ctx, "GET", "/sessions", params, nil, os.Stdout)
+}
+
+func clientCommand(method, path string) func(*cli.Context) {
+	return func(ctx *cli.Context) {
+		id := ctx.String("c")
+		if id == "" {
+			fmt.Printf("Client identifier required\n")
+			os.Exit(1)
+		}
+
+		params := url.Values{"client_id": {id}}
+		if ctx.Bool("no-will") {
+			params.Set("suppress_will", "true")
+		}
+		admin(ctx, method, path, params, nil, os.Stdout)
+		fmt.Printf("\n")
+	}
+}
+
 func main() {
 	logger.SetupLogging("info", "stdout")
 	app := cli.NewApp()
@@ -146,6 +245,35 @@ func main() {
 	pubFlags := append(commonFlags,
 		cli.BoolFlag{"s", "read message from stdin, sending line by line as a message", ""},
 	)
+	adminFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:   "admin",
+			Value:  "http://localhost:9000",
+			Usage:  "momonga http admin url. Defaults to http://localhost:9000",
+			EnvVar: "MOMONGA_ADMIN",
+		},
+		cli.StringFlag{Name: "t", Usage: "topic filter of retained messages."},
+	}
+	retainExportFlags := append(adminFlags,
+		cli.StringFlag{Name: "o", Usage: "write to the file instead of stdout"},
+	)
+	retainImportFlags := append(adminFlags,
+		cli.StringFlag{Name: "i", Usage: "read from the file instead of stdin"},
+	)
+
+	clientFlags := []cli.Flag{
+		adminFlags[0],
+		cli.StringFlag{Name: "c", Usage: "client identifier (prefix for clients)"},
+	}
+	clientsFlags := append(clientFlags,
+		cli.StringFlag{Name: "u,user", Usage: "username"},
+		cli.StringFlag{Name: "tenant", Usage: "tenant name"},
+		cli.StringFlag{Name: "state", Usage: "connected or offline"},
+	)
+	kickFlags := append(clientFlags,
+		cli.BoolFlag{Name: "no-will", Usage: "don't publish the will message"},
+	)
+
 	app.Action = func(c *cli.Context) {
 		println(app.Usage)
 	}
@@ -163,6 +291,48 @@ func main() {
 			Flags:  subFlags,
 			Action: subscribe,
 		},
+		{
+			Name:   "retain-export",
+			Usage:  "export retained messages (matching -t) as json",
+			Flags:  retainExportFlags,
+			Action: retainExport,
+		},
+		{
+			Name:   "retain-import",
+			Usage:  "import retained messages exported by retain-export",
+			Flags:  retainImportFlags,
+			Action: retainImport,
+		},
+		{
+			Name:   "retain-delete",
+			Usage:  "delete retained messages matching -t",
+			Flags:  adminFlags,
+			Action: retainDelete,
+		},
+		{
+			Name:   "clients",
+			Usage:  "list sessions as json",
+			Flags:  clientsFlags,
+			Action: clients,
+		},
+		{
+			Name:   "client-show",
+			Usage:  "show the session of -c",
+			Flags:  clientFlags,
+			Action: clientCommand("GET", "/sessions/show"),
+		},
+		{
+			Name:   "client-kick",
+			Usage:  "disconnect the client -c",
+			Flags:  kickFlags,
+			Action: clientCommand("POST", "/sessions/kick"),
+		},
+		{
+			Name:   "client-delete",
+			Usage:  "disconnect the client -c and discard its session",
+			Flags:  clientFlags,
+			Action: clientCommand("POST", "/sessions/delete"),
+		},
 	}
 	app.Run(os.Args)
 }
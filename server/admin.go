@@ -0,0 +1,222 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	. "github.com/chobie/momonga/common"
+	log "github.com/chobie/momonga/logger"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrSessionNotConnected = errors.New("session is not connected")
+)
+
+// SessionInfo describes a session for administrators.
+type SessionInfo struct {
+	ClientId      string         `json:"client_id"`
+	UserName      string         `json:"username"`
+	Tenant        string         `json:"tenant,omitempty"`
+	RemoteAddr    string         `json:"remote_addr"`
+	Connected     bool           `json:"connected"`
+	CleanSession  bool           `json:"clean_session"`
+	Keepalive     int            `json:"keepalive"`
+	Subscriptions map[string]int `json:"subscriptions"`
+	Inflight      int            `json:"inflight"`
+	Queued        int            `json:"queued"`
+	QueuedBytes   int64          `json:"queued_bytes"`
+	OfflineQueue  int            `json:"offline_queue"`
+	Created       time.Time      `json:"created"`
+	LastActivity  time.Time      `json:"last_activity"`
+}
+
+// SessionFilter narrows ListSessions. empty fields match everything.
+type SessionFilter struct {
+	// prefix of the client identifier
+	ClientId string
+	UserName string
+	Tenant   string
+	// "connected" or "offline"
+	State string
+}
+
+func (self SessionFilter) match(info *SessionInfo) bool {
+	if !strings.HasPrefix(info.ClientId, self.ClientId) {
+		return false
+	}
+	if self.UserName != "" && self.UserName != info.UserName {
+		return false
+	}
+	if self.Tenant != "" && self.Tenant != info.Tenant {
+		return false
+	}
+	switch self.State {
+	case "connected":
+		return info.Connected
+	case "offline":
+		return !info.Connected
+	}
+	return true
+}
+
+func newSessionInfo(mux *MmuxConnection) *SessionInfo {
+	info := &SessionInfo{
+		ClientId:      mux.Identifier,
+		UserName:      mux.UserName,
+		Tenant:        mux.Tenant.GetName(),
+		CleanSession:  mux.CleanSession,
+		Subscriptions: make(map[string]int),
+		Created:       mux.Created,
+		LastActivity:  mux.Disconnected,
+	}
+	info.Queued, info.QueuedBytes, info.OfflineQueue = mux.QueueStats()
+
+	mux.Mutex.RLock()
+	for filter, set := range mux.SubscribedTopics {
+		info.Subscriptions[filter] = set.QoS
+	}
+	if cn := mux.PrimaryConnection; cn != nil {
+		info.Connected = true
+		info.RemoteAddr = remoteAddr(cn)
+		if c, ok := cn.(*MyConnection); ok {
+			info.Keepalive = c.Keepalive
+			info.Inflight = c.InflightTable.Len()
+			info.LastActivity = c.LastActivity()
+		}
+	}
+	mux.Mutex.RUnlock()
+
+	if info.LastActivity.IsZero() {
+		info.LastActivity = info.Created
+	}
+	return info
+}
+
+// ListSessions returns sessions which match filter ordered by client identifier.
+func (self *Momonga) ListSessions(filter SessionFilter) []*SessionInfo {
+	result := []*SessionInfo{}
+	for _, mux := range self.Sessions() {
+		if info := newSessionInfo(mux); filter.match(info) {
+			result = append(result, info)
+		}
+	}
+
+	sort.Sort(sessionInfoByClientId(result))
+	return result
+}
+
+// SessionDetails returns the session of the client identifier.
+func (self *Momonga) SessionDetails(clientId string) (*SessionInfo, error) {
+	mux, err := self.GetConnectionByClientId(clientId)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	return newSessionInfo(mux), nil
+}
+
+// Kick disconnects the client. the will message is published unless suppressWill is set.
+// the session is kept when it has CleanSession set to 0.
+func (self *Momonga) Kick(clientId string, suppressWill bool) error {
+	lock := self.getSessionLock(clientId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	mux, err := self.GetConnectionByClientId(clientId)
+	if err != nil {
+		return ErrSessionNotFound
+	}
+
+	cleanSession := mux.ShouldClearSession()
+	conns := mux.DetachAll()
+	if len(conns) == 0 {
+		return ErrSessionNotConnected
+	}
+
+	for _, conn := range conns {
+		if !suppressWill && conn.HasWillMessage() {
+			self.SendWillMessage(conn)
+		}
+		disconnected := newClientEvent(mux, conn)
+		disconnected.Reason = "kicked"
+		self.publishClientEvent("disconnected", disconnected)
+	}
+
+	if cleanSession {
+		self.discardSession(mux)
+	} else {
+		self.keepOfflineSession(mux)
+	}
+
+	// the disconnect path of detached connections doesn't touch the session.
+	for _, conn := range conns {
+		closeConnection(conn, "kicked")
+	}
+
+	log.Info("kicked %s (suppress will: %t)", clientId, suppressWill)
+	return nil
+}
+
+// DeleteSession disconnects the client without publishing its will and discards the session
+// (subscriptions, offline queue and inflight messages).
+func (self *Momonga) DeleteSession(clientId string) error {
+	lock := self.getSessionLock(clientId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	mux, err := self.GetConnectionByClientId(clientId)
+	if err != nil {
+		return ErrSessionNotFound
+	}
+
+	conns := mux.DetachAll()
+	for _, conn := range conns {
+		disconnected := newClientEvent(mux, conn)
+		disconnected.Reason = "session deleted"
+		self.publishClientEvent("disconnected", disconnected)
+	}
+
+	self.discardSession(mux)
+	mux.Mutex.Lock()
+	mux.OfflineQueue = mux.OfflineQueue[:0]
+	mux.SubscribedTopics = make(map[string]*SubscribeSet)
+	mux.OutGoingTable.Clean()
+	mux.Mutex.Unlock()
+
+	for _, conn := range conns {
+		closeConnection(conn, "session deleted")
+	}
+
+	log.Info("deleted session %s", clientId)
+	return nil
+}
+
+type sessionInfoByClientId []*SessionInfo
+
+func (self sessionInfoByClientId) Len() int           { return len(self) }
+func (self sessionInfoByClientId) Less(i, j int) bool { return self[i].ClientId < self[j].ClientId }
+func (self sessionInfoByClientId) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// ClearSubscriptions removes every subscription of every session.
+func (self *Momonga) ClearSubscriptions() {
+	for _, mux := range self.Sessions() {
+		mux.Mutex.Lock()
+		for filter, set := range mux.SubscribedTopics {
+			self.Subscriptions.Remove(set.Handle)
+			delete(mux.SubscribedTopics, filter)
+			delete(mux.SubscribeMap, filter)
+		}
+		mux.Mutex.Unlock()
+	}
+
+	// subscriptions of sessions which have gone meanwhile.
+	for _, filter := range self.Subscriptions.Filters() {
+		self.Subscriptions.RemoveFilter(filter)
+	}
+	log.Info("cleared subscriptions")
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"runtime"
 	"strconv"
 	"sync"
 	"syscall"
@@ -27,14 +28,18 @@ type Application struct {
 	execPath   string
 	workingDir string
 	mu         sync.Mutex
+	stopOnce   sync.Once
 }
 
-func NewApplication(configPath string) *Application {
+// NewApplication returns an error when the engine can't be created. see NewMomonga
+func NewApplication(configPath string) (*Application, error) {
 	conf, err := configuration.LoadConfiguration(configPath)
 	if err != nil {
 		log.Error("Can't read config.toml. use default setting.: %s", err)
 	}
 	log.SetupLogging(conf.Server.LogLevel, conf.Server.LogFile)
+	// for /debug/pprof/block
+	runtime.SetBlockProfileRate(1)
 	pid := strconv.Itoa(os.Getpid())
 	if conf.Server.PidFile != "" {
 		if err := ioutil.WriteFile(conf.Server.PidFile, []byte(pid), 0644); err != nil {
@@ -49,7 +54,10 @@ func NewApplication(configPath string) *Application {
 	}
 
 	log.Info("Momonga started pid: %s (inherit:%t)", pid, inherit)
-	engine := NewMomonga(conf)
+	engine, err := NewMomonga(conf)
+	if err != nil {
+		return nil, err
+	}
 	app := &Application{
 		Engine:     engine,
 		Servers:    []Server{},
@@ -76,22 +84,22 @@ func NewApplication(configPath string) *Application {
 	app.execPath, err = exec.LookPath(os.Args[0])
 	if err != nil {
 		log.Error("Error: %s", err)
-		return app
+		return app, nil
 	}
 	app.workingDir, err = os.Getwd()
 	if err != nil {
 		log.Error("Error: %s", err)
-		return app
+		return app, nil
 	}
 
-	return app
+	return app, nil
 }
 
 func (self *Application) Start() {
 	self.wg.Add(1)
 
 	ch := make(chan os.Signal, 1)
-	signals := []os.Signal{syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2}
+	signals := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2}
 	signal.Notify(ch, signals...)
 
 	go func(ch chan os.Signal) {
@@ -99,12 +107,12 @@ func (self *Application) Start() {
 			select {
 			case x := <-ch:
 				switch x {
-				case syscall.SIGINT:
+				case syscall.SIGINT, syscall.SIGTERM:
 					self.Stop()
+					return
 				case syscall.SIGHUP:
 					// reload config
-					log.Info("reload configuration from %s", self.configPath)
-					configuration.LoadConfigurationTo(self.configPath, self.config)
+					self.Reload()
 				case syscall.SIGUSR2:
 					self.mu.Lock()
 					// graceful restart
@@ -169,17 +177,55 @@ func (self *Application) Start() {
 	for i := 0; i < len(self.Servers); i++ {
 		svr := self.Servers[i]
 		self.wg.Add(1)
-		go svr.ListenAndServe()
+		if err := svr.ListenAndServe(); err != nil {
+			log.Error("failed to start %T: %s", svr, err)
+			self.wg.Done()
+			return
+		}
 	}
 }
 
-func (self *Application) Stop() {
-	for i := 0; i < len(self.Servers); i++ {
-		svr := self.Servers[i]
-		svr.Stop()
+// Reload reads the configuration file again and replaces topic rewrite rules and payload schemas.
+// other goroutines read the running configuration, so the file is decoded into a new one.
+func (self *Application) Reload() {
+	log.Info("reload configuration from %s", self.configPath)
+	conf := configuration.DefaultConfiguration()
+	if err := configuration.LoadConfigurationTo(self.configPath, conf); err != nil {
+		log.Error("failed to reload configuration: %s", err)
+		return
+	}
+
+	if err := self.Engine.SetRewriteRules(conf.Engine.RewriteRules); err != nil {
+		log.Error("keep current topic rewrite rules: %s", err)
+	}
+	if err := self.Engine.SetSchemas(conf.Engine.Schemas, conf.Engine.DeadLetterTopic); err != nil {
+		log.Error("keep current payload schemas: %s", err)
 	}
+}
+
+// Stop shuts down the application with the configured shutdown timeout.
+func (self *Application) Stop() {
+	self.Shutdown(self.config.GetShutdownTimeout())
+}
+
+// Shutdown stops accepting new connections, then shuts down the engine (see Momonga.Shutdown).
+// Loop returns after all connections are closed.
+func (self *Application) Shutdown(timeout time.Duration) error {
+	var err error
+	self.stopOnce.Do(func() {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+
+		log.Info("stop accepting new connections")
+		for i := 0; i < len(self.Servers); i++ {
+			svr := self.Servers[i]
+			svr.Stop()
+		}
 
-	self.wg.Done()
+		err = self.Engine.Shutdown(timeout)
+		self.wg.Done()
+	})
+	return err
 }
 
 func (self *Application) Loop() {
@@ -0,0 +1,191 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/chobie/momonga/common"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	log "github.com/chobie/momonga/logger"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const AUDIT_TOPIC = "$SYS/broker/audit"
+
+var ErrAuditLogClosed = errors.New("audit log is closed")
+
+// audit events
+const (
+	AUDIT_CONNECT    = "connect"
+	AUDIT_AUTH       = "auth"
+	AUDIT_ACL_DENIED = "acl_denied"
+	AUDIT_TAKEOVER   = "takeover"
+	AUDIT_DISCONNECT = "disconnect"
+	AUDIT_WILL       = "will"
+)
+
+// AuditEvent is written as one JSON line.
+type AuditEvent struct {
+	Time            time.Time `json:"time"`
+	Event           string    `json:"event"`
+	ClientId        string    `json:"client_id,omitempty"`
+	UserName        string    `json:"username,omitempty"`
+	Tenant          string    `json:"tenant,omitempty"`
+	RemoteAddr      string    `json:"remote_addr,omitempty"`
+	ProtocolVersion int       `json:"protocol_version,omitempty"`
+	CleanSession    *bool     `json:"clean_session,omitempty"`
+	Result          string    `json:"result,omitempty"`
+	Reason          string    `json:"reason,omitempty"`
+	Topic           string    `json:"topic,omitempty"`
+	QoS             *int      `json:"qos,omitempty"`
+}
+
+// AuditLog is an append-only JSON lines file. the file is rotated when it exceeds maxSize:
+// path becomes path.1, path.1 becomes path.2 and so on. at most maxFiles rotated files are kept.
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+func NewAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	self := &AuditLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	os.MkdirAll(filepath.Dir(path), 0744)
+	if err := self.open(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *AuditLog) open() error {
+	f, err := os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	self.file = f
+	self.size = st.Size()
+	return nil
+}
+
+func (self *AuditLog) rotate() error {
+	self.file.Close()
+	self.file = nil
+
+	for i := self.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", self.path, i), fmt.Sprintf("%s.%d", self.path, i+1))
+	}
+	if self.maxFiles > 0 {
+		os.Rename(self.path, self.path+".1")
+	} else {
+		os.Remove(self.path)
+	}
+	return self.open()
+}
+
+func (self *AuditLog) Write(event *AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.file == nil {
+		return ErrAuditLogClosed
+	}
+	if self.maxSize > 0 && self.size > 0 && self.size+int64(len(b)) > self.maxSize {
+		if err := self.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := self.file.Write(b)
+	self.size += int64(n)
+	return err
+}
+
+func (self *AuditLog) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.file == nil {
+		return nil
+	}
+	err := self.file.Close()
+	self.file = nil
+	return err
+}
+
+// audit records event to the audit log and $SYS/broker/audit when they are enabled.
+func (self *Momonga) audit(event *AuditEvent) {
+	if self.AuditLog == nil && !self.config.Server.AuditSys {
+		return
+	}
+
+	event.Time = time.Now()
+	if self.AuditLog != nil {
+		if err := self.AuditLog.Write(event); err != nil {
+			log.Error("failed to write audit log: %s", err)
+		}
+	}
+
+	if self.config.Server.AuditSys {
+		b, _ := json.Marshal(event)
+		msg := codec.NewPublishMessage()
+		msg.TopicName = AUDIT_TOPIC
+		msg.Payload = b
+		// don't block the caller, it might hold a session lock.
+		select {
+		case self.auditQueue <- msg:
+		default:
+			log.Error("audit queue is full. discard %s event of %s", event.Event, event.ClientId)
+		}
+	}
+}
+
+// publishAuditEvents publishes $SYS/broker/audit messages in the order they were recorded.
+func (self *Momonga) publishAuditEvents() {
+	defer self.auditWorker.Done()
+
+	for {
+		select {
+		case msg := <-self.auditQueue:
+			self.SendPublishMessage(msg)
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+func remoteAddr(conn Connection) string {
+	if c, ok := conn.(*MyConnection); ok {
+		if nc, ok := c.MyConnection.(net.Conn); ok {
+			return nc.RemoteAddr().String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,268 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/chobie/momonga/common"
+	"github.com/chobie/momonga/configuration"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrBrokerStarted    = errors.New("broker has been started already")
+	ErrBrokerNotStarted = errors.New("broker is not running")
+)
+
+// Option modifies the configuration of NewBroker.
+type Option func(*configuration.Config)
+
+// WithBindAddress sets the address of the TCP listener.
+func WithBindAddress(address string) Option {
+	return func(config *configuration.Config) {
+		config.Server.BindAddress = address
+	}
+}
+
+// WithPort sets the port of the TCP listener. 0 disables it.
+func WithPort(port int) Option {
+	return func(config *configuration.Config) {
+		config.Server.Port = port
+	}
+}
+
+// WithSocket sets the path of the unix domain socket listener. "" disables it.
+func WithSocket(path string) Option {
+	return func(config *configuration.Config) {
+		config.Server.Socket = path
+	}
+}
+
+// WithHttpPort sets the port of the HTTP (admin and websocket) listener. 0 disables it.
+func WithHttpPort(port int) Option {
+	return func(config *configuration.Config) {
+		config.Server.HttpPort = port
+	}
+}
+
+// Broker is an embeddable momonga broker.
+//
+// Unlike Application, Broker doesn't read configuration files, write pid files,
+// install signal handlers or set up logging.
+//
+//   broker, err := server.NewBroker(nil, server.WithPort(0), server.WithHttpPort(0))
+//   broker.Start(ctx)
+//   sub, _ := broker.Subscribe("sensors/#", 1, func(msg *mqtt.PublishMessage) { ... })
+//   broker.Publish("sensors/1", []byte("hello"), 1, false)
+//   sub.Unsubscribe()
+//   broker.Shutdown(ctx)
+type Broker struct {
+	Engine  *Momonga
+	Servers []Server
+	config  *configuration.Config
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	running bool
+	seq     int64
+}
+
+// NewBroker creates a broker. config might be nil (DefaultConfiguration is used then).
+// see NewMomonga for errors.
+func NewBroker(config *configuration.Config, options ...Option) (*Broker, error) {
+	if config == nil {
+		config = configuration.DefaultConfiguration()
+	}
+	for _, option := range options {
+		option(config)
+	}
+
+	engine, err := NewMomonga(config)
+	if err != nil {
+		return nil, err
+	}
+	broker := &Broker{
+		Engine:  engine,
+		Servers: []Server{},
+		config:  config,
+	}
+
+	if config.Server.Port > 0 {
+		t := NewTcpServer(engine, config, false)
+		t.wg = &broker.wg
+		broker.Servers = append(broker.Servers, t)
+	}
+	if config.Server.Socket != "" {
+		u := NewUnixServer(engine, config, false)
+		u.wg = &broker.wg
+		broker.Servers = append(broker.Servers, u)
+	}
+	if config.Server.HttpPort > 0 {
+		h := NewHttpServer(engine, config, false)
+		h.wg = &broker.wg
+		broker.Servers = append(broker.Servers, h)
+	}
+
+	return broker, nil
+}
+
+func (self *Broker) Config() *configuration.Config {
+	return self.config
+}
+
+// Start runs the engine and listeners. It returns after listeners are ready.
+func (self *Broker) Start(ctx context.Context) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.running {
+		return ErrBrokerStarted
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	self.Engine.Run()
+	for i, svr := range self.Servers {
+		self.wg.Add(1)
+		if err := svr.ListenAndServe(); err != nil {
+			self.wg.Done()
+			for _, started := range self.Servers[:i] {
+				started.Stop()
+			}
+			self.Engine.Terminate()
+			return err
+		}
+	}
+
+	self.running = true
+	return nil
+}
+
+// Shutdown stops accepting connections and shuts down the engine (see Momonga.Shutdown).
+// The deadline of ctx is used as the shutdown timeout, the configured shutdown_timeout otherwise.
+func (self *Broker) Shutdown(ctx context.Context) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if !self.running {
+		return ErrBrokerNotStarted
+	}
+	self.running = false
+
+	for _, svr := range self.Servers {
+		// HttpServer.Stop waits for its connections. don't block here.
+		go svr.Stop()
+	}
+
+	timeout := self.config.GetShutdownTimeout()
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = deadline.Sub(time.Now())
+	}
+	err := self.Engine.Shutdown(timeout)
+
+	done := make(chan bool)
+	go func() {
+		self.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
+
+// Publish routes a message to subscribers as if a client published it.
+func (self *Broker) Publish(topic string, payload []byte, qos int, retain bool) error {
+	if err := codec.ValidateTopicName(topic); err != nil {
+		return err
+	}
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid QoS: %d", qos)
+	}
+
+	msg := codec.NewPublishMessage()
+	msg.TopicName = topic
+	msg.Payload = payload
+	msg.QosLevel = qos
+	if retain {
+		msg.Retain = 1
+	}
+
+	self.Engine.SendPublishMessage(msg)
+	return nil
+}
+
+// Subscription is an in-process subscription made by Broker.Subscribe.
+type Subscription struct {
+	Filter  string
+	QoS     int
+	broker  *Broker
+	mux     *MmuxConnection
+	conn    *LocalConnection
+	removed int32
+}
+
+// Subscribe calls callback with messages which match filter. Retained messages are delivered too.
+// callback is called from a dedicated goroutine, one message at a time.
+func (self *Broker) Subscribe(filter string, qos int, callback func(*codec.PublishMessage)) (*Subscription, error) {
+	if err := codec.ValidateTopicFilter(filter); err != nil {
+		return nil, err
+	}
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("invalid QoS: %d", qos)
+	}
+
+	engine := self.Engine
+	id := fmt.Sprintf("momonga-local-%d", atomic.AddInt64(&self.seq, 1))
+	conn := NewLocalConnection(engine, id, callback)
+
+	mux := NewMmuxConnection()
+	mux.SetId(id)
+	guid, _ := engine.guidFactory.NewGUID(int64(mux.GetHash()))
+	mux.SetGuid(guid)
+	conn.SetGuid(guid)
+	conn.table = mux.OutGoingTable
+	mux.Attach(conn)
+	mux.SetState(STATE_CONNECTED)
+	mux.Admin = true
+	engine.registerSession(mux)
+
+	sub := codec.NewSubscribeMessage()
+	sub.Payload = []codec.SubscribePayload{{TopicPath: filter, RequestedQos: uint8(qos)}}
+	engine.Subscribe(sub, mux)
+
+	set, ok := mux.GetSubscribedTopics()[filter]
+	if !ok {
+		engine.discardSession(mux)
+		conn.Close()
+		return nil, fmt.Errorf("subscription refused: %s", filter)
+	}
+
+	return &Subscription{
+		Filter: filter,
+		QoS:    set.QoS,
+		broker: self,
+		mux:    mux,
+		conn:   conn,
+	}, nil
+}
+
+// Unsubscribe removes the subscription and stops delivering queued messages to the callback.
+func (self *Subscription) Unsubscribe() {
+	if !atomic.CompareAndSwapInt32(&self.removed, 0, 1) {
+		return
+	}
+
+	self.broker.Engine.discardSession(self.mux)
+	self.mux.DetachAll()
+	self.conn.Close()
+}
@@ -0,0 +1,544 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/chobie/momonga/common"
+	"github.com/chobie/momonga/configuration"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type BrokerSuite struct{}
+
+var _ = Suite(&BrokerSuite{})
+
+func (s *BrokerSuite) TestInProcess(c *C) {
+	setupLogging()
+
+	broker, err := NewBroker(nil, WithPort(0), WithHttpPort(0))
+	c.Assert(err, Equals, nil)
+	c.Assert(len(broker.Servers), Equals, 0)
+	c.Assert(broker.Start(context.Background()), Equals, nil)
+	c.Assert(broker.Start(context.Background()), Equals, ErrBrokerStarted)
+
+	c.Assert(broker.Publish("/retained", []byte("retained"), 1, true), Equals, nil)
+
+	received := make(chan *codec.PublishMessage, 10)
+	sub, err := broker.Subscribe("/+", 1, func(msg *codec.PublishMessage) {
+		received <- msg
+	})
+	c.Assert(err, Equals, nil)
+	c.Assert(sub.QoS, Equals, 1)
+
+	receive := func() *codec.PublishMessage {
+		select {
+		case m := <-received:
+			return m
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	m := receive()
+	c.Assert(m, NotNil)
+	c.Assert(m.TopicName, Equals, "/retained")
+	c.Assert(m.QosLevel, Equals, 1)
+	// the packet identifier of the retained message is released in the table of the session.
+	c.Assert(sub.mux.OutGoingTable.Len(), Equals, 0)
+
+	c.Assert(broker.Publish("/hello", []byte("world"), 2, false), Equals, nil)
+	m = receive()
+	c.Assert(m, NotNil)
+	c.Assert(m.TopicName, Equals, "/hello")
+	c.Assert(string(m.Payload), Equals, "world")
+	c.Assert(m.QosLevel, Equals, 1)
+
+	sub.Unsubscribe()
+	c.Assert(broker.Publish("/hello", []byte("again"), 0, false), Equals, nil)
+	time.Sleep(time.Millisecond * 10)
+	c.Assert(len(received), Equals, 0)
+	c.Assert(len(broker.Engine.Subscriptions.Match("/hello")), Equals, 0)
+
+	// invalid topics
+	c.Assert(broker.Publish("/a/#", nil, 0, false), Equals, codec.ErrWildcardInTopicName)
+	_, err = broker.Subscribe("/a/#/b", 0, func(*codec.PublishMessage) {})
+	c.Assert(err, Equals, codec.ErrInvalidWildcard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Assert(broker.Shutdown(ctx), Equals, nil)
+	c.Assert(broker.Shutdown(ctx), Equals, ErrBrokerNotStarted)
+
+	// invalid configurations are returned as errors.
+	config := configuration.DefaultConfiguration()
+	config.Tenants = []configuration.Tenant{{Name: "a/b"}}
+	_, err = NewBroker(config)
+	c.Assert(err, ErrorMatches, `invalid tenant configuration: .*`)
+
+	config = configuration.DefaultConfiguration()
+	config.Engine.OverlappingSubscriptions = "per_subscription"
+	_, err = NewBroker(config)
+	c.Assert(err, ErrorMatches, `unknown overlapping_subscriptions "per_subscription"`)
+
+	config = configuration.DefaultConfiguration()
+	config.Engine.RewriteRules = []configuration.RewriteRule{{Regexp: "("}}
+	_, err = NewBroker(config)
+	c.Assert(err, ErrorMatches, `invalid rewrite rules: .*`)
+
+	config = configuration.DefaultConfiguration()
+	config.Engine.Schemas = []configuration.Schema{{Topic: "telemetry/+"}}
+	_, err = NewBroker(config)
+	c.Assert(err, ErrorMatches, `invalid payload schemas: .*`)
+}
+
+func (s *BrokerSuite) TestDelayedPublish(c *C) {
+	setupLogging()
+
+	broker, err := NewBroker(nil, WithPort(0), WithHttpPort(0))
+	c.Assert(err, Equals, nil)
+	broker.Start(context.Background())
+	engine := broker.Engine
+
+	received := make(chan *codec.PublishMessage, 10)
+	broker.Subscribe("reminder/#", 0, func(msg *codec.PublishMessage) {
+		received <- msg
+	})
+
+	now := time.Now()
+	broker.Publish("$delayed/10/reminder/1", []byte("wake up"), 0, false)
+	// invalid delayed topics are discarded.
+	broker.Publish("$delayed/soon/reminder/1", []byte("invalid"), 0, false)
+	broker.Publish("$delayed/10", []byte("invalid"), 0, false)
+	broker.Publish("$delayed/10/$delayed/1/reminder/1", []byte("invalid"), 0, false)
+
+	delayed := engine.DelayedMessages()
+	c.Assert(len(delayed), Equals, 1)
+	c.Assert(delayed[0].Message.TopicName, Equals, "reminder/1")
+	c.Assert(delayed[0].DeliverAt.Sub(now) >= 10*time.Second, Equals, true)
+
+	engine.deliverDelayedMessages(now)
+	c.Assert(len(engine.DelayedMessages()), Equals, 1)
+	c.Assert(len(received), Equals, 0)
+
+	engine.deliverDelayedMessages(now.Add(11 * time.Second))
+	c.Assert(len(engine.DelayedMessages()), Equals, 0)
+	select {
+	case m := <-received:
+		c.Assert(m.TopicName, Equals, "reminder/1")
+		c.Assert(string(m.Payload), Equals, "wake up")
+	case <-time.After(time.Second):
+		c.Fatal("delayed message wasn't delivered")
+	}
+
+	// cancel
+	msg := codec.NewPublishMessage()
+	msg.TopicName = "reminder/2"
+	id, err := engine.ScheduleMessage(msg, time.Minute)
+	c.Assert(err, Equals, nil)
+	c.Assert(engine.CancelDelayed(id), Equals, nil)
+	c.Assert(engine.CancelDelayed(id), Equals, ErrDelayedNotFound)
+	c.Assert(len(engine.DelayedMessages()), Equals, 0)
+
+	// cancel through the http admin interface
+	id, _ = engine.ScheduleMessage(msg, time.Minute)
+	httpd := &MyHttpServer{Engine: engine}
+	cancelDelayed := func(method string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/delayed/cancel?id="+id, nil)
+		httpd.ServeHTTP(w, req)
+		return w.Code
+	}
+	c.Assert(cancelDelayed("GET"), Equals, http.StatusMethodNotAllowed)
+	c.Assert(len(engine.DelayedMessages()), Equals, 1)
+	c.Assert(cancelDelayed("POST"), Equals, http.StatusOK)
+	c.Assert(len(engine.DelayedMessages()), Equals, 0)
+
+	// concurrent sweeps deliver a message only once.
+	msg.TopicName = "reminder/3"
+	_, err = engine.ScheduleMessage(msg, 0)
+	c.Assert(err, Equals, nil)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			engine.deliverDelayedMessages(time.Now().Add(time.Second))
+		}()
+	}
+	wg.Wait()
+	select {
+	case m := <-received:
+		c.Assert(m.TopicName, Equals, "reminder/3")
+	case <-time.After(time.Second):
+		c.Fatal("delayed message wasn't delivered")
+	}
+	select {
+	case m := <-received:
+		c.Fatalf("delayed message was delivered twice: %s", m.TopicName)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	broker.Shutdown(context.Background())
+}
+
+func (s *BrokerSuite) TestTopicRewrite(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.RewriteRules = []configuration.RewriteRule{
+		{From: "dev/+/t", To: "devices/+/telemetry"},
+		{From: "old/#", To: "new/#"},
+		{Regexp: "^legacy/(.+)$", Replacement: "v2/$1"},
+	}
+	broker, err := NewBroker(config, WithPort(0), WithHttpPort(0))
+	c.Assert(err, Equals, nil)
+	broker.Start(context.Background())
+	defer broker.Shutdown(context.Background())
+
+	subscribe := func(filter string) chan string {
+		received := make(chan string, 10)
+		_, err := broker.Subscribe(filter, 0, func(msg *codec.PublishMessage) {
+			received <- msg.TopicName
+		})
+		c.Assert(err, Equals, nil)
+		return received
+	}
+	receive := func(received chan string) string {
+		select {
+		case topic := <-received:
+			return topic
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	rewriter := broker.Engine.Rewriter()
+	c.Assert(rewriter.Publish("dev/42/t"), Equals, "devices/42/telemetry")
+	c.Assert(rewriter.Publish("dev/42/x"), Equals, "dev/42/x")
+	c.Assert(rewriter.Publish("old"), Equals, "new")
+	c.Assert(rewriter.Publish("legacy/a/b"), Equals, "v2/a/b")
+	c.Assert(rewriter.Filter("dev/+/t"), Equals, "devices/+/telemetry")
+	c.Assert(rewriter.Filter("dev/#"), Equals, "dev/#")
+	c.Assert(rewriter.Reverse("devices/42/telemetry", "dev/+/t"), Equals, "dev/42/t")
+	c.Assert(rewriter.Reverse("devices/42/telemetry", "dev/1/t"), Equals, "devices/42/telemetry")
+
+	services := subscribe("devices/+/telemetry")
+	firmware := subscribe("dev/+/t")
+	v2 := subscribe("v2/#")
+
+	// legacy firmware and new services see the same messages with their own topic.
+	broker.Publish("dev/42/t", []byte("21.5"), 0, true)
+	c.Assert(receive(services), Equals, "devices/42/telemetry")
+	c.Assert(receive(firmware), Equals, "dev/42/t")
+
+	broker.Publish("devices/43/telemetry", []byte("22.0"), 0, false)
+	c.Assert(receive(services), Equals, "devices/43/telemetry")
+	c.Assert(receive(firmware), Equals, "dev/43/t")
+
+	broker.Publish("legacy/x", nil, 0, false)
+	c.Assert(receive(v2), Equals, "v2/x")
+
+	// retained messages are stored with the rewritten topic.
+	c.Assert(len(broker.Engine.RetainMatch("devices/42/telemetry")), Equals, 1)
+	c.Assert(receive(subscribe("dev/42/t")), Equals, "dev/42/t")
+
+	// reload
+	app := &Application{Engine: broker.Engine, config: config, configPath: filepath.Join(c.MkDir(), "config.toml")}
+	reload := func(data string) {
+		c.Assert(ioutil.WriteFile(app.configPath, []byte(data), 0644), Equals, nil)
+		app.Reload()
+	}
+	reload("[engine]\n[[engine.rewrite]]\nfrom = \"dev/+/t\"\nto = \"devices/+/t/#\"\n")
+	c.Assert(broker.Engine.Rewriter().Publish("dev/1/t"), Equals, "devices/1/telemetry")
+	reload("[engine\n")
+	c.Assert(broker.Engine.Rewriter().Publish("dev/1/t"), Equals, "devices/1/telemetry")
+	// the running configuration isn't touched.
+	c.Assert(len(config.Engine.RewriteRules), Equals, 3)
+
+	// subscriptions follow the rules.
+	reload("")
+	broker.Publish("dev/44/t", nil, 0, false)
+	c.Assert(receive(firmware), Equals, "dev/44/t")
+	broker.Publish("devices/45/telemetry", nil, 0, false)
+	c.Assert(receive(firmware), Equals, "")
+}
+
+func (s *BrokerSuite) TestClientEvents(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.ClientEvents = true
+	broker, err := NewBroker(config, WithPort(0), WithHttpPort(0))
+	c.Assert(err, Equals, nil)
+	broker.Start(context.Background())
+	defer broker.Shutdown(context.Background())
+	engine := broker.Engine
+
+	received := make(chan *codec.PublishMessage, 10)
+	broker.Subscribe("$SYS/broker/clients/+/+", 0, func(msg *codec.PublishMessage) {
+		received <- msg
+	})
+	receive := func(topic string) *ClientEvent {
+		select {
+		case m := <-received:
+			c.Assert(m.TopicName, Equals, topic)
+			e := &ClientEvent{}
+			c.Assert(json.Unmarshal(m.Payload, e), Equals, nil)
+			return e
+		case <-time.After(time.Second):
+			c.Fatalf("%s wasn't published", topic)
+		}
+		return nil
+	}
+
+	client1 := connect(engine, "device1", false, withUser("bob"), withKeepalive(30))
+	e := receive("$SYS/broker/clients/device1/connected")
+	c.Assert(e.ClientId, Equals, "device1")
+	c.Assert(e.UserName, Equals, "bob")
+	c.Assert(e.RemoteAddr, Equals, "debug")
+	c.Assert(e.Keepalive, Equals, 30)
+	c.Assert(e.CleanSession, Equals, false)
+	c.Assert(e.Timestamp.IsZero(), Equals, false)
+
+	// takeover: the old connection is reported before the new one.
+	client2 := connect(engine, "device1", false, withUser("bob"), withKeepalive(30))
+	c.Assert(receive("$SYS/broker/clients/device1/disconnected").Reason, Equals, "taken over")
+	receive("$SYS/broker/clients/device1/connected")
+	engine.HandleConnection(client1.Conn)
+
+	// clean disconnect
+	time.Sleep(time.Millisecond * 10)
+	client2.Mock.Reset()
+	codec.WriteMessageTo(codec.NewDisconnectMessage(), client2.Mock)
+	engine.HandleConnection(client2.Conn)
+	c.Assert(receive("$SYS/broker/clients/device1/disconnected").Reason, Equals, "disconnect")
+
+	time.Sleep(time.Millisecond * 10)
+	c.Assert(len(received), Equals, 0)
+}
+
+func (s *BrokerSuite) TestAuditEvents(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Server.AuditSys = true
+	broker, err := NewBroker(config, WithPort(0), WithHttpPort(0))
+	c.Assert(err, Equals, nil)
+	broker.Start(context.Background())
+	defer broker.Shutdown(context.Background())
+	engine := broker.Engine
+
+	received := make(chan string, 100)
+	broker.Subscribe(AUDIT_TOPIC, 0, func(msg *codec.PublishMessage) {
+		e := &AuditEvent{}
+		c.Check(json.Unmarshal(msg.Payload, e), Equals, nil)
+		received <- e.Event + ":" + e.ClientId
+	})
+
+	// events are published in the order they were recorded.
+	var expected []string
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("client%d", i)
+		client := connect(engine, id, true)
+		engine.HandleConnection(client.Conn)
+		expected = append(expected, "auth:"+id, "connect:"+id, "disconnect:"+id)
+	}
+
+	var events []string
+	for range expected {
+		select {
+		case e := <-received:
+			events = append(events, e)
+		case <-time.After(time.Second):
+			c.Fatalf("received %d of %d events", len(events), len(expected))
+		}
+	}
+	c.Assert(events, DeepEquals, expected)
+}
+
+func (s *BrokerSuite) TestSessionAdmin(c *C) {
+	setupLogging()
+
+	broker, err := NewBroker(nil, WithPort(0), WithHttpPort(0))
+	c.Assert(err, Equals, nil)
+	broker.Start(context.Background())
+	defer broker.Shutdown(context.Background())
+	engine := broker.Engine
+
+	wills := make(chan string, 10)
+	broker.Subscribe("/will/+", 0, func(msg *codec.PublishMessage) {
+		wills <- msg.TopicName
+	})
+
+	client1 := connect(engine, "sensor-1", false, withUser("alice"), withKeepalive(60), withWill("/will/sensor-1", "bye"))
+	sub := codec.NewSubscribeMessage()
+	sub.Payload = []codec.SubscribePayload{{TopicPath: "/a", RequestedQos: 1}, {TopicPath: "/b", RequestedQos: 0}}
+	engine.Subscribe(sub, client1.Mux)
+	engine.Unsubscribe(2, 0, []codec.SubscribePayload{{TopicPath: "/b"}}, client1.Mux)
+	client2 := connect(engine, "sensor-2", true, withUser("bob"), withWill("/will/sensor-2", "bye"))
+	connect(engine, "gateway", true, withUser("alice"), withWill("/will/gateway", "bye"))
+
+	ids := func(sessions []*SessionInfo) []string {
+		var result []string
+		for _, v := range sessions {
+			result = append(result, v.ClientId)
+		}
+		return result
+	}
+	c.Assert(ids(engine.ListSessions(SessionFilter{ClientId: "sensor-"})), DeepEquals, []string{"sensor-1", "sensor-2"})
+	c.Assert(ids(engine.ListSessions(SessionFilter{UserName: "alice"})), DeepEquals, []string{"gateway", "sensor-1"})
+
+	info, err := engine.SessionDetails("sensor-1")
+	c.Assert(err, Equals, nil)
+	c.Assert(info.Connected, Equals, true)
+	c.Assert(info.CleanSession, Equals, false)
+	c.Assert(info.RemoteAddr, Equals, "debug")
+	c.Assert(info.Keepalive, Equals, 60)
+	// unsubscribed filters aren't listed.
+	c.Assert(info.Subscriptions, DeepEquals, map[string]int{"/a": 1})
+	_, err = engine.SessionDetails("unknown")
+	c.Assert(err, Equals, ErrSessionNotFound)
+
+	// kick without will. the persistent session is kept.
+	c.Assert(engine.Kick("sensor-1", true), Equals, nil)
+	c.Assert(client1.Conn.GetState(), Equals, STATE_CLOSED)
+	c.Assert(client1.Conn.DisconnectReason, Equals, "kicked")
+	engine.HandleConnection(client1.Conn)
+	c.Assert(engine.Kick("sensor-1", true), Equals, ErrSessionNotConnected)
+	c.Assert(ids(engine.ListSessions(SessionFilter{State: "offline"})), DeepEquals, []string{"sensor-1"})
+	c.Assert(len(engine.Subscriptions.Match("/a")), Equals, 1)
+
+	// kick with will. the clean session is discarded.
+	c.Assert(engine.Kick("sensor-2", false), Equals, nil)
+	engine.HandleConnection(client2.Conn)
+	select {
+	case topic := <-wills:
+		c.Assert(topic, Equals, "/will/sensor-2")
+	case <-time.After(time.Second):
+		c.Fatal("will message wasn't published")
+	}
+	_, err = engine.SessionDetails("sensor-2")
+	c.Assert(err, Equals, ErrSessionNotFound)
+
+	// delete the persistent session.
+	c.Assert(engine.DeleteSession("sensor-1"), Equals, nil)
+	_, err = engine.SessionDetails("sensor-1")
+	c.Assert(err, Equals, ErrSessionNotFound)
+	c.Assert(len(engine.Subscriptions.Match("/a")), Equals, 0)
+	c.Assert(engine.DeleteSession("sensor-1"), Equals, ErrSessionNotFound)
+
+	time.Sleep(time.Millisecond * 10)
+	c.Assert(len(wills), Equals, 0)
+}
+
+func (s *BrokerSuite) TestPayloadSchema(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.DeadLetterTopic = "dead/letters"
+	config.Engine.Schemas = []configuration.Schema{
+		{Topic: "telemetry/+", Fields: map[string]string{"device": "string", "temperature": "number", "battery": "integer?"}},
+		{Topic: "config/#", Schema: `{
+			"type": "object",
+			"properties": {
+				"mode": {"enum": ["eco", "boost"]},
+				"interval": {"type": "integer", "minimum": 1, "maximum": 3600},
+				"tags": {"type": "array", "items": {"type": "string", "pattern": "^[a-z]+$"}, "maxItems": 2}
+			},
+			"required": ["mode"],
+			"additionalProperties": false
+		}`, DeadLetterTopic: "dead/config"},
+	}
+	broker, err := NewBroker(config, WithPort(0), WithHttpPort(0))
+	c.Assert(err, Equals, nil)
+	broker.Start(context.Background())
+	defer broker.Shutdown(context.Background())
+
+	validator := broker.Engine.Validator()
+	c.Assert(validator.Len(), Equals, 2)
+	invalid := func(topic, payload string) string {
+		err := validator.Validate(topic, []byte(payload))
+		if err == nil {
+			return ""
+		}
+		return err.(*PayloadError).Err.Error()
+	}
+	c.Assert(invalid("telemetry/1", `{"device": "a", "temperature": 21.5}`), Equals, "")
+	c.Assert(invalid("telemetry/1", `{"device": "a", "temperature": "hot"}`), Equals, "$.temperature: expected number, got string")
+	c.Assert(invalid("telemetry/1", `{"device": "a", "temperature": 1, "battery": 0.5}`), Equals, "$.battery: expected integer, got number")
+	c.Assert(invalid("telemetry/1", `{"temperature": 1}`), Equals, `$: missing required property "device"`)
+	c.Assert(invalid("telemetry/1", `{"device": `), Matches, "invalid JSON: .*")
+	c.Assert(invalid("config/a", `{"mode": "eco", "interval": 60, "tags": ["x"]}`), Equals, "")
+	c.Assert(invalid("config/a", `{"mode": "off"}`), Equals, "$.mode: not one of the enum values")
+	c.Assert(invalid("config/a", `{"mode": "eco", "interval": 0}`), Equals, "$.interval: 0 is less than 1")
+	c.Assert(invalid("config/a", `{"mode": "eco", "tags": ["x", "Y"]}`), Equals, "$.tags[1]: doesn't match ^[a-z]+$")
+	c.Assert(invalid("config/a", `{"mode": "eco", "debug": true}`), Equals, `$: unknown property "debug"`)
+	c.Assert(invalid("other", `not json`), Equals, "")
+
+	// invalid configurations keep current schemas.
+	app := &Application{Engine: broker.Engine, config: config, configPath: filepath.Join(c.MkDir(), "config.toml")}
+	reload := func(data string) {
+		c.Assert(ioutil.WriteFile(app.configPath, []byte(data), 0644), Equals, nil)
+		app.Reload()
+	}
+	reload("[engine]\ndead_letter_topic = \"dead/letters\"\n[[engine.schema]]\ntopic = \"dead/#\"\nfields = { a = \"string\" }\n")
+	reload("[[engine.schema]]\ntopic = \"a\"\nfields = { a = \"text\" }\n")
+	reload("[engine\n")
+	c.Assert(broker.Engine.Validator().Len(), Equals, 2)
+	c.Assert(len(config.Engine.Schemas), Equals, 2)
+
+	received := make(chan *codec.PublishMessage, 10)
+	for _, filter := range []string{"telemetry/+", "dead/#"} {
+		broker.Subscribe(filter, 0, func(msg *codec.PublishMessage) {
+			received <- msg
+		})
+	}
+	receive := func() *codec.PublishMessage {
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(time.Second):
+			c.Fatal("message wasn't delivered")
+		}
+		return nil
+	}
+
+	broker.Publish("telemetry/1", []byte(`{"device": "a", "temperature": 21.5}`), 0, false)
+	c.Assert(receive().TopicName, Equals, "telemetry/1")
+
+	// rejected messages are neither delivered nor retained.
+	broker.Publish("telemetry/1", []byte(`{"device": "a"}`), 1, true)
+	msg := receive()
+	c.Assert(msg.TopicName, Equals, "dead/letters")
+	dead := &DeadLetter{}
+	c.Assert(json.Unmarshal(msg.Payload, dead), Equals, nil)
+	c.Assert(dead.Topic, Equals, "telemetry/1")
+	c.Assert(dead.QoS, Equals, 1)
+	c.Assert(dead.Retain, Equals, true)
+	c.Assert(dead.Error, Equals, `$: missing required property "temperature"`)
+	c.Assert(string(dead.Payload), Equals, `{"device": "a"}`)
+	c.Assert(len(broker.Engine.RetainMatch("telemetry/1")), Equals, 0)
+	c.Assert(broker.Engine.System.Broker.Messages.Publish.Rejected, Equals, int64(1))
+
+	broker.Publish("config/a", []byte(`{}`), 0, false)
+	c.Assert(receive().TopicName, Equals, "dead/config")
+	c.Assert(len(received), Equals, 0)
+
+	// an empty retained message clears the retained one without validation.
+	broker.Publish("telemetry/2", []byte(`{"device": "b", "temperature": 20}`), 0, true)
+	c.Assert(receive().TopicName, Equals, "telemetry/2")
+	c.Assert(len(broker.Engine.RetainMatch("telemetry/2")), Equals, 1)
+	broker.Publish("telemetry/2", nil, 0, true)
+	c.Assert(len(broker.Engine.RetainMatch("telemetry/2")), Equals, 0)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(len(received), Equals, 0)
+	c.Assert(broker.Engine.System.Broker.Messages.Publish.Rejected, Equals, int64(2))
+}
@@ -0,0 +1,60 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/chobie/momonga/common"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	"time"
+)
+
+// $SYS/broker/clients/<client id>/connected and $SYS/broker/clients/<client id>/disconnected
+const CLIENT_EVENT_TOPIC = "$SYS/broker/clients/%s/%s"
+
+// ClientEvent is the payload of client lifecycle events.
+type ClientEvent struct {
+	Timestamp    time.Time `json:"timestamp"`
+	ClientId     string    `json:"client_id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	UserName     string    `json:"username"`
+	CleanSession bool      `json:"clean_session"`
+	Keepalive    int       `json:"keepalive"`
+	Reason       string    `json:"reason,omitempty"`
+	// events of tenant clients are published in the tenant namespace.
+	mountpoint string
+}
+
+// publishClientEvent publishes event ("connected" or "disconnected") when client_events is enabled.
+// it is called while holding the session lock, so events of a client are published in order.
+func (self *Momonga) publishClientEvent(event string, e *ClientEvent) {
+	if !self.config.Engine.ClientEvents {
+		return
+	}
+
+	e.Timestamp = time.Now()
+	b, _ := json.Marshal(e)
+
+	msg := codec.NewPublishMessage()
+	// a client identifier which contains wildcards isn't a valid topic name. SendPublishMessage discards it.
+	msg.TopicName = e.mountpoint + fmt.Sprintf(CLIENT_EVENT_TOPIC, e.ClientId, event)
+	msg.Payload = b
+	self.SendPublishMessage(msg)
+}
+
+func newClientEvent(mux *MmuxConnection, conn Connection) *ClientEvent {
+	e := &ClientEvent{
+		ClientId:     mux.Tenant.UnmountId(mux.Identifier),
+		RemoteAddr:   remoteAddr(conn),
+		UserName:     mux.UserName,
+		CleanSession: conn.ShouldClearSession(),
+		mountpoint:   mux.Tenant.GetMountpoint(),
+	}
+	if c, ok := conn.(*MyConnection); ok {
+		e.Keepalive = c.Keepalive
+	}
+	return e
+}
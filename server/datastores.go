@@ -0,0 +1,55 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"github.com/chobie/momonga/datastore"
+	log "github.com/chobie/momonga/logger"
+	"path/filepath"
+)
+
+// openDatastores opens DataStore (retained messages), SessionStore and DelayedStore as configured.
+// the memory datastore loses them on restart, the disk one keeps each of them in its own log under datastore_dir.
+func (self *Momonga) openDatastores() error {
+	switch self.config.Engine.Datastore {
+	case "", "memory":
+		self.DataStore = datastore.NewMemstore()
+		self.SessionStore = datastore.NewMemstore()
+		self.DelayedStore = datastore.NewMemstore()
+		return nil
+	case "disk":
+	default:
+		return fmt.Errorf("unknown datastore %q", self.config.Engine.Datastore)
+	}
+
+	options := datastore.DefaultDiskstoreOptions()
+	options.Sync = self.config.Engine.DatastoreSync
+	options.CompactionInterval = self.config.GetDatastoreCompaction()
+
+	stores := []*datastore.Datastore{&self.DataStore, &self.SessionStore, &self.DelayedStore}
+	for i, name := range []string{"retained", "sessions", "delayed"} {
+		path := filepath.Join(self.config.Engine.DatastoreDir, name+".wal")
+		store, err := datastore.OpenDiskstore(path, options)
+		if err != nil {
+			self.closeDatastores()
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		log.Info("opened %s (sync: %s)", path, options.Sync)
+		self.diskstores = append(self.diskstores, store)
+		*stores[i] = store
+	}
+	return nil
+}
+
+// closeDatastores syncs and closes disk datastores.
+func (self *Momonga) closeDatastores() {
+	for _, store := range self.diskstores {
+		if err := store.Close(); err != nil {
+			log.Error("failed to close %s: %s", store.Path(), err)
+		}
+	}
+	self.diskstores = nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	log "github.com/chobie/momonga/logger"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PUBLISH to $delayed/<seconds>/<topic> is delivered to subscribers of <topic> after <seconds>.
+const DELAYED_TOPIC_PREFIX = "$delayed/"
+
+var ErrDelayedNotFound = errors.New("delayed message not found")
+
+type DelayedMessage struct {
+	Id        string                `json:"id"`
+	DeliverAt time.Time             `json:"deliver_at"`
+	Message   *codec.PublishMessage `json:"-"`
+}
+
+var delayedSequence int64
+
+// parseDelayedTopic splits $delayed/<seconds>/<topic>.
+func parseDelayedTopic(topic string) (time.Duration, string, error) {
+	rest := strings.TrimPrefix(topic, DELAYED_TOPIC_PREFIX)
+	offset := strings.Index(rest, "/")
+	if offset < 0 {
+		return 0, "", fmt.Errorf("delayed topic requires $delayed/<seconds>/<topic>: %s", topic)
+	}
+
+	seconds, err := strconv.ParseUint(rest[:offset], 10, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid delay %q: %s", rest[:offset], err)
+	}
+
+	target := rest[offset+1:]
+	if err := codec.ValidateTopicName(target); err != nil {
+		return 0, "", err
+	}
+	if strings.HasPrefix(target, DELAYED_TOPIC_PREFIX) {
+		return 0, "", fmt.Errorf("delayed topic can't be nested: %s", topic)
+	}
+
+	return time.Duration(seconds) * time.Second, target, nil
+}
+
+// ScheduleMessage persists msg in DelayedStore. RunMaintenanceThread delivers it after delay.
+func (self *Momonga) ScheduleMessage(msg *codec.PublishMessage, delay time.Duration) (string, error) {
+	at := time.Now().Add(delay)
+	// keys are ordered by delivery time.
+	id := fmt.Sprintf("%019d-%010d", at.UnixNano(), atomic.AddInt64(&delayedSequence, 1))
+
+	x, err := codec.CopyPublishMessage(msg)
+	if err != nil {
+		return "", err
+	}
+	x.PacketIdentifier = 0
+	x.Dupe = false
+
+	buffer := bytes.NewBuffer(nil)
+	codec.WriteMessageTo(x, buffer)
+	self.delayedLock.Lock()
+	err = self.DelayedStore.Put([]byte(id), buffer.Bytes())
+	self.delayedLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	log.Debug("scheduled %s to %s at %s", id, x.TopicName, at)
+	return id, nil
+}
+
+func (self *Momonga) scheduleDelayedTopic(msg *codec.PublishMessage) {
+	delay, topic, err := parseDelayedTopic(msg.TopicName)
+	if err != nil {
+		log.Error("discard delayed publish message. %s", err)
+		return
+	}
+
+	x, _ := codec.CopyPublishMessage(msg)
+	x.TopicName = topic
+	if _, err := self.ScheduleMessage(x, delay); err != nil {
+		log.Error("failed to schedule delayed message: %s", err)
+	}
+}
+
+// DelayedMessages returns pending delayed messages ordered by delivery time.
+func (self *Momonga) DelayedMessages() []*DelayedMessage {
+	var result []*DelayedMessage
+
+	self.delayedLock.Lock()
+	defer self.delayedLock.Unlock()
+
+	itr := self.DelayedStore.Iterator()
+	for ; itr.Valid(); itr.Next() {
+		if m := parseDelayedEntry(itr.Key(), itr.Value()); m != nil {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// CancelDelayed removes a pending delayed message.
+func (self *Momonga) CancelDelayed(id string) error {
+	if _, ok := parseDelayedId(id); !ok {
+		return ErrDelayedNotFound
+	}
+
+	self.delayedLock.Lock()
+	defer self.delayedLock.Unlock()
+
+	itr := self.DelayedStore.Iterator()
+	itr.Seek([]byte(id))
+	if !itr.Valid() || string(itr.Key()) != id {
+		return ErrDelayedNotFound
+	}
+
+	return self.DelayedStore.Del([]byte(id), []byte(id))
+}
+
+// deliverDelayedMessages publishes delayed messages which are due.
+func (self *Momonga) deliverDelayedMessages(now time.Time) {
+	for _, m := range self.takeDueMessages(now) {
+		if m.Message != nil {
+			log.Debug("deliver delayed message %s to %s", m.Id, m.Message.TopicName)
+			self.SendPublishMessage(m.Message)
+		}
+	}
+}
+
+// takeDueMessages removes delayed messages which are due from DelayedStore and returns them.
+// only the sweep which deleted an entry returns it, so concurrent sweeps never deliver it twice.
+func (self *Momonga) takeDueMessages(now time.Time) []*DelayedMessage {
+	var due, taken []*DelayedMessage
+
+	self.delayedLock.Lock()
+	defer self.delayedLock.Unlock()
+
+	itr := self.DelayedStore.Iterator()
+	for ; itr.Valid(); itr.Next() {
+		at, ok := parseDelayedId(string(itr.Key()))
+		if ok && at.After(now) {
+			break
+		}
+		if m := parseDelayedEntry(itr.Key(), itr.Value()); m != nil {
+			due = append(due, m)
+		} else {
+			// broken entries are removed as well.
+			due = append(due, &DelayedMessage{Id: string(itr.Key())})
+		}
+	}
+
+	for _, m := range due {
+		if err := self.DelayedStore.Del([]byte(m.Id), []byte(m.Id)); err != nil {
+			log.Error("failed to remove delayed message %s: %s", m.Id, err)
+			continue
+		}
+		taken = append(taken, m)
+	}
+	return taken
+}
+
+func parseDelayedId(id string) (time.Time, bool) {
+	offset := strings.Index(id, "-")
+	if offset < 0 {
+		return time.Time{}, false
+	}
+
+	nsec, err := strconv.ParseInt(id[:offset], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nsec), true
+}
+
+func parseDelayedEntry(key, value []byte) *DelayedMessage {
+	at, ok := parseDelayedId(string(key))
+	if !ok {
+		log.Error("broken delayed message key: %q", key)
+		return nil
+	}
+
+	p, err := codec.ParseMessage(bytes.NewReader(value), 0)
+	if err != nil {
+		log.Error("broken delayed message %s: %s", key, err)
+		return nil
+	}
+	msg, ok := p.(*codec.PublishMessage)
+	if !ok {
+		return nil
+	}
+
+	return &DelayedMessage{
+		Id:        string(key),
+		DeliverAt: at,
+		Message:   msg,
+	}
+}
@@ -24,7 +24,7 @@ func (s *DummyPlugSuite) TestDummyPlug(c *C) {
 	mux.SetId(p.GetId())
 	mux.Attach(p)
 	// Memo: Normally, engine has correct relation ship between mux and iteself. this is only need for test
-	engine.Connections[p.GetId()] = mux
+	engine.SetConnectionByClientId(p.GetId(), mux)
 
 	sub := mqtt.NewSubscribeMessage()
 	sub.Payload = append(sub.Payload, mqtt.SubscribePayload{
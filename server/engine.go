@@ -8,7 +8,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
-	_ "errors"
+	"errors"
 	"fmt"
 	. "github.com/chobie/momonga/common"
 	"github.com/chobie/momonga/configuration"
@@ -20,10 +20,10 @@ import (
 	"io"
 	"math/rand"
 	"os"
-	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +39,8 @@ type DisconnectError struct {
 
 func (e *DisconnectError) Error() string { return "received disconnect message" }
 
+var ErrShutdownTimeout = errors.New("shutdown timed out before outbound messages were drained")
+
 // TODO: haven't used this yet.
 type Retryable struct {
 	Id      string
@@ -47,30 +49,79 @@ type Retryable struct {
 
 // QoS 1, 2 are available. but really suck implementation.
 // reconsider qos design later.
-func NewMomonga(config *configuration.Config) *Momonga {
+//
+// NewMomonga returns an error when tenants, overlapping_subscriptions, rewrite rules or payload schemas
+// are invalid, or datastores or the audit log can't be opened.
+func NewMomonga(config *configuration.Config) (*Momonga, error) {
 	engine := &Momonga{
-		publishQueue:  make(chan *codec.PublishMessage, config.GetQueueSize()),
 		OutGoingTable: util.NewMessageTable(),
-		Qlobber:       util.NewQlobber(),
-		Connections:   map[string]*MmuxConnection{},
+		Subscriptions: util.NewSubscriptionTrie[*SubscribeSet](),
+		Connections:   NewSessionRegistry(config.GetLockPoolSize()),
 		RetryMap:      map[string][]*Retryable{},
 		ErrorChannel:  make(chan *Retryable, config.GetQueueSize()),
 		Started:       time.Now(),
 		EnableSys:     false,
-		DataStore:     datastore.NewMemstore(),
-		LockPool:      map[uint32]*sync.RWMutex{},
+		SessionLock:   map[uint32]*sync.Mutex{},
 		config:        config,
 		InflightTable: map[string]*util.MessageTable{},
+		quit:          make(chan bool),
+	}
+
+	tenants, err := NewTenants(config.Tenants)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant configuration: %s", err)
+	}
+	engine.Tenants = tenants
+
+	switch strings.ToLower(config.Engine.OverlappingSubscriptions) {
+	case "", "highest", "each":
+	default:
+		return nil, fmt.Errorf("unknown overlapping_subscriptions %q", config.Engine.OverlappingSubscriptions)
+	}
+
+	// don't start without the configured rules. the broker would accept every payload.
+	if err := engine.ReloadRewriteRules(); err != nil {
+		return nil, fmt.Errorf("invalid rewrite rules: %s", err)
+	}
+	if err := engine.ReloadSchemas(); err != nil {
+		return nil, fmt.Errorf("invalid payload schemas: %s", err)
+	}
+
+	if err := engine.openDatastores(); err != nil {
+		return nil, fmt.Errorf("failed to open datastore: %s", err)
+	}
+
+	// one queue for each fan-out worker. see enqueue
+	workers := config.GetFanoutWorkerCount()
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		engine.publishQueues = append(engine.publishQueues, make(chan *codec.PublishMessage, config.GetQueueSize()))
 	}
 
 	// initialize lock pool
 	for i := 0; i < config.GetLockPoolSize(); i++ {
-		engine.LockPool[uint32(i)] = &sync.RWMutex{}
+		engine.SessionLock[uint32(i)] = &sync.Mutex{}
 	}
 
+	engine.Subscriptions.SetCacheSize(config.Engine.MatchCacheSize)
 	engine.setupCallback()
+	engine.restoreSessions()
+
+	if path := config.Server.AuditLog; path != "" {
+		audit, err := NewAuditLog(path, int64(config.Server.AuditLogSize), config.Server.AuditLogFiles)
+		if err != nil {
+			engine.closeDatastores()
+			return nil, fmt.Errorf("failed to open audit log %s: %s", path, err)
+		}
+		engine.AuditLog = audit
+	}
+	if config.Server.AuditSys {
+		engine.auditQueue = make(chan *codec.PublishMessage, config.GetQueueSize())
+	}
 
-	return engine
+	return engine, nil
 }
 
 /*
@@ -79,28 +130,182 @@ goroutine (2)
 	Run
 */
 type Momonga struct {
-	publishQueue  chan *codec.PublishMessage
+	publishQueues []chan *codec.PublishMessage
 	OutGoingTable *util.MessageTable
+	// guarded by inflightLock. see inflightTable
 	InflightTable map[string]*util.MessageTable
-	Qlobber       *util.Qlobber
-	// TODO: improve this.
-	Connections  map[string]*MmuxConnection
+	inflightLock  sync.RWMutex
+	Subscriptions *util.SubscriptionTrie[*SubscribeSet]
+	Connections   *SessionRegistry
+	// guarded by retryLock.
 	RetryMap     map[string][]*Retryable
+	retryLock    sync.Mutex
 	ErrorChannel chan *Retryable
 	System       System
 	EnableSys    bool
 	Started      time.Time
 	DataStore    datastore.Datastore
-	LockPool     map[uint32]*sync.RWMutex
-	config       *configuration.Config
-	guidFactory  util.GuidFactory
+	// persistent sessions are saved here on shutdown.
+	SessionStore datastore.Datastore
+	// pending $delayed messages
+	DelayedStore datastore.Datastore
+	// serializes access to DelayedStore, so a sweep doesn't race with schedules, cancels or another sweep.
+	delayedLock sync.Mutex
+	// stores opened by openDatastores. Shutdown closes them.
+	diskstores []*datastore.Diskstore
+	// serializes connect / disconnect handling of the same client identifier.
+	SessionLock   map[uint32]*sync.Mutex
+	config        *configuration.Config
+	guidFactory   util.GuidFactory
+	shutdown      int32
+	quit          chan bool
+	terminateOnce sync.Once
+	rewriter      *TopicRewriter
+	rewriterLock  sync.RWMutex
+	validator     *PayloadValidator
+	validatorLock sync.RWMutex
+	// nil when the audit log is disabled.
+	AuditLog *AuditLog
+	Tenants  []*Tenant
+	// $SYS/broker/audit messages, published in order by publishAuditEvents. nil unless audit_sys is set.
+	auditQueue  chan *codec.PublishMessage
+	auditWorker sync.WaitGroup
 }
 
 func (self *Momonga) DisableSys() {
 	self.EnableSys = false
 }
 
+// Terminate stops fan-out workers and the maintenance thread.
 func (self *Momonga) Terminate() {
+	self.terminateOnce.Do(func() {
+		close(self.quit)
+	})
+}
+
+// ReloadRewriteRules replaces topic rewrite rules with the configured ones.
+// current rules are kept when the configuration is invalid.
+func (self *Momonga) ReloadRewriteRules() error {
+	return self.SetRewriteRules(self.config.Engine.RewriteRules)
+}
+
+// SetRewriteRules replaces topic rewrite rules. current rules are kept when rules are invalid.
+func (self *Momonga) SetRewriteRules(rules []configuration.RewriteRule) error {
+	rewriter, err := NewTopicRewriter(rules)
+	if err != nil {
+		return err
+	}
+
+	self.rewriterLock.Lock()
+	self.rewriter = rewriter
+	self.rewriterLock.Unlock()
+	log.Info("loaded %d topic rewrite rules", rewriter.Len())
+	// existing subscriptions follow the new rules.
+	self.remapSubscriptions()
+	return nil
+}
+
+func (self *Momonga) Rewriter() *TopicRewriter {
+	self.rewriterLock.RLock()
+	defer self.rewriterLock.RUnlock()
+	return self.rewriter
+}
+
+// ReloadSchemas replaces payload schemas with the configured ones.
+// current schemas are kept when the configuration is invalid.
+func (self *Momonga) ReloadSchemas() error {
+	return self.SetSchemas(self.config.Engine.Schemas, self.config.Engine.DeadLetterTopic)
+}
+
+// SetSchemas replaces payload schemas. current schemas are kept when schemas are invalid.
+func (self *Momonga) SetSchemas(schemas []configuration.Schema, deadLetterTopic string) error {
+	validator, err := NewPayloadValidator(schemas, deadLetterTopic)
+	if err != nil {
+		return err
+	}
+
+	self.validatorLock.Lock()
+	self.validator = validator
+	self.validatorLock.Unlock()
+	log.Info("loaded %d payload schemas", validator.Len())
+	return nil
+}
+
+func (self *Momonga) Validator() *PayloadValidator {
+	self.validatorLock.RLock()
+	defer self.validatorLock.RUnlock()
+	return self.validator
+}
+
+func (self *Momonga) IsShuttingDown() bool {
+	return atomic.LoadInt32(&self.shutdown) == 1
+}
+
+// Shutdown stops the engine in order:
+//
+//   1) stop routing new PUBLISH messages
+//   2) wait for queued outbound messages and inflight QoS 1, 2 messages to be acknowledged
+//   3) persist sessions and retained messages
+//   4) close every connection
+//
+// Steps 3 and 4 run even if 2 doesn't finish within timeout. In that case unacknowledged messages are
+// kept in persistent sessions and ErrShutdownTimeout is returned.
+//
+// NOTE: MQTT 3.1.1 doesn't allow servers to send DISCONNECT, so we just close network connections.
+func (self *Momonga) Shutdown(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&self.shutdown, 0, 1) {
+		return nil
+	}
+	log.Info("shutting down engine (timeout: %s)", timeout)
+
+	var result error
+	deadline := time.Now().Add(timeout)
+	for !self.isDrained() {
+		if time.Now().After(deadline) {
+			log.Error("couldn't drain outbound messages in %s", timeout)
+			result = ErrShutdownTimeout
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err := self.persistSessions(); err != nil {
+		log.Error("failed to persist sessions: %s", err)
+		result = err
+	}
+
+	// closing connections after persisting, as disconnect handling discards clean sessions.
+	// detached connections are treated as taken over, so will messages aren't published.
+	for _, mux := range self.Sessions() {
+		for _, conn := range mux.DetachAll() {
+			closeConnection(conn, "server shutdown")
+		}
+	}
+
+	self.Terminate()
+	// don't publish audit events to closed datastores.
+	self.auditWorker.Wait()
+	self.closeDatastores()
+	log.Info("engine stopped")
+	return result
+}
+
+func (self *Momonga) isDrained() bool {
+	for _, queue := range self.publishQueues {
+		if len(queue) > 0 {
+			return false
+		}
+	}
+	if len(self.auditQueue) > 0 {
+		return false
+	}
+
+	for _, mux := range self.Sessions() {
+		if !mux.IsDrained() {
+			return false
+		}
+	}
+	return true
 }
 
 func (self *Momonga) setupCallback() {
@@ -134,8 +339,8 @@ func (self *Momonga) setupCallback() {
 }
 
 func (self *Momonga) CleanSubscription(conn Connection) {
-	for t, v := range conn.GetSubscribedTopics() {
-		self.Qlobber.Remove(t, v)
+	for _, v := range conn.GetSubscribedTopics() {
+		self.Subscriptions.Remove(v.Handle)
 	}
 }
 
@@ -146,45 +351,32 @@ func (self *Momonga) SendWillMessage(conn Connection) {
 	msg.Payload = []byte(will.Message)
 	msg.QosLevel = int(will.Qos)
 
+	self.audit(&AuditEvent{
+		Event:      AUDIT_WILL,
+		ClientId:   conn.GetId(),
+		RemoteAddr: remoteAddr(conn),
+		Topic:      msg.TopicName,
+		QoS:        &msg.QosLevel,
+	})
 	self.SendPublishMessage(msg)
 }
 
-// TODO: wanna implement trie. but regexp works well.
-// retain should persist their data. though, how do we fetch it efficiently...
+// RetainMatch returns retained messages which match topic (a topic filter).
+// only keys starting with the literal prefix of topic are scanned. see retainedPrefix
 func (self *Momonga) RetainMatch(topic string) []*codec.PublishMessage {
 	var result []*codec.PublishMessage
-	orig := topic
-
-	// TODO: should validate illegal wildcards like /debug/#/hello
-	topic = strings.Replace(topic, "+", "[^/]+", -1)
-	topic = strings.Replace(topic, "#", ".*", -1)
 
-	reg, err := regexp.Compile(topic)
-	if err != nil {
-		fmt.Printf("Regexp Error: %s", err)
-	}
+	// NOTE: topic filters are validated by codec.ValidateTopicFilter before reaching here.
+	// TopicMatch matches whole levels, so a tenant mountpoint never matches in the middle of a topic.
+	// it also applies [MQTT-4.7.2-1] The Server MUST NOT match Topic Filters starting with a wildcard character (# or +)
+	// with Topic Names beginning with a $ character
 
-	all := false
-	if string(orig[0:1]) == "#" || string(orig[0:1]) == "+" {
-		all = true
-	}
-
-	// TODO:これどうにかしたいなー・・・。とは思いつつDBからめて素敵にやるってなるとあんまりいいアイデアない
-	itr := self.DataStore.Iterator()
+	itr := self.retainedIterator(topic)
 	for ; itr.Valid(); itr.Next() {
 		k := string(itr.Key())
 
-		if all && (len(k) > 0 && k[0:1] == "$") {
-			// [MQTT-4.7.2-1] The Server MUST NOT match Topic Filters starting with a wildcard character (# or +)
-			// with Topic Names beginning with a $ character
-			// NOTE: Qlobber doesn't support this feature yet
-			continue
-		}
-
-		if reg.MatchString(k) {
-			data := itr.Value()
-			p, _ := codec.ParseMessage(bytes.NewReader(data), 0)
-			if v, ok := p.(*codec.PublishMessage); ok {
+		if codec.TopicMatch(topic, k) {
+			if v, _, err := decodeRetained(itr.Value()); err == nil {
 				result = append(result, v)
 			}
 		}
@@ -202,33 +394,73 @@ func (self *Momonga) Subscribe(p *codec.SubscribeMessage, conn Connection) {
 
 	var retained []*codec.PublishMessage
 	// どのレベルでlockするか
-	qosBuffer := bytes.NewBuffer(make([]byte, len(p.Payload)))
+	// [MQTT-3.9.3-1] one return code per Topic Filter, in the same order.
+	qosBuffer := bytes.NewBuffer(make([]byte, 0, len(p.Payload)))
 	for _, payload := range p.Payload {
-		// don't subscribe multiple time
-		if cn.IsSubscribed(payload.TopicPath) {
-			log.Error("Map exists. [%s:%s]", conn.GetId(), payload.TopicPath)
+		if err := codec.ValidateTopicFilter(payload.TopicPath); err != nil {
+			log.Error("invalid topic filter. [%s:%q] %s", conn.GetId(), payload.TopicPath, err)
+			binary.Write(qosBuffer, binary.BigEndian, uint8(0x80))
+			continue
+		}
+
+		filter := self.subscriptionFilter(cn.Tenant, payload.TopicPath)
+		granted := -1
+		// clients of the default namespace don't reach tenants. see visible
+		if cn.Tenant != nil || cn.Admin || self.tenantOf(payload.TopicPath) == nil {
+			// qos_limit rules are written against client-visible topics.
+			granted = self.GrantQos(cn, payload.TopicPath, int(payload.RequestedQos))
+		}
+		if granted < 0 {
+			log.Info("subscription refused. [%s:%s]", conn.GetId(), payload.TopicPath)
+			requested := int(payload.RequestedQos)
+			self.audit(&AuditEvent{
+				Event:    AUDIT_ACL_DENIED,
+				ClientId: cn.Identifier,
+				UserName: cn.UserName,
+				Tenant:   cn.Tenant.GetName(),
+				Topic:    payload.TopicPath,
+				QoS:      &requested,
+				Reason:   "subscribe",
+			})
+			binary.Write(qosBuffer, binary.BigEndian, uint8(0x80))
 			continue
 		}
+		binary.Write(qosBuffer, binary.BigEndian, uint8(granted))
 
-		set := &SubscribeSet{
-			TopicFilter: payload.TopicPath,
-			ClientId:    conn.GetId(),
-			QoS:         int(payload.RequestedQos),
+		set := self.newSubscribeSet(conn.GetId(), cn.Tenant, payload.TopicPath, granted)
+		set.Admin = cn.Admin
+		if set.OriginalFilter != "" {
+			log.Debug("rewrite topic filter %s -> %s", payload.TopicPath, set.TopicFilter)
 		}
-		binary.Write(qosBuffer, binary.BigEndian, payload.RequestedQos)
 
-		self.Qlobber.Add(payload.TopicPath, set)
+		// [MQTT-3.8.4-3] an existing subscription is replaced by the new one (and retained messages are re-sent).
+		if old, ok := cn.GetSubscribedTopics()[payload.TopicPath]; ok {
+			self.Subscriptions.Remove(old.Handle)
+		}
+		set.Handle = self.Subscriptions.Add(filter, set)
 		conn.AppendSubscribedTopic(payload.TopicPath, set)
-		retaines := self.RetainMatch(payload.TopicPath)
+		retaines := self.RetainMatch(filter)
 
 		if len(retaines) > 0 {
 			for i := range retaines {
 				log.Debug("Retains: %s", retaines[i].TopicName)
-				id := conn.GetOutGoingTable().NewId()
+				if !self.visible(retaines[i].TopicName, set) {
+					continue
+				}
 
 				pp, _ := codec.CopyPublishMessage(retaines[i])
-				pp.PacketIdentifier = id
-				conn.GetOutGoingTable().Register(id, pp, conn)
+				self.localTopic(pp, set)
+
+				if pp.QosLevel > granted {
+					pp.QosLevel = granted
+				}
+				if pp.QosLevel > 0 {
+					if _, err := conn.GetOutGoingTable().Add(pp, 1, conn); err != nil {
+						// every packet identifier is in use. send the current value at least.
+						log.Info("send a retained message to %s with QoS 0: %s", conn.GetId(), err)
+						pp.QosLevel = 0
+					}
+				}
 				retained = append(retained, pp)
 			}
 		}
@@ -241,10 +473,71 @@ func (self *Momonga) Subscribe(p *codec.SubscribeMessage, conn Connection) {
 	if len(retained) > 0 {
 		log.Debug("Send retained Message To: %s", conn.GetId())
 		for i := range retained {
-			conn.WriteMessageQueue(retained[i])
+			// retained messages are subject to the inflight window as well.
+			self.deliver(cn, retained[i])
+		}
+	}
+
+}
+
+// visible reports whether the subscriber of set may receive a message of topic.
+func (self *Momonga) visible(topic string, set *SubscribeSet) bool {
+	if !strings.HasPrefix(topic, set.Mountpoint) {
+		return false
+	}
+	// wildcards of the default namespace (e.g. #) must not match topics of tenants.
+	if set.Mountpoint == "" && !set.Admin && self.tenantOf(topic) != nil {
+		return false
+	}
+	topic = strings.TrimPrefix(topic, set.Mountpoint)
+
+	filter := set.TopicFilter
+	if set.OriginalFilter != "" {
+		filter = set.OriginalFilter
+	}
+	// [MQTT-4.7.2-1] The Server MUST NOT match Topic Filters starting with a wildcard character (# or +)
+	// with Topic Names beginning with a $ character. Subscriptions only sees mounted topics, so $ topics
+	// inside a tenant are checked here.
+	return !strings.HasPrefix(topic, "$") || !strings.ContainsAny(filter[0:1], "+#")
+}
+
+// matchSubscriptions returns subscriptions which receive a message of topic.
+func (self *Momonga) matchSubscriptions(topic string) []*SubscribeSet {
+	targets := self.Subscriptions.Match(topic)
+	result := make([]*SubscribeSet, 0, len(targets))
+	for _, v := range targets {
+		// NOTE: the trie doesn't know mountpoints.
+		if self.visible(topic, v) {
+			result = append(result, v)
 		}
 	}
+	return result
+}
 
+// localTopic maps the topic of msg back to the namespace of the subscriber (see Tenant and TopicRewriter).
+func (self *Momonga) localTopic(msg *codec.PublishMessage, set *SubscribeSet) {
+	msg.TopicName = strings.TrimPrefix(msg.TopicName, set.Mountpoint)
+	if set.OriginalFilter != "" {
+		msg.TopicName = self.Rewriter().Reverse(msg.TopicName, set.OriginalFilter)
+	}
+}
+
+// GrantQos returns the QoS granted for the requested subscription, or -1 when it is refused.
+func (self *Momonga) GrantQos(mux *MmuxConnection, filter string, requested int) int {
+	// The Server MUST treat a SUBSCRIBE packet with a Requested QoS other than 0, 1 or 2 as malformed.
+	// we just refuse that subscription.
+	if requested < 0 || requested > 2 {
+		return -1
+	}
+
+	max := self.config.GetMaxQos(mux.UserName, filter)
+	if mux.Tenant != nil && mux.Tenant.MaxQos < max {
+		max = mux.Tenant.MaxQos
+	}
+	if requested > max {
+		return max
+	}
+	return requested
 }
 
 func (self *Momonga) SendMessage(topic string, message []byte, qos int) {
@@ -256,44 +549,117 @@ func (self *Momonga) SendMessage(topic string, message []byte, qos int) {
 }
 
 func (self *Momonga) GetConnectionByClientId(clientId string) (*MmuxConnection, error) {
-	hash := util.MurmurHash([]byte(clientId))
-	key := hash % uint32(self.config.Engine.LockPoolSize)
-
-	self.LockPool[key].RLock()
-	if cn, ok := self.Connections[clientId]; ok {
-		self.LockPool[key].RUnlock()
+	if cn, ok := self.Connections.Get(clientId); ok {
 		return cn, nil
 	}
-
-	self.LockPool[key].RUnlock()
 	return nil, fmt.Errorf("not found")
 }
 
 func (self *Momonga) SetConnectionByClientId(clientId string, conn *MmuxConnection) {
-	hash := util.MurmurHash([]byte(clientId))
-	key := hash % uint32(self.config.Engine.LockPoolSize)
-
-	self.LockPool[key].Lock()
-	defer self.LockPool[key].Unlock()
-	self.Connections[clientId] = conn
+	self.Connections.Swap(clientId, conn)
 }
 
 func (self *Momonga) RemoveConnectionByClientId(clientId string) {
-	hash := util.MurmurHash([]byte(clientId))
-	key := hash % uint32(self.config.Engine.LockPoolSize)
+	self.Connections.Delete(clientId)
+}
+
+func (self *Momonga) getSessionLock(identifier string) *sync.Mutex {
+	hash := util.MurmurHash([]byte(identifier))
+	return self.SessionLock[hash%uint32(self.config.Engine.LockPoolSize)]
+}
 
-	self.LockPool[key].Lock()
-	delete(self.Connections, clientId)
-	self.LockPool[key].Unlock()
+// registerSession stores mux under its id. When experimental.newid is enabled, the bare
+// client identifier also points to mux so that a following CONNECT can find (and take over) it.
+func (self *Momonga) registerSession(mux *MmuxConnection) {
+	self.SetConnectionByClientId(mux.GetId(), mux)
+	if mux.GetId() != mux.Identifier {
+		self.SetConnectionByClientId(mux.Identifier, mux)
+	}
+}
+
+// inflightTable returns the table of the experimental QoS 1 fanout for clientId.
+// it returns nil when the client doesn't have one and create is false.
+func (self *Momonga) inflightTable(clientId string, create bool) *util.MessageTable {
+	self.inflightLock.RLock()
+	tbl, ok := self.InflightTable[clientId]
+	self.inflightLock.RUnlock()
+	if ok || !create {
+		return tbl
+	}
+
+	self.inflightLock.Lock()
+	defer self.inflightLock.Unlock()
+	if tbl, ok = self.InflightTable[clientId]; !ok {
+		tbl = util.NewMessageTable()
+		self.InflightTable[clientId] = tbl
+	}
+	return tbl
+}
+
+// discardSession removes subscriptions and registry entries of mux.
+// a newer session registered under the same key is kept.
+func (self *Momonga) discardSession(mux *MmuxConnection) {
+	self.CleanSubscription(mux)
+	self.Connections.CompareAndDelete(mux.GetId(), mux)
+	self.Connections.CompareAndDelete(mux.Identifier, mux)
+}
+
+// selectSubscriptions picks the subscriptions a message is delivered to.
+//
+// NOTE (from interoperability/client_test.py):
+//
+//   overlapping subscriptions. When there is more than one matching subscription for the same client for a topic,
+//   the server may send back one message with the highest QoS of any matching subscription, or one message for
+//   each subscription with a matching QoS.
+//
+// perSubscription chooses the latter.
+func selectSubscriptions(targets []*SubscribeSet, perSubscription bool) []*SubscribeSet {
+	sets := make([]*SubscribeSet, 0, len(targets))
+	index := make(map[string]int)
+
+	for _, set := range targets {
+		if !perSubscription {
+			if j, ok := index[set.ClientId]; ok {
+				if set.QoS > sets[j].QoS {
+					sets[j] = set
+				}
+				continue
+			}
+			index[set.ClientId] = len(sets)
+		}
+		sets = append(sets, set)
+	}
+
+	return sets
 }
 
 func (self *Momonga) SendPublishMessage(msg *codec.PublishMessage) {
 	// Don't pass wrong message here. user should validate the message be ore using this API.
-	if len(msg.TopicName) < 1 {
+	if err := codec.ValidateTopicName(msg.TopicName); err != nil {
+		log.Error("discard publish message. [%q] %s", msg.TopicName, err)
 		return
 	}
 
-	// TODO: Have to persist retain message.
+	if strings.HasPrefix(msg.TopicName, DELAYED_TOPIC_PREFIX) {
+		self.scheduleDelayedTopic(msg)
+		return
+	}
+
+	if topic := self.rewriteTopic(msg.TopicName); topic != msg.TopicName {
+		log.Debug("rewrite topic %s -> %s", msg.TopicName, topic)
+		msg.TopicName = topic
+	}
+
+	// reject malformed payloads before storing or fanning them out.
+	// an empty retained message deletes the retained one, so it isn't validated.
+	if msg.Retain == 0 || len(msg.Payload) > 0 {
+		if err := self.Validator().Validate(msg.TopicName, msg.Payload); err != nil {
+			self.rejectPublish(msg, err.(*PayloadError))
+			return
+		}
+	}
+
+	// retained messages survive restarts when the disk datastore is configured.
 	if msg.Retain > 0 {
 		if len(msg.Payload) == 0 {
 			log.Debug("[DELETE RETAIN: %s]\n%s", msg.TopicName, hex.Dump([]byte(msg.TopicName)))
@@ -307,17 +673,16 @@ func (self *Momonga) SendPublishMessage(msg *codec.PublishMessage) {
 			// あれ、ackとかかえすんだっけ？
 			return
 		} else {
-			buffer := bytes.NewBuffer(nil)
-			codec.WriteMessageTo(msg, buffer)
-			self.DataStore.Put([]byte(msg.TopicName), buffer.Bytes())
+			self.DataStore.Put([]byte(msg.TopicName), encodeRetained(msg, time.Now()))
 		}
 	}
 
 	if Mflags["experimental.qos1"] {
 		if msg.QosLevel == 1 {
-			targets := self.Qlobber.Match(msg.TopicName)
+			// NOTE: inflight messages are managed by client id in this path, so a client receives one message.
+			targets := selectSubscriptions(self.matchSubscriptions(msg.TopicName), false)
 
-			go func(msg *codec.PublishMessage, set []interface{}) {
+			go func(msg *codec.PublishMessage, set []*SubscribeSet) {
 				p := make(chan string, 1000)
 				wg := sync.WaitGroup{}
 				wg.Add(3) // bulk sernder, retry kun, receive kun
@@ -393,30 +758,15 @@ func (self *Momonga) SendPublishMessage(msg *codec.PublishMessage) {
 				}(p, term, cnt, mng, mchan)
 
 				// sender. これは勝手に終わる
-				go func(msg *codec.PublishMessage, set []interface{}, p chan string, mng map[string]*codec.PublishMessage) {
-					dp := make(map[string]bool)
+				go func(msg *codec.PublishMessage, set []*SubscribeSet, p chan string, mng map[string]*codec.PublishMessage) {
 					for i := range targets {
-						var tbl *util.MessageTable
-						var ok bool
-
-						myset := targets[i].(*SubscribeSet)
-						fmt.Printf("myset: %s", myset)
-
-						// NOTE (from interoperability/client_test.py):
-						//
-						//   overlapping subscriptions. When there is more than one matching subscription for the same client for a topic,
-						//   the server may send back one message with the highest QoS of any matching subscription, or one message for
-						//   each subscription with a matching QoS.
-						//
-						// Currently, We choose one message for each subscription with a matching QoS.
-						//
-						if _, ok := dp[myset.ClientId]; ok {
-							continue
-						}
-						dp[myset.ClientId] = true
+						myset := targets[i]
 
 						x, _ := codec.CopyPublishMessage(msg)
-						x.QosLevel = myset.QoS
+						if x.QosLevel > myset.QoS {
+							x.QosLevel = myset.QoS
+						}
+						self.localTopic(x, myset)
 						conn, err := self.GetConnectionByClientId(myset.ClientId)
 						// これは面倒臭い。clean sessionがtrueで再接続した時はもはや別人として扱わなければならない
 						if conn.GetId() != myset.ClientId {
@@ -431,17 +781,15 @@ func (self *Momonga) SendPublishMessage(msg *codec.PublishMessage) {
 							continue
 						}
 
-						if tbl, ok = self.InflightTable[myset.ClientId]; !ok {
-							self.InflightTable[myset.ClientId] = util.NewMessageTable()
-							// callback仕込めるんだよなー。QoS1なら使わなくてもいいかなー。とかおもったり
-
-							tbl = self.InflightTable[myset.ClientId]
-						}
+						// callback仕込めるんだよなー。QoS1なら使わなくてもいいかなー。とかおもったり
+						tbl := self.inflightTable(myset.ClientId, true)
 
-						id := tbl.NewId()
-						x.PacketIdentifier = id
 						x.Opaque = p
-						tbl.Register2(id, x, 1, x)
+						if _, e := tbl.Add(x, 1, x); e != nil {
+							log.Error("can't deliver a message to %s: %s", myset.ClientId, e)
+							p <- myset.ClientId
+							continue
+						}
 
 						if err != nil {
 							continue
@@ -468,11 +816,7 @@ func (self *Momonga) SendPublishMessage(msg *codec.PublishMessage) {
 	// Publishで受け取ったMessageIdのやつのCountをとっておく
 	// で、Pubackが帰ってきたらrefcountを下げて0になったらMessageを消す
 	//log.Debug("TopicName: %s %s", m.TopicName, m.Payload)
-	targets := self.Qlobber.Match(msg.TopicName)
-	if msg.TopicName[0:1] == "#" {
-		// TODO:  [MQTT-4.7.2-1] The Server MUST NOT match Topic Filters starting with a wildcard character
-		// (# or +) with Topic Names beginning with a $ character
-	}
+	targets := self.matchSubscriptions(msg.TopicName)
 
 	// TODO: これ詰まるから各種コネクション側でやらないほうがいいよなー・・・
 	//
@@ -485,28 +829,15 @@ func (self *Momonga) SendPublishMessage(msg *codec.PublishMessage) {
 	// }
 	// いやまぁエラーハンドリングちゃんとやってれば問題ない。
 	// client idのほうがベターだな。Connectionを無駄に参照つけると後が辛い
-	dp := make(map[string]bool)
-	for i := range targets {
-		var cn Connection
+	sets := selectSubscriptions(targets, self.config.DeliverPerSubscription())
+	for i := range sets {
+		var cn *MmuxConnection
 		var ok error
 
-		myset := targets[i].(*SubscribeSet)
+		myset := sets[i]
 		clientId := myset.ClientId
 		//clientId := targets[i].(string)
 
-		// NOTE (from interoperability/client_test.py):
-		//
-		//   overlapping subscriptions. When there is more than one matching subscription for the same client for a topic,
-		//   the server may send back one message with the highest QoS of any matching subscription, or one message for
-		//   each subscription with a matching QoS.
-		//
-		// Currently, We choose one message for each subscription with a matching QoS.
-		//
-		if _, ok := dp[clientId]; ok {
-			continue
-		}
-		dp[clientId] = true
-
 		cn, ok = self.GetConnectionByClientId(clientId)
 		if ok != nil {
 			// どちらかというとClientが悪いと思うよ！
@@ -527,23 +858,20 @@ func (self *Momonga) SendPublishMessage(msg *codec.PublishMessage) {
 		if subscriberQos < x.QosLevel {
 			x.QosLevel = subscriberQos
 		}
+		self.localTopic(x, myset)
 
-		if x.QosLevel > 0 {
-			// TODO: ClientごとにInflightTableを持つ
-			// engineのOutGoingTableなのはとりあえず、ということ
-			id := self.OutGoingTable.NewId()
-			x.PacketIdentifier = id
-			if sender, ok := x.Opaque.(Connection); ok {
-				// TODO: ここ
-				self.OutGoingTable.Register2(x.PacketIdentifier, x, len(targets), sender)
-			}
-		}
-
+		// the packet identifier is assigned by the inflight table of the connection. see MyConnection
 		x.Opaque = cn
-		self.publishQueue <- x
+		self.enqueue(cn, x)
 	}
 }
 
+// enqueue passes m to the fan-out worker of mux. messages to a client always go through
+// the same worker, so they are delivered in the order they were published. [MQTT-4.6.0-6]
+func (self *Momonga) enqueue(mux *MmuxConnection, m *codec.PublishMessage) {
+	self.publishQueues[mux.GetHash()%uint32(len(self.publishQueues))] <- m
+}
+
 // below methods are intend to maintain engine itself (remove needless connection, dispatch queue).
 func (self *Momonga) RunMaintenanceThread() {
 	for {
@@ -563,31 +891,54 @@ func (self *Momonga) RunMaintenanceThread() {
 			self.System.Broker.Broker.Uptime = int(now.Sub(self.Started) / 1e9)
 			self.SendMessage("$SYS/broker/broker/uptime", []byte(fmt.Sprintf("%d", self.System.Broker.Broker.Uptime)), 0)
 			self.SendMessage("$SYS/broker/broker/time", []byte(fmt.Sprintf("%d", now.Unix())), 0)
-			self.SendMessage("$SYS/broker/clients/connected", []byte(fmt.Sprintf("%d", self.System.Broker.Clients.Connected)), 0)
-			self.SendMessage("$SYS/broker/messages/received", []byte(fmt.Sprintf("%d", self.System.Broker.Messages.Received)), 0)
-			self.SendMessage("$SYS/broker/messages/sent", []byte(fmt.Sprintf("%d", self.System.Broker.Messages.Sent)), 0)
+			self.SendMessage("$SYS/broker/clients/connected", []byte(fmt.Sprintf("%d", atomic.LoadInt64(&self.System.Broker.Clients.Connected))), 0)
+			self.SendMessage("$SYS/broker/messages/received", []byte(fmt.Sprintf("%d", atomic.LoadInt64(&self.System.Broker.Messages.Received))), 0)
+			self.SendMessage("$SYS/broker/messages/sent", []byte(fmt.Sprintf("%d", atomic.LoadInt64(&self.System.Broker.Messages.Sent))), 0)
 			self.SendMessage("$SYS/broker/messages/stored", []byte(fmt.Sprintf("%d", 0)), 0)
-			self.SendMessage("$SYS/broker/messages/publish/dropped", []byte(fmt.Sprintf("%d", 0)), 0)
+			self.SendMessage("$SYS/broker/messages/publish/dropped", []byte(fmt.Sprintf("%d", atomic.LoadInt64(&self.System.Broker.Messages.Publish.Dropped))), 0)
+			self.SendMessage("$SYS/broker/messages/publish/rejected", []byte(fmt.Sprintf("%d", atomic.LoadInt64(&self.System.Broker.Messages.Publish.Rejected))), 0)
 			self.SendMessage("$SYS/broker/messages/retained/count", []byte(fmt.Sprintf("%d", 0)), 0)
 			self.SendMessage("$SYS/broker/messages/inflight", []byte(fmt.Sprintf("%d", 0)), 0)
-			self.SendMessage("$SYS/broker/clients/total", []byte(fmt.Sprintf("%d", 0)), 0)
+			self.SendMessage("$SYS/broker/clients/total", []byte(fmt.Sprintf("%d", self.Connections.Len())), 0)
 			self.SendMessage("$SYS/broker/clients/maximum", []byte(fmt.Sprintf("%d", 0)), 0)
 			self.SendMessage("$SYS/broker/clients/disconnected", []byte(fmt.Sprintf("%d", 0)), 0)
+			self.SendMessage("$SYS/broker/clients/expired", []byte(fmt.Sprintf("%d", atomic.LoadInt64(&self.System.Broker.Clients.Expired))), 0)
 			self.SendMessage("$SYS/broker/load/bytes/sent", []byte(fmt.Sprintf("%d", 0)), 0)
 			self.SendMessage("$SYS/broker/load/bytes/received", []byte(fmt.Sprintf("%d", 0)), 0)
-			self.SendMessage("$SYS/broker/subscriptions/count", []byte(fmt.Sprintf("%d", 0)), 0)
+			self.SendMessage("$SYS/broker/subscriptions/count", []byte(fmt.Sprintf("%d", self.Subscriptions.Count())), 0)
+			if self.config.Engine.MatchCacheSize > 0 {
+				stats := self.Subscriptions.CacheStats()
+				self.SendMessage("$SYS/broker/subscriptions/cache/size", []byte(fmt.Sprintf("%d", stats.Size)), 0)
+				self.SendMessage("$SYS/broker/subscriptions/cache/hits", []byte(fmt.Sprintf("%d", stats.Hits)), 0)
+				self.SendMessage("$SYS/broker/subscriptions/cache/misses", []byte(fmt.Sprintf("%d", stats.Misses)), 0)
+				self.SendMessage("$SYS/broker/subscriptions/cache/evictions", []byte(fmt.Sprintf("%d", stats.Evictions)), 0)
+				self.SendMessage("$SYS/broker/subscriptions/cache/invalidations", []byte(fmt.Sprintf("%d", stats.Invalidations)), 0)
+			}
 		}
 
-		time.Sleep(time.Second)
+		self.deliverDelayedMessages(time.Now())
+		self.reapIdleConnections(time.Now())
+		self.expireSessions(time.Now())
+
+		// spilled messages of slow consumers
+		for _, mux := range self.Sessions() {
+			mux.FlushOfflineQueue()
+		}
+
+		select {
+		case <-self.quit:
+			return
+		case <-time.After(time.Second):
+		}
 	}
 }
 
-func (self *Momonga) Work() {
+func (self *Momonga) Work(queue <-chan *codec.PublishMessage) {
 	// TODO: improve this
 	for {
 		select {
 		// とにかくQos0の配送をFanoutさせるのが目的だったけど、、、いらなくね？
-		case m := <-self.publishQueue:
+		case m := <-queue:
 			// NOTE: ここは単純にdestinationに対して送る、だけにしたい
 			// 時間がかかる処理をやってはいけない
 
@@ -600,12 +951,16 @@ func (self *Momonga) Work() {
 				continue
 			}
 
-			if cn, ok = m.Opaque.(Connection); ok {
+			if mux, isMux := op.(*MmuxConnection); isMux {
+				self.deliver(mux, m)
+			} else if cn, ok = m.Opaque.(Connection); ok {
 				cn.WriteMessageQueue(m)
-				self.System.Broker.Messages.Sent++
+				atomic.AddInt64(&self.System.Broker.Messages.Sent, 1)
 			} else {
 				log.Error("Opaque is not set")
 			}
+		case <-self.quit:
+			return
 		case <-self.ErrorChannel:
 			///self.RetryMap[r.Id] = append(self.RetryMap[r.Id], r)
 			log.Debug("ADD RETRYABLE MAP. But we don't do anything")
@@ -615,11 +970,69 @@ func (self *Momonga) Work() {
 	}
 }
 
+// deliver writes m to mux without blocking the fan-out worker. When the client can't keep up
+// with its outbound queue, the slow consumer policy decides what happens to m.
+func (self *Momonga) deliver(mux *MmuxConnection, m *codec.PublishMessage) {
+	err := mux.TryWriteMessageQueue(m)
+	if err == nil {
+		atomic.AddInt64(&self.System.Broker.Messages.Sent, 1)
+		return
+	}
+
+	if err == ErrInflightFull {
+		// wait in the session queue until the client acknowledges inflight messages. see Handler.Puback
+		if !mux.Spill(m) {
+			log.Info("offline queue is full. dropped a message for [%s]", mux.GetId())
+			atomic.AddInt64(&self.System.Broker.Messages.Publish.Dropped, 1)
+		}
+		return
+	}
+
+	mux.MarkSlow()
+	switch self.config.GetSlowConsumerPolicy() {
+	case "disconnect":
+		log.Info("disconnect slow consumer. [%s]", mux.GetId())
+		if cn := mux.primary(); cn != nil {
+			closeConnection(cn, "slow consumer")
+		}
+		if m.QosLevel == 0 {
+			self.dropMessage(mux, m)
+			return
+		}
+	case "drop":
+		if m.QosLevel == 0 {
+			self.dropMessage(mux, m)
+			return
+		}
+	}
+
+	if !mux.Spill(m) {
+		log.Info("offline queue is full. dropped a message for [%s]", mux.GetId())
+		atomic.AddInt64(&self.System.Broker.Messages.Publish.Dropped, 1)
+	}
+}
+
+func (self *Momonga) dropMessage(mux *MmuxConnection, m *codec.PublishMessage) {
+	log.Debug("dropped a message for slow consumer. [%s] %s", mux.GetId(), m.TopicName)
+	mux.MarkDropped()
+	atomic.AddInt64(&self.System.Broker.Messages.Publish.Dropped, 1)
+}
+
+// Sessions returns a snapshot of registered sessions.
+func (self *Momonga) Sessions() []*MmuxConnection {
+	return self.Connections.Snapshot()
+}
+
 func (self *Momonga) Run() {
 	go self.RunMaintenanceThread()
 
-	for i := 0; i < self.config.GetFanoutWorkerCount(); i++ {
-		go self.Work()
+	if self.auditQueue != nil {
+		self.auditWorker.Add(1)
+		go self.publishAuditEvents()
+	}
+
+	for _, queue := range self.publishQueues {
+		go self.Work(queue)
 	}
 }
 
@@ -642,8 +1055,20 @@ func (self *Momonga) checkVersion(p *codec.ConnectMessage) error {
 func (self *Momonga) Handshake(p *codec.ConnectMessage, conn *MyConnection) *MmuxConnection {
 	log.Debug("handshaking: %s", p.Identifier)
 
+	event := &AuditEvent{
+		Event:           AUDIT_CONNECT,
+		ClientId:        p.Identifier,
+		UserName:        p.UserName,
+		RemoteAddr:      remoteAddr(conn),
+		ProtocolVersion: int(p.Version),
+		CleanSession:    &p.CleanSession,
+		Result:          "rejected",
+	}
+
 	if conn.Connected == true {
 		log.Error("wrong sequence. (connect twice)")
+		event.Reason = "connect twice"
+		self.audit(event)
 		conn.Close()
 		return nil
 	}
@@ -651,14 +1076,56 @@ func (self *Momonga) Handshake(p *codec.ConnectMessage, conn *MyConnection) *Mmu
 	if ok := self.checkVersion(p); ok != nil {
 		conn.Close()
 		log.Error("magic is not expected: %s  %+v\n", string(p.Magic), p)
-		conn.Close()
+		event.Reason = ok.Error()
+		self.audit(event)
+		return nil
 	}
 
+	tenant := self.resolveTenant(p.UserName, conn.Listener)
+	event.Tenant = tenant.GetName()
+
 	// TODO: implement authenticator
+	self.audit(&AuditEvent{
+		Event:      AUDIT_AUTH,
+		ClientId:   p.Identifier,
+		UserName:   p.UserName,
+		Tenant:     event.Tenant,
+		RemoteAddr: event.RemoteAddr,
+		Result:     "allowed",
+		Reason:     "no authenticator",
+	})
+
+	if tenant == nil && self.isReservedId(p.Identifier) {
+		log.Error("client identifier %s is reserved for a tenant", p.Identifier)
+		event.Reason = "identifier reserved for a tenant"
+		self.audit(event)
+		// 0x02 Connection Refused, identifier rejected
+		self.refuseConnection(conn, 0x02, event.Reason)
+		return nil
+	}
+	// client identifiers (and so sessions) are scoped to the tenant.
+	p.Identifier = tenant.MountId(p.Identifier)
+	event.ClientId = p.Identifier
 
 	// preserve messagen when will flag set
 	if (p.Flag & 0x4) > 0 {
-		conn.SetWillMessage(*p.Will)
+		if err := codec.ValidateTopicName(p.Will.Topic); err != nil {
+			log.Error("invalid will topic: %q %s", p.Will.Topic, err)
+			event.Reason = "invalid will topic"
+			self.audit(event)
+			conn.Close()
+			return nil
+		}
+		if tenant == nil && self.tenantOf(p.Will.Topic) != nil {
+			log.Error("will topic %s is reserved for a tenant", p.Will.Topic)
+			event.Reason = "will topic reserved for a tenant"
+			self.audit(event)
+			conn.Close()
+			return nil
+		}
+		will := *p.Will
+		will.Topic = self.inboundTopic(tenant, will.Topic)
+		conn.SetWillMessage(will)
 	}
 
 	if !p.CleanSession {
@@ -668,61 +1135,103 @@ func (self *Momonga) Handshake(p *codec.ConnectMessage, conn *MyConnection) *Mmu
 	var mux *MmuxConnection
 	var err error
 
+	// the disconnect path of a replaced connection takes the same lock (see HandleConnection)
+	lock := self.getSessionLock(p.Identifier)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if tenant != nil && tenant.MaxConnections > 0 && self.tenantConnections(tenant, p.Identifier) >= tenant.MaxConnections {
+		log.Info("tenant %s reached max_connections (%d)", tenant.Name, tenant.MaxConnections)
+		event.Reason = "tenant max_connections"
+		self.audit(event)
+		// 0x03 Connection Refused, Server unavailable
+		self.refuseConnection(conn, 0x03, event.Reason)
+		return nil
+	}
+
 	reply := codec.NewConnackMessage()
 	if mux, err = self.GetConnectionByClientId(p.Identifier); err == nil {
-		// [MQTT-3.2.2-2] If the Server accepts a connection with CleanSession set to 0,
-		// the value set in Session Present depends on whether the Server already has stored Session state
-		// for the supplied client ID. If the Server has stored Session state,
-		// it MUST set Session Present to 1 in the CONNACK packet.
-		reply.Reserved |= 0x01
+		// [MQTT-3.1.4-2] If the ClientId represents a Client already connected to the Server
+		// then the Server MUST disconnect the existing Client.
+		//
+		// The existing connection is detached first, so its disconnect path
+		// neither publishes its will nor touches the session.
+		for _, old := range mux.DetachAll() {
+			log.Info("takeover: close existing connection of %s (%s)", p.Identifier, old.GetRealId())
+			self.audit(&AuditEvent{
+				Event:      AUDIT_TAKEOVER,
+				ClientId:   p.Identifier,
+				UserName:   mux.UserName,
+				RemoteAddr: remoteAddr(old),
+				Reason:     "taken over by " + event.RemoteAddr,
+			})
+			// the disconnect path of old doesn't publish the event as it has been detached.
+			disconnected := newClientEvent(mux, old)
+			disconnected.Reason = "taken over"
+			self.publishClientEvent("disconnected", disconnected)
+			closeConnection(old, disconnected.Reason)
+		}
+
+		if p.CleanSession || mux.CleanSession {
+			// [MQTT-3.1.2-6] If CleanSession is set to 1, the Client and Server MUST discard any previous Session
+			// and start a new one. a session which had CleanSession set to 1 lasts as long as its Network Connection.
+			self.discardSession(mux)
+			mux = nil
+		} else {
+			// [MQTT-3.2.2-2] If the Server accepts a connection with CleanSession set to 0,
+			// the value set in Session Present depends on whether the Server already has stored Session state
+			// for the supplied client ID. If the Server has stored Session state,
+			// it MUST set Session Present to 1 in the CONNACK packet.
+			reply.Reserved |= 0x01
+		}
 	}
 
+	conn.MaxQueuedMessages = self.config.Engine.MaxQueuedMessages
+	conn.MaxQueuedBytes = self.config.Engine.MaxQueuedBytes
+	conn.MaxInflightMessages = self.config.Engine.MaxInflightMessages
+	keepalive := self.keepalive(int(p.KeepAlive))
+
 	// CONNACK MUST BE FIRST RESPONSE
 	// clean周りはAttachでぜんぶやるべきでは
 	conn.WriteMessageQueue(reply)
 	if mux != nil {
+		mux.UserName = p.UserName
+		mux.Tenant = tenant
 		log.Info("Attach to mux[%s]", mux.GetId())
 
 		conn.SetId(p.Identifier)
-		conn.SetKeepaliveInterval(int(p.KeepAlive))
-		mux.SetKeepaliveInterval(int(p.KeepAlive))
+		conn.SetKeepaliveInterval(keepalive)
+		mux.SetKeepaliveInterval(keepalive)
 		mux.SetState(STATE_CONNECTED)
 		mux.DisableClearSession()
 		conn.SetGuid(mux.GetGuid())
 
-		if conn.ShouldClearSession() {
-			self.CleanSubscription(mux)
-
-			if Mflags["experimental.newid"] {
-				self.SetConnectionByClientId(mux.GetId(), mux)
-				self.RemoveConnectionByClientId(mux.Identifier)
-			}
-		} else {
-			if Mflags["experimental.newid"] {
-				// idを戻してもどす。
-				for t, v := range mux.GetSubscribedTopics() {
-					self.Qlobber.Remove(t, v)
-					v.ClientId = mux.GetId()
-					self.Qlobber.Add(t, v)
-				}
-				self.SetConnectionByClientId(mux.GetId(), mux)
-				self.RemoveConnectionByClientId(mux.Identifier)
+		if Mflags["experimental.newid"] {
+			// idを戻してもどす。
+			for _, v := range mux.GetSubscribedTopics() {
+				self.Subscriptions.Remove(v.Handle)
+				v.ClientId = mux.GetId()
+				v.Handle = self.Subscriptions.Add(v.TopicFilter, v)
 			}
+			self.registerSession(mux)
 		}
 		mux.Attach(conn)
 	} else {
 		mux = NewMmuxConnection()
 		mux.SetId(p.Identifier)
+		mux.UserName = p.UserName
+		mux.Tenant = tenant
 		i, _ := self.guidFactory.NewGUID(int64(mux.GetHash()))
 		mux.SetGuid(i)
 		conn.SetGuid(i)
 
+		// the keepalive reaper sees conn as soon as mux is registered.
+		conn.SetKeepaliveInterval(keepalive)
+		mux.SetKeepaliveInterval(keepalive)
 		mux.Attach(conn)
-		self.SetConnectionByClientId(mux.GetId(), mux)
+		self.registerSession(mux)
 
 		conn.SetId(p.Identifier)
-		conn.SetKeepaliveInterval(int(p.KeepAlive))
-		mux.SetKeepaliveInterval(int(p.KeepAlive))
 		mux.SetState(STATE_CONNECTED)
 
 		log.Debug("Starting new mux[%s]", mux.GetId())
@@ -730,7 +1239,9 @@ func (self *Momonga) Handshake(p *codec.ConnectMessage, conn *MyConnection) *Mmu
 
 	if p.CleanSession {
 		// これは正直どうでもいい
+		self.retryLock.Lock()
 		delete(self.RetryMap, mux.GetId())
+		self.retryLock.Unlock()
 	} else {
 		// Okay, attach to existing session.
 		tbl := mux.GetOutGoingTable()
@@ -756,7 +1267,10 @@ func (self *Momonga) Handshake(p *codec.ConnectMessage, conn *MyConnection) *Mmu
 
 	conn.Connected = true
 	log.Debug("handshake Successful: %s", p.Identifier)
-	self.System.Broker.Clients.Connected++
+	event.Result = "accepted"
+	self.audit(event)
+	self.publishClientEvent("connected", newClientEvent(mux, conn))
+	atomic.AddInt64(&self.System.Broker.Clients.Connected, 1)
 	return mux
 }
 
@@ -768,7 +1282,9 @@ func (self *Momonga) Unsubscribe(messageId uint16, granted int, payloads []codec
 	topics := conn.GetSubscribedTopics()
 	for _, payload := range payloads {
 		if v, ok := topics[payload.TopicPath]; ok {
-			self.Qlobber.Remove(payload.TopicPath, v)
+			self.Subscriptions.Remove(v.Handle)
+			// persistent sessions must not restore it.
+			conn.RemoveSubscribedTopic(payload.TopicPath)
 		}
 	}
 	conn.WriteMessageQueue(ack)
@@ -802,40 +1318,54 @@ func (self *Momonga) HandleConnection(conn Connection) {
 				log.Error("(while processing disconnect)can't fetch connection: %s, %T", conn.GetId(), conn)
 			}
 
-			if _, ok := err.(*DisconnectError); !ok {
-				if conn.HasWillMessage() {
-					self.SendWillMessage(conn)
-				}
-
-				if err == io.EOF {
-					// nothing to do
-				} else {
-					log.Error("Handle Connection Error: %s", err)
-				}
+			event := &AuditEvent{
+				Event:      AUDIT_DISCONNECT,
+				RemoteAddr: remoteAddr(conn),
+				Reason:     disconnectReason(err),
+			}
+			if mux != nil {
+				event.ClientId = mux.Identifier
+				event.UserName = mux.UserName
+			}
+			if c, ok := conn.(*MyConnection); ok && c.DisconnectReason != "" {
+				event.Reason = c.DisconnectReason
 			}
 
 			if mux != nil {
-				mux.Detach(conn)
+				lock := self.getSessionLock(mux.Identifier)
+				lock.Lock()
 
-				if mux.ShouldClearSession() {
-					self.CleanSubscription(mux)
-					self.RemoveConnectionByClientId(mux.GetId())
+				if !mux.Detach(conn) {
+					// this connection was taken over by a newer one (or kicked, or closed on shutdown).
+					// the session belongs to it now and the will message MUST NOT be published.
+					log.Debug("%s has been detached", conn.GetId())
 				} else {
-					// Attach出来ない対策
-					if Mflags["experimental.newid"] {
-						// idを戻してもどす
-						self.SetConnectionByClientId(mux.Identifier, mux)
-						for t, v := range mux.GetSubscribedTopics() {
-							self.Qlobber.Remove(t, v)
-							v.ClientId = mux.Identifier
-							self.Qlobber.Add(t, v)
+					disconnected := newClientEvent(mux, conn)
+					disconnected.Reason = event.Reason
+					self.publishClientEvent("disconnected", disconnected)
+
+					if _, ok := err.(*DisconnectError); !ok {
+						if conn.HasWillMessage() {
+							self.SendWillMessage(conn)
 						}
 
-						self.RemoveConnectionByClientId(mux.GetId())
+						if err == io.EOF {
+							// nothing to do
+						} else {
+							log.Error("Handle Connection Error: %s", err)
+						}
+					}
+
+					if mux.ShouldClearSession() {
+						self.discardSession(mux)
+					} else {
+						self.keepOfflineSession(mux)
 					}
 				}
+				lock.Unlock()
 			}
 
+			self.audit(event)
 			conn.Close()
 			hndr.Close()
 			return
@@ -843,12 +1373,56 @@ func (self *Momonga) HandleConnection(conn Connection) {
 	}
 }
 
+// refuseConnection replies CONNACK with code and closes conn.
+func (self *Momonga) refuseConnection(conn *MyConnection, code uint8, reason string) {
+	reply := codec.NewConnackMessage()
+	reply.ReturnCode = code
+	// the write loop discards queued messages once conn is closed.
+	conn.WriteMessage(reply)
+	closeConnection(conn, reason)
+}
+
+// keepOfflineSession keeps mux (which has no connection) so that the client can resume it.
+func (self *Momonga) keepOfflineSession(mux *MmuxConnection) {
+	// Attach出来ない対策
+	if Mflags["experimental.newid"] {
+		// idを戻してもどす
+		self.SetConnectionByClientId(mux.Identifier, mux)
+		for _, v := range mux.GetSubscribedTopics() {
+			self.Subscriptions.Remove(v.Handle)
+			v.ClientId = mux.Identifier
+			v.Handle = self.Subscriptions.Add(v.TopicFilter, v)
+		}
+
+		self.RemoveConnectionByClientId(mux.GetId())
+	}
+}
+
+// closeConnection closes a connection on purpose. its disconnect path reports reason.
+func closeConnection(conn Connection, reason string) {
+	if c, ok := conn.(*MyConnection); ok {
+		c.DisconnectReason = reason
+	}
+	conn.Close()
+}
+
+func disconnectReason(err error) string {
+	switch err {
+	case io.EOF:
+		return "connection closed by client"
+	}
+	if _, ok := err.(*DisconnectError); ok {
+		return "disconnect"
+	}
+	return err.Error()
+}
+
 func (self *Momonga) Config() *configuration.Config {
 	return self.config
 }
 
 func (self *Momonga) Doom() {
-	for _, v := range self.Connections {
+	for _, v := range self.Sessions() {
 		wait := 5 + rand.Intn(30)
 		log.Info("DOOM in %d seconds: %s\n", wait, v.GetId())
 		go func(x *MmuxConnection, wait int) {
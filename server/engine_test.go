@@ -2,6 +2,8 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	. "github.com/chobie/momonga/common"
 	"github.com/chobie/momonga/configuration"
 	codec "github.com/chobie/momonga/encoding/mqtt"
@@ -9,7 +11,11 @@ import (
 	. "gopkg.in/check.v1"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,6 +27,38 @@ type MockConnection struct {
 	Local  mockAddr
 	Remote mockAddr
 	Type   int
+	// the write loop of MyConnection writes while tests read.
+	mutex sync.Mutex
+}
+
+func (m *MockConnection) Read(p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Buffer.Read(p)
+}
+
+func (m *MockConnection) Write(b []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Buffer.Write(b)
+}
+
+func (m *MockConnection) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Buffer.Len()
+}
+
+func (m *MockConnection) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Buffer.Reset()
+}
+
+func (m *MockConnection) IsClosed() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Closed
 }
 
 type mockAddr struct {
@@ -35,6 +73,8 @@ func (m *mockAddr) String() string {
 }
 
 func (m *MockConnection) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.Closed = true
 	return nil
 }
@@ -60,11 +100,85 @@ func (m *MockConnection) SetWriteDeadline(t time.Time) error {
 }
 
 func CreateEngine() *Momonga {
-	return NewMomonga(configuration.DefaultConfiguration())
+	engine, err := NewMomonga(configuration.DefaultConfiguration())
+	if err != nil {
+		panic(err)
+	}
+	return engine
+}
+
+// testClient is a client connected by connect.
+type testClient struct {
+	Mock    *MockConnection
+	Conn    *MyConnection
+	Handler *Handler
+	// nil when the handshake failed.
+	Mux *MmuxConnection
+}
+
+// connect connects a MQTT 3.1.1 client over a MockConnection. options modify CONNECT before the handshake.
+func connect(engine *Momonga, id string, clean bool, options ...func(*codec.ConnectMessage)) *testClient {
+	mock := &MockConnection{}
+	client := connectOver(engine, mock, id, clean, options...)
+	client.Mock = mock
+	return client
+}
+
+// connectOver is connect over mock.
+func connectOver(engine *Momonga, mock net.Conn, id string, clean bool, options ...func(*codec.ConnectMessage)) *testClient {
+	conn := NewMyConnection()
+	conn.SetMyConnection(mock)
+	client := &testClient{
+		Conn:    conn,
+		Handler: NewHandler(conn, engine),
+	}
+
+	msg := codec.NewConnectMessage()
+	msg.Magic = []byte("MQTT")
+	msg.Version = uint8(4)
+	msg.Identifier = id
+	msg.CleanSession = clean
+	for _, option := range options {
+		option(msg)
+	}
+
+	client.Mux = engine.Handshake(msg, conn)
+	if client.Mux != nil {
+		client.Handler.Connection = client.Mux
+	}
+	return client
+}
+
+func withUser(user string) func(*codec.ConnectMessage) {
+	return func(msg *codec.ConnectMessage) {
+		msg.UserName = user
+	}
+}
+
+func withKeepalive(seconds uint16) func(*codec.ConnectMessage) {
+	return func(msg *codec.ConnectMessage) {
+		msg.KeepAlive = seconds
+	}
+}
+
+func withWill(topic, message string) func(*codec.ConnectMessage) {
+	return func(msg *codec.ConnectMessage) {
+		msg.Flag |= 0x4
+		msg.Will = &codec.WillMessage{Topic: topic, Message: message}
+	}
 }
 
 func Test(t *testing.T) { TestingT(t) }
 
+var loggingOnce sync.Once
+
+// setupLogging configures the logger once. log4go can't be reconfigured while goroutines of other tests log.
+func setupLogging() {
+	loggingOnce.Do(func() {
+		log.SetupLogging("error", "stdout")
+	})
+}
+
 type EngineSuite struct{}
 
 var _ = Suite(&EngineSuite{})
@@ -77,7 +191,7 @@ func (s *EngineSuite) TearDownSuite(c *C) {
 }
 
 func (s *EngineSuite) TestBasic(c *C) {
-	log.SetupLogging("error", "stdout")
+	setupLogging()
 
 	// This test introduce how to setup custom MQTT server
 
@@ -181,7 +295,7 @@ func (s *EngineSuite) TestBasic(c *C) {
 }
 
 func (s *EngineSuite) BenchmarkSimple(c *C) {
-	log.SetupLogging("error", "stdout")
+	setupLogging()
 
 	engine := CreateEngine()
 	go engine.Run()
@@ -230,3 +344,971 @@ func (s *EngineSuite) BenchmarkSimple(c *C) {
 	// That's it.
 	engine.Terminate()
 }
+
+func (s *EngineSuite) TestTakeover(c *C) {
+	setupLogging()
+
+	engine := CreateEngine()
+	go engine.Run()
+
+	// [MQTT-3.1.4-2] the existing client is disconnected and the session moves to the new connection.
+	client1 := connect(engine, "takeover", false, withWill("/will", "bye"))
+	client2 := connect(engine, "takeover", false, withWill("/will", "bye"))
+
+	c.Assert(client2.Mux, Equals, client1.Mux)
+	c.Assert(client1.Conn.GetState(), Equals, STATE_CLOSED)
+	c.Assert(client1.Mock.IsClosed(), Equals, true)
+	c.Assert(client2.Mux.PrimaryConnection, Equals, Connection(client2.Conn))
+
+	// the disconnect path of the replaced connection must not touch the session.
+	engine.HandleConnection(client1.Conn)
+	mux, err := engine.GetConnectionByClientId("takeover")
+	c.Assert(err, Equals, nil)
+	c.Assert(mux, Equals, client2.Mux)
+	c.Assert(mux.PrimaryConnection, Equals, Connection(client2.Conn))
+
+	// CleanSession=1 discards the previous session.
+	client3 := connect(engine, "takeover", true, withWill("/will", "bye"))
+	c.Assert(client3.Mux == client2.Mux, Equals, false)
+	c.Assert(client2.Conn.GetState(), Equals, STATE_CLOSED)
+
+	time.Sleep(time.Millisecond * 10)
+	r, err := codec.ParseMessage(client3.Mock, 0)
+	c.Assert(err, Equals, nil)
+	c.Assert(r.(*codec.ConnackMessage).Reserved, Equals, uint8(0))
+
+	engine.HandleConnection(client2.Conn)
+	mux, err = engine.GetConnectionByClientId("takeover")
+	c.Assert(err, Equals, nil)
+	c.Assert(mux, Equals, client3.Mux)
+}
+
+func (s *EngineSuite) TestGrantedQos(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.MaxQos = 1
+	config.Engine.QosLimits = []configuration.QosLimit{
+		{Topic: "/deny/#", MaxQos: -1},
+		{Topic: "/sensor/+", User: "guest", MaxQos: 0},
+	}
+	engine, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	go engine.Run()
+
+	client := connect(engine, "granted", true, withUser("guest"))
+	mux := client.Mux
+
+	sub := codec.NewSubscribeMessage()
+	sub.PacketIdentifier = 1
+	sub.Payload = []codec.SubscribePayload{
+		{TopicPath: "/a", RequestedQos: 0},
+		{TopicPath: "/b", RequestedQos: 2},
+		{TopicPath: "/deny/a", RequestedQos: 1},
+		{TopicPath: "/c/#/d", RequestedQos: 1},
+		{TopicPath: "/sensor/1", RequestedQos: 1},
+		{TopicPath: "/d", RequestedQos: 3},
+		// wildcards don't bypass limits.
+		{TopicPath: "#", RequestedQos: 1},
+		{TopicPath: "+/sensor/+", RequestedQos: 1},
+		{TopicPath: "/other/+", RequestedQos: 1},
+	}
+	engine.Subscribe(sub, mux)
+
+	time.Sleep(time.Millisecond * 10)
+	r, err := codec.ParseMessage(client.Mock, 0)
+	c.Assert(err, Equals, nil)
+	c.Assert(r.GetType(), Equals, codec.PACKET_TYPE_CONNACK)
+	r, err = codec.ParseMessage(client.Mock, 0)
+	c.Assert(err, Equals, nil)
+	c.Assert(r.GetType(), Equals, codec.PACKET_TYPE_SUBACK)
+	c.Assert(r.(*codec.SubackMessage).Qos, DeepEquals, []byte{0, 1, 0x80, 0x80, 0, 0x80, 0x80, 0, 1})
+
+	// the granted QoS is stored with the subscription and replaced on re-subscribe.
+	c.Assert(mux.GetSubscribedTopics()["/b"].QoS, Equals, 1)
+	sub.Payload = []codec.SubscribePayload{{TopicPath: "/b", RequestedQos: 0}}
+	engine.Subscribe(sub, mux)
+	c.Assert(mux.GetSubscribedTopics()["/b"].QoS, Equals, 0)
+	c.Assert(len(engine.Subscriptions.Match("/b")), Equals, 1)
+
+	engine.Terminate()
+}
+
+func (s *EngineSuite) TestOverlappingSubscriptions(c *C) {
+	setupLogging()
+
+	// interoperability/client_test.py: overlapping subscriptions
+	//   subscribe [("TopicA/#", 2), ("TopicA/+", 1)] then publish "TopicA/C" with QoS 2.
+	//   the server may send one message with QoS 2, or one message for each subscription (QoS 1 and 2).
+	deliver := func(mode string) []int {
+		config := configuration.DefaultConfiguration()
+		config.Engine.OverlappingSubscriptions = mode
+		engine, err := NewMomonga(config)
+		c.Assert(err, Equals, nil)
+		go engine.Run()
+		defer engine.Terminate()
+
+		client := connect(engine, "overlapping", true)
+
+		sub := codec.NewSubscribeMessage()
+		sub.PacketIdentifier = 1
+		sub.Payload = []codec.SubscribePayload{
+			{TopicPath: "TopicA/#", RequestedQos: 2},
+			{TopicPath: "TopicA/+", RequestedQos: 1},
+		}
+		engine.Subscribe(sub, client.Mux)
+		engine.SendMessage("TopicA/C", []byte("overlapping topic filters"), 2)
+
+		time.Sleep(time.Millisecond * 10)
+		var qos []int
+		for {
+			r, err := codec.ParseMessage(client.Mock, 0)
+			if err != nil {
+				break
+			}
+			if p, ok := r.(*codec.PublishMessage); ok {
+				c.Assert(p.TopicName, Equals, "TopicA/C")
+				qos = append(qos, p.QosLevel)
+			}
+		}
+		sort.Ints(qos)
+		return qos
+	}
+
+	c.Assert(deliver("highest"), DeepEquals, []int{2})
+	c.Assert(deliver("each"), DeepEquals, []int{1, 2})
+}
+
+func (s *EngineSuite) TestSelectSubscriptions(c *C) {
+	targets := []*SubscribeSet{
+		&SubscribeSet{ClientId: "a", TopicFilter: "a/#", QoS: 0},
+		&SubscribeSet{ClientId: "b", TopicFilter: "a/b", QoS: 1},
+		&SubscribeSet{ClientId: "a", TopicFilter: "a/b", QoS: 2},
+	}
+
+	sets := selectSubscriptions(targets, false)
+	c.Assert(len(sets), Equals, 2)
+	c.Assert(sets[0].ClientId, Equals, "a")
+	c.Assert(sets[0].QoS, Equals, 2)
+	c.Assert(sets[1].ClientId, Equals, "b")
+
+	c.Assert(len(selectSubscriptions(targets, true)), Equals, 3)
+}
+
+// BlockingConnection doesn't return from Write until released.
+type BlockingConnection struct {
+	MockConnection
+	release chan bool
+}
+
+func (m *BlockingConnection) Write(b []byte) (int, error) {
+	<-m.release
+	return m.MockConnection.Write(b)
+}
+
+func (s *EngineSuite) TestSlowConsumer(c *C) {
+	setupLogging()
+
+	setup := func(policy string) (*Momonga, *BlockingConnection, *MmuxConnection) {
+		config := configuration.DefaultConfiguration()
+		config.Engine.MaxQueuedMessages = 2
+		config.Engine.SlowConsumerPolicy = policy
+		engine, err := NewMomonga(config)
+		c.Assert(err, Equals, nil)
+
+		mock := &BlockingConnection{release: make(chan bool)}
+		mux := connectOver(engine, mock, "slow", true).Mux
+
+		// the writer is stuck in writing CONNACK.
+		time.Sleep(time.Millisecond * 10)
+		for i := 0; i < 5; i++ {
+			m := codec.NewPublishMessage()
+			m.TopicName = "/slow"
+			m.Payload = []byte("hello")
+			m.QosLevel = i % 2
+			engine.deliver(mux, m)
+		}
+		return engine, mock, mux
+	}
+
+	// drop: QoS 0 messages are discarded, QoS 1 messages wait in the offline queue.
+	engine, mock, mux := setup("drop")
+	queued, _, spilled := mux.QueueStats()
+	c.Assert(queued, Equals, 2)
+	c.Assert(spilled, Equals, 1)
+	slow, dropped, _ := mux.SlowStats()
+	c.Assert(slow, Equals, 3)
+	c.Assert(dropped, Equals, 2)
+	c.Assert(engine.System.Broker.Messages.Publish.Dropped, Equals, int64(2))
+	c.Assert(engine.System.Broker.Messages.Sent, Equals, int64(2))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/debug/slow_consumers", nil)
+	(&MyHttpServer{Engine: engine}).ServeHTTP(w, req)
+	c.Assert(w.Body.String(), Matches, "slow.*\tslow: 3\tdropped: 2\t.*\n")
+
+	// the client catches up. spilled messages are flushed in order.
+	close(mock.release)
+	time.Sleep(time.Millisecond * 10)
+	mux.FlushOfflineQueue()
+	time.Sleep(time.Millisecond * 10)
+	queued, _, spilled = mux.QueueStats()
+	c.Assert(queued, Equals, 0)
+	c.Assert(spilled, Equals, 0)
+
+	// spill: every message is kept.
+	_, mock, mux = setup("spill")
+	_, _, spilled = mux.QueueStats()
+	c.Assert(spilled, Equals, 3)
+	_, dropped, _ = mux.SlowStats()
+	c.Assert(dropped, Equals, 0)
+	close(mock.release)
+
+	// disconnect: the slow client is disconnected.
+	_, mock, mux = setup("disconnect")
+	c.Assert(mock.IsClosed(), Equals, true)
+	close(mock.release)
+}
+
+func (s *EngineSuite) TestShutdown(c *C) {
+	setupLogging()
+
+	engine := CreateEngine()
+	go engine.Run()
+
+	client := connect(engine, "persistent", false)
+	mux := client.Mux
+
+	sub := codec.NewSubscribeMessage()
+	sub.PacketIdentifier = 1
+	sub.Payload = []codec.SubscribePayload{{TopicPath: "/shutdown", RequestedQos: 1}, {TopicPath: "/gone", RequestedQos: 1}}
+	engine.Subscribe(sub, mux)
+	engine.Unsubscribe(2, 0, []codec.SubscribePayload{{TopicPath: "/gone"}}, mux)
+	engine.SendMessage("/shutdown", []byte("hello"), 1)
+	time.Sleep(time.Millisecond * 10)
+
+	// the client doesn't acknowledge the message.
+	c.Assert(engine.Shutdown(time.Millisecond*50), Equals, ErrShutdownTimeout)
+	c.Assert(engine.IsShuttingDown(), Equals, true)
+	c.Assert(client.Mock.IsClosed(), Equals, true)
+
+	// the session is restored with the unacknowledged message.
+	restored := CreateEngine()
+	restored.SessionStore = engine.SessionStore
+	restored.restoreSessions()
+
+	mux, err := restored.GetConnectionByClientId("persistent")
+	c.Assert(err, Equals, nil)
+	c.Assert(mux.CleanSession, Equals, false)
+	c.Assert(mux.GetSubscribedTopics()["/shutdown"].QoS, Equals, 1)
+	c.Assert(len(restored.Subscriptions.Match("/shutdown")), Equals, 1)
+	// unsubscribed filters aren't restored.
+	c.Assert(len(mux.GetSubscribedTopics()), Equals, 1)
+	c.Assert(len(restored.Subscriptions.Match("/gone")), Equals, 0)
+	c.Assert(len(mux.OfflineQueue), Equals, 1)
+	p := mux.OfflineQueue[0].(*codec.PublishMessage)
+	c.Assert(string(p.Payload), Equals, "hello")
+	c.Assert(p.Dupe, Equals, true)
+
+	// nothing to wait.
+	c.Assert(restored.Shutdown(time.Second), Equals, nil)
+}
+
+func (s *EngineSuite) TestDiskDatastore(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.Datastore = "disk"
+	config.Engine.DatastoreDir = c.MkDir()
+	config.Engine.DatastoreSync = "always"
+
+	engine, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	c.Assert(engine.DataStore.Name(), Equals, "diskstore")
+	for _, topic := range []string{"retained/a", "retained/b"} {
+		msg := codec.NewPublishMessage()
+		msg.TopicName = topic
+		msg.Payload = []byte("hello")
+		msg.Retain = 1
+		engine.SendPublishMessage(msg)
+	}
+	msg := codec.NewPublishMessage()
+	msg.TopicName = "retained/b"
+	msg.Retain = 1
+	engine.SendPublishMessage(msg)
+
+	mux := NewMmuxConnection()
+	mux.Identifier = "persistent"
+	mux.CleanSession = false
+	engine.SetConnectionByClientId("persistent", mux)
+	c.Assert(engine.Shutdown(time.Second), Equals, nil)
+
+	// retained messages and sessions survive the restart.
+	restarted, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	retained := restarted.RetainMatch("retained/#")
+	c.Assert(len(retained), Equals, 1)
+	c.Assert(retained[0].TopicName, Equals, "retained/a")
+	_, err = restarted.GetConnectionByClientId("persistent")
+	c.Assert(err, Equals, nil)
+	c.Assert(restarted.Shutdown(time.Second), Equals, nil)
+
+	config.Engine.Datastore = "leveldb"
+	_, err = NewMomonga(config)
+	c.Assert(err, ErrorMatches, `failed to open datastore: unknown datastore "leveldb"`)
+}
+
+func (s *EngineSuite) TestRetainedPrefix(c *C) {
+	setupLogging()
+
+	c.Assert(retainedPrefix("sport/tennis"), Equals, "sport/tennis")
+	c.Assert(retainedPrefix("sport/tennis/#"), Equals, "sport/tennis")
+	c.Assert(retainedPrefix("sport/+/player1"), Equals, "sport/")
+	c.Assert(retainedPrefix("+/tennis"), Equals, "")
+	c.Assert(retainedPrefix("#"), Equals, "")
+
+	engine := CreateEngine()
+	for _, topic := range []string{"sport", "sport/tennis", "sport/tennis/player1", "sportx", "$SYS/sport"} {
+		msg := codec.NewPublishMessage()
+		msg.TopicName = topic
+		msg.Payload = []byte(topic)
+		msg.Retain = 1
+		engine.SendPublishMessage(msg)
+	}
+
+	topics := func(messages []*codec.PublishMessage) []string {
+		result := []string{}
+		for _, m := range messages {
+			result = append(result, m.TopicName)
+		}
+		return result
+	}
+	c.Assert(topics(engine.RetainMatch("sport/#")), DeepEquals, []string{"sport", "sport/tennis", "sport/tennis/player1"})
+	c.Assert(topics(engine.RetainMatch("sport/+")), DeepEquals, []string{"sport/tennis"})
+	c.Assert(topics(engine.RetainMatch("sport")), DeepEquals, []string{"sport"})
+	c.Assert(topics(engine.RetainMatch("+/tennis")), DeepEquals, []string{"sport/tennis"})
+	c.Assert(topics(engine.RetainMatch("#")), DeepEquals, []string{"sport", "sport/tennis", "sport/tennis/player1", "sportx"})
+
+	count, err := engine.DeleteRetained("sport/#")
+	c.Assert(err, Equals, nil)
+	c.Assert(count, Equals, 3)
+	c.Assert(topics(engine.RetainMatch("#")), DeepEquals, []string{"sportx"})
+	c.Assert(len(engine.RetainMatch("$SYS/#")), Equals, 1)
+
+	count, err = engine.DeleteRetained("+")
+	c.Assert(err, Equals, nil)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *EngineSuite) TestRetainedImportExport(c *C) {
+	setupLogging()
+
+	engine := CreateEngine()
+	httpd := &MyHttpServer{Engine: engine}
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		httpd.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, topic := range []string{"site42/a", "site42/b/c", "site43/a", "$SYS/x"} {
+		msg := codec.NewPublishMessage()
+		msg.TopicName = topic
+		msg.Payload = []byte(topic)
+		msg.QosLevel = 1
+		msg.Retain = 1
+		engine.SendPublishMessage(msg)
+	}
+
+	// export
+	w := request("GET", "/retained?filter=site42/%23", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var exported []*RetainedMessage
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &exported), Equals, nil)
+	c.Assert(len(exported), Equals, 2)
+	c.Assert(exported[0].Topic, Equals, "site42/a")
+	c.Assert(string(exported[0].Payload), Equals, "site42/a")
+	c.Assert(exported[0].QoS, Equals, 1)
+	c.Assert(exported[0].Timestamp.IsZero(), Equals, false)
+	c.Assert(len(engine.RetainMatch("site42/#")), Equals, 2)
+
+	all, _ := engine.RetainedMessages("")
+	c.Assert(len(all), Equals, 4)
+	c.Assert(request("GET", "/retained?filter=a/%23/b", "").Code, Equals, http.StatusBadRequest)
+
+	// filter-scoped deletion
+	c.Assert(request("GET", "/retained/delete?filter=site42/%23", "").Code, Equals, http.StatusMethodNotAllowed)
+	w = request("POST", "/retained/delete?filter=site42/%23", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "2")
+	all, _ = engine.RetainedMessages("")
+	c.Assert(len(all), Equals, 2)
+	c.Assert(request("POST", "/retained/delete", "").Code, Equals, http.StatusBadRequest)
+
+	// import to another broker keeps timestamps
+	other := CreateEngine()
+	count, err := other.ImportRetained(exported)
+	c.Assert(err, Equals, nil)
+	c.Assert(count, Equals, 2)
+	imported, _ := other.RetainedMessages("#")
+	c.Assert(len(imported), Equals, 2)
+	c.Assert(imported[1].Topic, Equals, "site42/b/c")
+	c.Assert(imported[1].Timestamp.Equal(exported[1].Timestamp), Equals, true)
+
+	body, _ := json.Marshal(exported)
+	w = request("POST", "/retained/import", string(body))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "2")
+	all, _ = engine.RetainedMessages("")
+	c.Assert(len(all), Equals, 4)
+
+	// nothing is imported when a message is invalid.
+	w = request("POST", "/retained/import", `[{"topic":"ok","payload":"b2s="},{"topic":"a/+","payload":"b2s="}]`)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	all, _ = engine.RetainedMessages("ok")
+	c.Assert(len(all), Equals, 0)
+}
+
+func (s *EngineSuite) TestAuditLog(c *C) {
+	setupLogging()
+
+	dir := c.MkDir()
+	config := configuration.DefaultConfiguration()
+	config.Server.AuditLog = dir + "/audit.log"
+	config.Engine.QosLimits = []configuration.QosLimit{{Topic: "/secret/#", MaxQos: -1}}
+	engine, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	go engine.Run()
+
+	unsupported := func(msg *codec.ConnectMessage) {
+		msg.Version = 9
+	}
+	rejected := connect(engine, "audited", false, withUser("alice"), withWill("/will", "bye"), unsupported)
+	c.Assert(rejected.Mux, IsNil)
+	client1 := connect(engine, "audited", false, withUser("alice"), withWill("/will", "bye"))
+	sub := codec.NewSubscribeMessage()
+	sub.Payload = []codec.SubscribePayload{{TopicPath: "/secret/a", RequestedQos: 1}}
+	engine.Subscribe(sub, client1.Mux)
+	client2 := connect(engine, "audited", false, withUser("alice"), withWill("/will", "bye"))
+	engine.HandleConnection(client1.Conn)
+	// EOF publishes the will message.
+	engine.HandleConnection(client2.Conn)
+
+	f, err := os.Open(config.Server.AuditLog)
+	c.Assert(err, Equals, nil)
+	defer f.Close()
+
+	var events []*AuditEvent
+	decoder := json.NewDecoder(f)
+	for {
+		e := &AuditEvent{}
+		if err := decoder.Decode(e); err != nil {
+			c.Assert(err, Equals, io.EOF)
+			break
+		}
+		events = append(events, e)
+	}
+
+	var names []string
+	for _, e := range events {
+		names = append(names, e.Event+":"+e.Result)
+	}
+	c.Assert(names, DeepEquals, []string{
+		"connect:rejected",
+		"auth:allowed", "connect:accepted",
+		"acl_denied:",
+		"auth:allowed", "takeover:", "connect:accepted",
+		"disconnect:",
+		"will:", "disconnect:",
+	})
+
+	c.Assert(events[0].ProtocolVersion, Equals, 9)
+	c.Assert(events[2].ClientId, Equals, "audited")
+	c.Assert(events[2].UserName, Equals, "alice")
+	c.Assert(events[2].RemoteAddr, Equals, "debug")
+	c.Assert(*events[2].CleanSession, Equals, false)
+	c.Assert(events[3].Topic, Equals, "/secret/a")
+	c.Assert(events[7].Reason, Equals, "taken over")
+	c.Assert(events[8].Topic, Equals, "/will")
+	c.Assert(events[9].Reason, Equals, "connection closed by client")
+
+	// the broker doesn't run without the audit log.
+	config.Server.AuditLog = config.Server.AuditLog + "/audit.log"
+	_, err = NewMomonga(config)
+	c.Assert(err, ErrorMatches, "failed to open audit log .*")
+}
+
+func (s *EngineSuite) TestAuditLogRotation(c *C) {
+	path := c.MkDir() + "/audit.log"
+	audit, err := NewAuditLog(path, 200, 2)
+	c.Assert(err, Equals, nil)
+
+	for i := 0; i < 10; i++ {
+		c.Assert(audit.Write(&AuditEvent{Event: AUDIT_CONNECT, ClientId: fmt.Sprintf("client%d", i)}), Equals, nil)
+	}
+	audit.Close()
+	c.Assert(audit.Write(&AuditEvent{Event: AUDIT_CONNECT}), Equals, ErrAuditLogClosed)
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		st, err := os.Stat(name)
+		c.Assert(err, Equals, nil)
+		c.Assert(st.Size() <= 200, Equals, true)
+	}
+	_, err = os.Stat(path + ".3")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *EngineSuite) TestTenants(c *C) {
+	setupLogging()
+
+	one := 1
+	config := configuration.DefaultConfiguration()
+	config.Tenants = []configuration.Tenant{
+		{Name: "acme", Users: []string{"alice", "bob"}},
+		{Name: "globex", Mountpoint: "globex/", UserPrefix: "globex-", MaxConnections: 1, MaxQos: &one},
+	}
+	config.Engine.QosLimits = []configuration.QosLimit{{Topic: "secret/#", MaxQos: 0}}
+	config.Engine.RewriteRules = []configuration.RewriteRule{
+		{Regexp: "old/(.+)$", Replacement: "new/$1"},
+		{Regexp: "new/(.+)$", Replacement: "newer/$1"},
+	}
+	engine, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	go engine.Run()
+	defer engine.Terminate()
+
+	subscribe := func(mux *MmuxConnection, filter string, qos int) {
+		sub := codec.NewSubscribeMessage()
+		sub.PacketIdentifier = 1
+		sub.Payload = []codec.SubscribePayload{{TopicPath: filter, RequestedQos: uint8(qos)}}
+		engine.Subscribe(sub, mux)
+	}
+	publish := func(mux *MmuxConnection, topic string, retain int) {
+		msg := codec.NewPublishMessage()
+		msg.TopicName = topic
+		msg.Payload = []byte(topic)
+		msg.Retain = retain
+		NewHandler(mux, engine).Publish(msg)
+		time.Sleep(time.Millisecond * 10)
+	}
+	received := func(mock *MockConnection) []string {
+		time.Sleep(time.Millisecond * 10)
+		result := []string{}
+		for {
+			r, err := codec.ParseMessage(mock, 0)
+			if err != nil {
+				break
+			}
+			switch m := r.(type) {
+			case *codec.PublishMessage:
+				result = append(result, m.TopicName)
+			case *codec.ConnackMessage:
+				result = append(result, fmt.Sprintf("connack %d", m.ReturnCode))
+			}
+		}
+		return result
+	}
+
+	// the same client identifier in different namespaces doesn't collide.
+	acme := connect(engine, "device", true, withUser("alice"))
+	globex := connect(engine, "device", true, withUser("globex-1"))
+	global := connect(engine, "device", true)
+	acmeMux, globexMux, globalMux := acme.Mux, globex.Mux, global.Mux
+	c.Assert(acmeMux.Identifier, Equals, "$tenant/acme/device")
+	c.Assert(globexMux.Identifier, Equals, "globex/device")
+	c.Assert(globalMux.Identifier, Equals, "device")
+	c.Assert(received(acme.Mock), DeepEquals, []string{"connack 0"})
+	c.Assert(received(globex.Mock), DeepEquals, []string{"connack 0"})
+	c.Assert(received(global.Mock), DeepEquals, []string{"connack 0"})
+
+	subscribe(acmeMux, "#", 2)
+	subscribe(acmeMux, "$SYS/#", 0)
+	subscribe(globexMux, "#", 2)
+	subscribe(globalMux, "#", 2)
+	// max_qos of the tenant, and the qos_limit of secret/# which # overlaps.
+	subscribe(globexMux, "sensors/#", 2)
+	c.Assert(globexMux.GetSubscribedTopics()["sensors/#"].QoS, Equals, 1)
+	c.Assert(globexMux.GetSubscribedTopics()["#"].QoS, Equals, 0)
+
+	// wildcards don't reach other namespaces.
+	publish(acmeMux, "sensors/1", 0)
+	publish(globexMux, "sensors/2", 0)
+	publish(globalMux, "sensors/3", 0)
+	c.Assert(received(acme.Mock), DeepEquals, []string{"sensors/1"})
+	c.Assert(received(globex.Mock), DeepEquals, []string{"sensors/2"})
+	c.Assert(received(global.Mock), DeepEquals, []string{"sensors/3"})
+
+	// clients of the default namespace don't reach tenants either.
+	publish(globalMux, "globex/injected", 0)
+	publish(globalMux, "$tenant/acme/injected", 0)
+	c.Assert(received(acme.Mock), DeepEquals, []string{})
+	c.Assert(received(globex.Mock), DeepEquals, []string{})
+	c.Assert(received(global.Mock), DeepEquals, []string{})
+	subscribe(globalMux, "globex/#", 0)
+	subscribe(globalMux, "$tenant/acme/#", 0)
+	c.Assert(len(globalMux.GetSubscribedTopics()), Equals, 1)
+
+	// retained messages are stored in the namespace.
+	publish(acmeMux, "status", 1)
+	publish(globexMux, "status", 1)
+	received(acme.Mock)
+	received(globex.Mock)
+	c.Assert(received(global.Mock), DeepEquals, []string{})
+	retained, _ := engine.RetainedMessages("")
+	c.Assert(retained[0].Topic, Equals, "$tenant/acme/status")
+	c.Assert(retained[1].Topic, Equals, "globex/status")
+	subscribe(acmeMux, "status", 0)
+	subscribe(globexMux, "+", 0)
+	subscribe(globalMux, "+", 0)
+	subscribe(globalMux, "+/status", 0)
+	c.Assert(received(acme.Mock), DeepEquals, []string{"status"})
+	c.Assert(received(globex.Mock), DeepEquals, []string{"status"})
+	c.Assert(received(global.Mock), DeepEquals, []string{})
+
+	// each tenant has its own $SYS.
+	engine.SendMessage("$SYS/broker/uptime", []byte("1"), 0)
+	engine.SendMessage("$tenant/acme/$SYS/broker/uptime", []byte("1"), 0)
+	c.Assert(received(acme.Mock), DeepEquals, []string{"$SYS/broker/uptime"})
+	c.Assert(received(global.Mock), DeepEquals, []string{})
+
+	bobMux := connect(engine, "second", true, withUser("bob")).Mux
+	c.Assert(bobMux.Tenant.Name, Equals, "acme")
+	event := newClientEvent(bobMux, bobMux.PrimaryConnection)
+	c.Assert(event.ClientId, Equals, "second")
+	c.Assert(event.mountpoint, Equals, "$tenant/acme/")
+
+	// limits and reserved identifiers
+	other := connect(engine, "other", true, withUser("globex-2"))
+	c.Assert(received(other.Mock), DeepEquals, []string{"connack 3"})
+	c.Assert(connect(engine, "device", true, withUser("globex-1")).Mux, NotNil)
+	reserved := connect(engine, "$tenant/acme/device", true)
+	c.Assert(received(reserved.Mock), DeepEquals, []string{"connack 2"})
+	c.Assert(len(engine.ListSessions(SessionFilter{Tenant: "acme"})), Equals, 2)
+
+	// rules are applied to client-visible topics, once. administrators see every tenant.
+	admin := connect(engine, "admin", true)
+	admin.Mux.Admin = true
+	subscribe(admin.Mux, "$tenant/acme/#", 0)
+	received(admin.Mock)
+	publish(acmeMux, "old/1", 0)
+	c.Assert(received(admin.Mock), DeepEquals, []string{"$tenant/acme/new/1"})
+	subscribe(acmeMux, "secret/#", 2)
+	c.Assert(acmeMux.GetSubscribedTopics()["secret/#"].QoS, Equals, 0)
+}
+
+func (s *EngineSuite) TestInflightWindow(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.MaxInflightMessages = 2
+	engine, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	go engine.Run()
+	defer engine.Terminate()
+
+	client := connect(engine, "constrained", true)
+	mock, conn, mux := client.Mock, client.Conn, client.Mux
+
+	sub := codec.NewSubscribeMessage()
+	sub.PacketIdentifier = 1
+	sub.Payload = []codec.SubscribePayload{{TopicPath: "a", RequestedQos: 1}}
+	engine.Subscribe(sub, mux)
+
+	received := func() []uint16 {
+		time.Sleep(time.Millisecond * 20)
+		ids := []uint16{}
+		for {
+			r, err := codec.ParseMessage(mock, 0)
+			if err != nil {
+				break
+			}
+			if p, ok := r.(*codec.PublishMessage); ok {
+				ids = append(ids, p.PacketIdentifier)
+			}
+		}
+		return ids
+	}
+	puback := func(id uint16) {
+		conn.Events["puback"].(func(uint16))(id)
+	}
+
+	for i := 0; i < 5; i++ {
+		engine.SendMessage("a", []byte{byte(i)}, 1)
+	}
+	// QoS 0 messages wait behind as well, so that the order is kept.
+	engine.SendMessage("a", []byte("qos0"), 0)
+
+	ids := received()
+	c.Assert(len(ids), Equals, 2)
+	c.Assert(conn.InflightMessages(), Equals, 2)
+	_, _, waiting := mux.QueueStats()
+	c.Assert(waiting, Equals, 4)
+
+	// each acknowledgement releases one message.
+	puback(ids[0])
+	c.Assert(len(received()), Equals, 1)
+	puback(ids[1])
+	puback(12345)
+	c.Assert(len(received()), Equals, 1)
+	c.Assert(conn.InflightMessages(), Equals, 2)
+
+	puback(3)
+	puback(4)
+	c.Assert(received(), DeepEquals, []uint16{5, 0})
+	c.Assert(mux.IsDrained(), Equals, false)
+	puback(5)
+	c.Assert(mux.IsDrained(), Equals, true)
+
+	// retained messages are sent with QoS 0 when every packet identifier of the session is in use.
+	for i := 0; i < 65535; i++ {
+		mux.GetOutGoingTable().Add(codec.NewPublishMessage(), 1, nil)
+	}
+	retained := codec.NewPublishMessage()
+	retained.TopicName = "r"
+	retained.Payload = []byte("r")
+	retained.QosLevel = 1
+	retained.Retain = 1
+	engine.SendPublishMessage(retained)
+	sub.Payload = []codec.SubscribePayload{{TopicPath: "r", RequestedQos: 1}}
+	engine.Subscribe(sub, mux)
+	time.Sleep(time.Millisecond * 20)
+	var r *codec.PublishMessage
+	for {
+		m, err := codec.ParseMessage(mock, 0)
+		if err != nil {
+			break
+		}
+		if p, ok := m.(*codec.PublishMessage); ok {
+			r = p
+		}
+	}
+	c.Assert(r, NotNil)
+	c.Assert(r.TopicName, Equals, "r")
+	c.Assert(r.QosLevel, Equals, 0)
+	c.Assert(r.PacketIdentifier, Equals, uint16(0))
+
+	// copies of a published message take packet identifiers of the subscriber only.
+	publisher := connect(engine, "publisher", true)
+	p := codec.NewPublishMessage()
+	p.TopicName = "a"
+	p.Payload = []byte("p")
+	p.QosLevel = 1
+	p.PacketIdentifier = 7
+	publisher.Handler.Publish(p)
+	time.Sleep(time.Millisecond * 20)
+	c.Assert(engine.OutGoingTable.Len(), Equals, 0)
+}
+
+func (s *EngineSuite) TestKeepaliveReaper(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.MaxKeepalive = 10
+	engine, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	go engine.Run()
+	defer engine.Terminate()
+
+	// keepalive 0 doesn't bypass max_keepalive.
+	sleepy := connect(engine, "sleepy", true, withKeepalive(0), withWill("will/sleepy", "gone")).Conn
+	c.Assert(sleepy.Keepalive, Equals, 10)
+
+	// the watcher connects later, so it isn't idle yet.
+	time.Sleep(time.Millisecond * 50)
+	watcher := connect(engine, "watcher", true)
+	sub := codec.NewSubscribeMessage()
+	sub.PacketIdentifier = 1
+	sub.Payload = []codec.SubscribePayload{{TopicPath: "will/#", RequestedQos: 0}}
+	engine.Subscribe(sub, watcher.Mux)
+
+	last := sleepy.LastReceived()
+	engine.reapIdleConnections(last.Add(time.Second * 15))
+	_, err = engine.GetConnectionByClientId("sleepy")
+	c.Assert(err, IsNil)
+
+	engine.reapIdleConnections(last.Add(time.Second*15 + time.Millisecond*10))
+	c.Assert(sleepy.DisconnectReason, Equals, "keepalive timeout")
+	_, err = engine.GetConnectionByClientId("sleepy")
+	c.Assert(err, NotNil)
+	_, err = engine.GetConnectionByClientId("watcher")
+	c.Assert(err, IsNil)
+
+	time.Sleep(time.Millisecond * 20)
+	wills := []string{}
+	for {
+		r, err := codec.ParseMessage(watcher.Mock, 0)
+		if err != nil {
+			break
+		}
+		if p, ok := r.(*codec.PublishMessage); ok {
+			wills = append(wills, p.TopicName+" "+string(p.Payload))
+		}
+	}
+	c.Assert(wills, DeepEquals, []string{"will/sleepy gone"})
+
+	config.Engine.KeepaliveOverride = 30
+	c.Assert(engine.keepalive(5), Equals, 10)
+	config.Engine.MaxKeepalive = 0
+	c.Assert(engine.keepalive(5), Equals, 30)
+	config.Engine.KeepaliveOverride = 0
+	c.Assert(engine.keepalive(0), Equals, 0)
+}
+
+func (s *EngineSuite) TestSessionExpiry(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.SessionExpiry = 60
+	engine, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	go engine.Run()
+	defer engine.Terminate()
+
+	subscribe := func(id string) *MmuxConnection {
+		mux := connect(engine, id, false).Mux
+		sub := codec.NewSubscribeMessage()
+		sub.PacketIdentifier = 1
+		sub.Payload = []codec.SubscribePayload{{TopicPath: "devices/" + id, RequestedQos: 1}}
+		engine.Subscribe(sub, mux)
+		return mux
+	}
+
+	subscribe("abandoned")
+	subscribe("connected")
+	persistent := subscribe("persistent")
+	persistent.SessionExpiry = time.Hour
+	c.Assert(engine.Kick("abandoned", true), IsNil)
+	c.Assert(engine.Kick("persistent", true), IsNil)
+
+	now := time.Now()
+	c.Assert(engine.expireSessions(now), Equals, 0)
+	c.Assert(engine.expireSessions(now.Add(time.Second*61)), Equals, 1)
+
+	_, err = engine.GetConnectionByClientId("abandoned")
+	c.Assert(err, NotNil)
+	c.Assert(engine.Subscriptions.Match("devices/abandoned"), HasLen, 0)
+	c.Assert(engine.System.Broker.Clients.Expired, Equals, int64(1))
+
+	// connected sessions never expire.
+	_, err = engine.GetConnectionByClientId("connected")
+	c.Assert(err, IsNil)
+	c.Assert(engine.Subscriptions.Match("devices/persistent"), HasLen, 1)
+
+	c.Assert(engine.expireSessions(now.Add(time.Hour+time.Second)), Equals, 1)
+	_, err = engine.GetConnectionByClientId("persistent")
+	c.Assert(err, NotNil)
+	c.Assert(engine.System.Broker.Clients.Expired, Equals, int64(2))
+}
+
+func (s *EngineSuite) TestClearSubscriptions(c *C) {
+	setupLogging()
+
+	engine := CreateEngine()
+	go engine.Run()
+	defer engine.Terminate()
+
+	mux := connect(engine, "cleared", true).Mux
+	sub := codec.NewSubscribeMessage()
+	sub.PacketIdentifier = 1
+	sub.Payload = []codec.SubscribePayload{{TopicPath: "a/#", RequestedQos: 0}, {TopicPath: "b", RequestedQos: 1}}
+	engine.Subscribe(sub, mux)
+	c.Assert(engine.Subscriptions.Count(), Equals, 2)
+
+	httpd := &MyHttpServer{Engine: engine}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/debug/qlobber/clear", nil)
+	httpd.ServeHTTP(w, req)
+	c.Assert(w.Body.String(), Equals, "cleared")
+	c.Assert(engine.Subscriptions.Count(), Equals, 0)
+	c.Assert(len(mux.GetSubscribedTopics()), Equals, 0)
+
+	// the session can subscribe again.
+	engine.Subscribe(sub, mux)
+	c.Assert(len(engine.Subscriptions.Match("a/1")), Equals, 1)
+	engine.Unsubscribe(2, 0, []codec.SubscribePayload{{TopicPath: "a/#"}}, mux)
+	c.Assert(len(engine.Subscriptions.Match("a/1")), Equals, 0)
+}
+
+func (s *EngineSuite) TestSessionRegistry(c *C) {
+	registry := NewSessionRegistry(4)
+
+	a := NewMmuxConnection()
+	b := NewMmuxConnection()
+	c.Assert(registry.Swap("a", a), IsNil)
+	// a session can be registered under two keys. see registerSession
+	c.Assert(registry.Swap("a:1", a), IsNil)
+	c.Assert(registry.Len(), Equals, 1)
+
+	c.Assert(registry.Swap("a", b), Equals, a)
+	c.Assert(registry.Len(), Equals, 2)
+	c.Assert(registry.CompareAndDelete("a", a), Equals, false)
+	mux, ok := registry.Get("a")
+	c.Assert(ok, Equals, true)
+	c.Assert(mux, Equals, b)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprintf("client-%d-%d", i, j)
+				registry.Swap(id, NewMmuxConnection())
+				registry.Snapshot()
+				registry.Delete(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.Assert(registry.Snapshot(), HasLen, 2)
+	c.Assert(registry.CompareAndDelete("a", b), Equals, true)
+	registry.Delete("a:1")
+	c.Assert(registry.Len(), Equals, 0)
+}
+
+func (s *EngineSuite) TestOrderedDelivery(c *C) {
+	setupLogging()
+
+	config := configuration.DefaultConfiguration()
+	config.Engine.FanoutWorkerCount = "4"
+	engine, err := NewMomonga(config)
+	c.Assert(err, Equals, nil)
+	go engine.Run()
+	defer engine.Terminate()
+
+	var mocks []*MockConnection
+	for i := 0; i < 4; i++ {
+		client := connect(engine, fmt.Sprintf("subscriber%d", i), true)
+		sub := codec.NewSubscribeMessage()
+		sub.PacketIdentifier = 1
+		sub.Payload = []codec.SubscribePayload{{TopicPath: "ordered/#", RequestedQos: 0}}
+		engine.Subscribe(sub, client.Mux)
+		mocks = append(mocks, client.Mock)
+	}
+	publisher := connect(engine, "publisher", true).Handler
+
+	for i := 0; i < 200; i++ {
+		msg := codec.NewPublishMessage()
+		msg.TopicName = fmt.Sprintf("ordered/%d", i%3)
+		msg.Payload = []byte(fmt.Sprintf("%d", i))
+		publisher.Publish(msg)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	for _, mock := range mocks {
+		received := 0
+		for {
+			r, err := codec.ParseMessage(mock, 0)
+			if err != nil {
+				break
+			}
+			if p, ok := r.(*codec.PublishMessage); ok {
+				c.Assert(string(p.Payload), Equals, fmt.Sprintf("%d", received))
+				received++
+			}
+		}
+		c.Assert(received, Equals, 200)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	. "github.com/chobie/momonga/common"
 	codec "github.com/chobie/momonga/encoding/mqtt"
 	log "github.com/chobie/momonga/logger"
+	"sync/atomic"
 )
 
 // Handler dispatches messages which sent by client.
@@ -43,10 +44,11 @@ func NewHandler(conn Connection, engine *Momonga) *Handler {
 		cn.On("pingreq", hndr.Pingreq, true)
 
 		// Defaultの動作で大丈夫なもの(念のため)
-		cn.On("puback", hndr.Puback, true)
+		// puback and pubcomp release the inflight window of the connection first.
+		cn.On("puback", hndr.Puback, false)
 		cn.On("pubrec", hndr.Pubrec, true)
 		cn.On("pubrel", hndr.Pubrel, true)
-		cn.On("pubcomp", hndr.Pubcomp, true)
+		cn.On("pubcomp", hndr.Pubcomp, false)
 	}
 
 	return hndr
@@ -58,15 +60,22 @@ func (self *Handler) Close() {
 }
 
 func (self *Handler) Parsed() {
-	self.Engine.System.Broker.Messages.Received++
+	atomic.AddInt64(&self.Engine.System.Broker.Messages.Received, 1)
 }
 
 func (self *Handler) Pubcomp(messageId uint16) {
 	//pubcompを受け取る、ということはserverがsender
 	log.Debug("Received Pubcomp Message from %s", self.Connection.GetId())
 
-	self.Engine.OutGoingTable.Unref(messageId)
 	self.Connection.GetOutGoingTable().Unref(messageId)
+	self.releaseInflight()
+}
+
+// releaseInflight sends messages waiting for the inflight window.
+func (self *Handler) releaseInflight() {
+	if mux, ok := self.Connection.(*MmuxConnection); ok {
+		mux.FlushOfflineQueue()
+	}
 }
 
 func (self *Handler) Pubrel(messageId uint16) {
@@ -87,20 +96,18 @@ func (self *Handler) Pubrec(messageId uint16) {
 func (self *Handler) Puback(messageId uint16) {
 	log.Debug("Received Puback Message from [%s: %d]", self.Connection.GetId(), messageId)
 
-	if tbl, ok := self.Engine.InflightTable[self.Connection.GetId()]; ok {
+	if tbl := self.Engine.inflightTable(self.Connection.GetId(), false); tbl != nil {
 		p, _ := tbl.Get(messageId)
 		if msg, ok := p.(*codec.PublishMessage); ok {
 			// TODO: やっぱclose済みのチャンネルにおくっちゃうよねー
 			msg.Opaque.(chan string) <- self.Connection.GetId()
 		}
-		if t, ok := self.Engine.InflightTable[self.Connection.GetId()]; ok {
-			t.Unref(messageId)
-		}
+		tbl.Unref(messageId)
 	}
 
 	// TODO: これのIDは内部的なの？
-	self.Engine.OutGoingTable.Unref(messageId)
 	self.Connection.GetOutGoingTable().Unref(messageId)
+	self.releaseInflight()
 }
 
 func (self *Handler) Unsubscribe(messageId uint16, granted int, payloads []codec.SubscribePayload) {
@@ -114,7 +121,7 @@ func (self *Handler) Disconnect() {
 		cn.Disconnect()
 	}
 
-	self.Engine.System.Broker.Clients.Connected--
+	atomic.AddInt64(&self.Engine.System.Broker.Clients.Connected, -1)
 	//return &DisconnectError{}
 }
 
@@ -127,6 +134,19 @@ func (self *Handler) Publish(p *codec.PublishMessage) {
 	//log.Info("Received Publish Message: %s: %+v", p.PacketIdentifier, p)
 	conn := self.Connection
 
+	if self.Engine.IsShuttingDown() {
+		// don't acknowledge. the client will send QoS 1, 2 messages again after reconnecting.
+		log.Debug("discard publish message while shutting down. [%s: %s]", conn.GetId(), p.TopicName)
+		return
+	}
+
+	denied := false
+	if mux, ok := conn.(*MmuxConnection); ok {
+		// clients of the default namespace don't reach tenants.
+		denied = mux.Tenant == nil && !mux.Admin && self.Engine.tenantOf(p.TopicName) != nil
+		p.TopicName = self.Engine.inboundTopic(mux.Tenant, p.TopicName)
+	}
+
 	if p.QosLevel == 1 {
 		ack := codec.NewPubackMessage()
 		ack.PacketIdentifier = p.PacketIdentifier
@@ -139,6 +159,20 @@ func (self *Handler) Publish(p *codec.PublishMessage) {
 		log.Debug("Send pubrec message to sender. [%s: %d]", conn.GetId(), ack.PacketIdentifier)
 	}
 
+	if denied {
+		// acknowledged above, so that the client doesn't send it again.
+		log.Info("publish refused. [%s:%s]", conn.GetId(), p.TopicName)
+		qos := p.QosLevel
+		self.Engine.audit(&AuditEvent{
+			Event:    AUDIT_ACL_DENIED,
+			ClientId: conn.GetId(),
+			Topic:    p.TopicName,
+			QoS:      &qos,
+			Reason:   "publish",
+		})
+		return
+	}
+
 	// TODO: QoSによっては適切なMessageIDを追加する
 	// Server / ClientはそれぞれMessageTableが違う
 	if p.QosLevel > 0 {
@@ -150,7 +184,8 @@ func (self *Handler) Publish(p *codec.PublishMessage) {
 		p.Opaque = conn
 	}
 
-	go self.Engine.SendPublishMessage(p)
+	// this runs on the read loop of the connection, so messages of a publisher are processed in order.
+	self.Engine.SendPublishMessage(p)
 }
 
 func (self *Handler) Subscribe(p *codec.SubscribeMessage) {
@@ -5,25 +5,22 @@ package server
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"encoding/json"
 	"expvar"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	. "github.com/chobie/momonga/common"
-	"github.com/chobie/momonga/util"
+	"github.com/chobie/momonga/datastore"
 	"io"
 	"io/ioutil"
 	"net/http"
 	httpprof "net/http/pprof"
 	"net/url"
-	"runtime"
 	"strconv"
+	"time"
 	//log "github.com/chobie/momonga/logger"
 )
 
-func init() {
-	runtime.SetBlockProfileRate(1)
-}
-
 type MyHttpServer struct {
 	Engine         *Momonga
 	WebSocketMount string
@@ -81,29 +78,31 @@ func (self *MyHttpServer) debugRouter(w http.ResponseWriter, req *http.Request)
 			fmt.Fprintf(w, "<div>key: %s</div>", k)
 		}
 	case "/debug/retain/clear":
-		itr := self.Engine.DataStore.Iterator()
-		var targets []string
-		for ; itr.Valid(); itr.Next() {
-			x := itr.Key()
-			targets = append(targets, string(x))
-		}
-		for _, s := range targets {
-			self.Engine.DataStore.Del([]byte(s), []byte(s))
+		if req.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return nil
 		}
+		datastore.DelPrefix(self.Engine.DataStore, nil)
 		fmt.Fprintf(w, "<textarea>%#v</textarea>", self.Engine.DataStore)
 	case "/debug/connections":
-		for _, v := range self.Engine.Connections {
+		for _, v := range self.Engine.Sessions() {
 			fmt.Fprintf(w, "<div>%#v</div>", v)
 		}
-	case "/debug/connections/clear":
-		self.Engine.Connections = make(map[string]*MmuxConnection)
-		fmt.Fprintf(w, "cleared")
+	case "/debug/slow_consumers":
+		for _, v := range self.Engine.Sessions() {
+			slow, dropped, last := v.SlowStats()
+			if slow == 0 {
+				continue
+			}
+			queued, size, spilled := v.QueueStats()
+			fmt.Fprintf(w, "%s\tslow: %d\tdropped: %d\tqueued: %d (%d bytes)\tspilled: %d\tlast: %s\n",
+				v.GetId(), slow, dropped, queued, size, spilled, last.Format(time.RFC3339))
+		}
 	case "/debug/qlobber/clear":
-		self.Engine.Qlobber = util.NewQlobber()
+		self.Engine.ClearSubscriptions()
 		fmt.Fprintf(w, "cleared")
 	case "/debug/qlobber/dump":
-		fmt.Fprintf(w, "qlobber:\n")
-		self.Engine.Qlobber.Dump(w)
+		self.Engine.Subscriptions.Dump(w)
 	case "/debug/config/dump":
 		e := toml.NewEncoder(w)
 		e.Encode(self.Engine.Config())
@@ -147,6 +146,120 @@ func (self *MyHttpServer) apiRouter(w http.ResponseWriter, req *http.Request) er
 		self.Engine.SendMessage(topic, []byte(body), int(rqos))
 		w.Write([]byte(fmt.Sprintf("OK")))
 		return nil
+	case "/delayed":
+		type delayed struct {
+			Id        string    `json:"id"`
+			DeliverAt time.Time `json:"deliver_at"`
+			Topic     string    `json:"topic"`
+			QoS       int       `json:"qos"`
+			Retain    bool      `json:"retain"`
+			Payload   []byte    `json:"payload"`
+		}
+
+		result := []delayed{}
+		for _, m := range self.Engine.DelayedMessages() {
+			result = append(result, delayed{
+				Id:        m.Id,
+				DeliverAt: m.DeliverAt,
+				Topic:     m.Message.TopicName,
+				QoS:       m.Message.QosLevel,
+				Retain:    m.Message.Retain > 0,
+				Payload:   m.Message.Payload,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(result)
+	case "/delayed/cancel":
+		if req.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return nil
+		}
+
+		id := req.URL.Query().Get("id")
+		if err := self.Engine.CancelDelayed(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil
+		}
+		w.Write([]byte("OK"))
+	case "/retained":
+		// export
+		messages, err := self.Engine.RetainedMessages(req.URL.Query().Get("filter"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(messages)
+	case "/retained/import":
+		if req.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return nil
+		}
+
+		var messages []*RetainedMessage
+		if err := json.NewDecoder(req.Body).Decode(&messages); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		count, err := self.Engine.ImportRetained(messages)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		fmt.Fprintf(w, "%d", count)
+	case "/retained/delete":
+		if req.Method != "POST" && req.Method != "DELETE" {
+			http.Error(w, "POST or DELETE required", http.StatusMethodNotAllowed)
+			return nil
+		}
+
+		count, err := self.Engine.DeleteRetained(req.URL.Query().Get("filter"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		fmt.Fprintf(w, "%d", count)
+	case "/sessions":
+		query := req.URL.Query()
+		sessions := self.Engine.ListSessions(SessionFilter{
+			ClientId: query.Get("client_id"),
+			UserName: query.Get("username"),
+			Tenant:   query.Get("tenant"),
+			State:    query.Get("state"),
+		})
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(sessions)
+	case "/sessions/show":
+		info, err := self.Engine.SessionDetails(req.URL.Query().Get("client_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(info)
+	case "/sessions/kick", "/sessions/delete":
+		if req.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return nil
+		}
+
+		var err error
+		query := req.URL.Query()
+		if req.URL.Path == "/sessions/kick" {
+			suppressWill, _ := strconv.ParseBool(query.Get("suppress_will"))
+			err = self.Engine.Kick(query.Get("client_id"), suppressWill)
+		} else {
+			err = self.Engine.DeleteSession(query.Get("client_id"))
+		}
+
+		switch err {
+		case nil:
+			w.Write([]byte("OK"))
+		case ErrSessionNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusConflict)
+		}
 	case "/stats":
 		return nil
 	case self.WebSocketMount:
@@ -157,6 +270,7 @@ func (self *MyHttpServer) apiRouter(w http.ResponseWriter, req *http.Request) er
 			conn := NewMyConnection()
 			conn.SetMyConnection(ws)
 			conn.SetId(ws.RemoteAddr().String())
+			conn.Listener = "websocket"
 			self.Engine.HandleConnection(conn)
 		}).ServeHTTP(w, req)
 	default:
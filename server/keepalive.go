@@ -0,0 +1,81 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	. "github.com/chobie/momonga/common"
+	log "github.com/chobie/momonga/logger"
+	"time"
+)
+
+// keepalive returns the keepalive (seconds) the server enforces for a client which requested requested.
+// NOTE: MQTT 3.1.1 can't tell the client, it has to ping often enough by itself.
+func (self *Momonga) keepalive(requested int) int {
+	keepalive := requested
+	if self.config.Engine.KeepaliveOverride > 0 {
+		keepalive = self.config.Engine.KeepaliveOverride
+	}
+	// 0 disables the keepalive mechanism, the maximum applies to it too.
+	if max := self.config.Engine.MaxKeepalive; max > 0 && (keepalive == 0 || keepalive > max) {
+		keepalive = max
+	}
+	return keepalive
+}
+
+// reapIdleConnections closes connections which have been idle for longer than their keepalive.
+// read deadlines only work for net.Conn, this works for every transport.
+func (self *Momonga) reapIdleConnections(now time.Time) {
+	for _, mux := range self.Sessions() {
+		var idle []*MyConnection
+
+		mux.Mutex.RLock()
+		for _, cn := range mux.Connections {
+			c, ok := cn.(*MyConnection)
+			if !ok || c.Keepalive <= 0 {
+				continue
+			}
+			// [MQTT-3.1.2-24] If the Keep Alive value is non-zero and the Server does not receive a Control Packet
+			// from the Client within one and a half times the Keep Alive time period, it MUST disconnect
+			// the Network Connection to the Client as if the network had failed.
+			if now.Sub(c.LastReceived()) > time.Duration(c.Keepalive)*time.Second*3/2 {
+				idle = append(idle, c)
+			}
+		}
+		mux.Mutex.RUnlock()
+
+		for _, c := range idle {
+			self.reapConnection(mux, c)
+		}
+	}
+}
+
+func (self *Momonga) reapConnection(mux *MmuxConnection, conn *MyConnection) {
+	lock := self.getSessionLock(mux.Identifier)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !mux.Detach(conn) {
+		// taken over or closed in the meantime.
+		return
+	}
+	log.Info("keepalive timeout: %s (keepalive: %d)", mux.Identifier, conn.Keepalive)
+
+	// the network failed, so the will message is published.
+	if conn.HasWillMessage() {
+		self.SendWillMessage(conn)
+	}
+	disconnected := newClientEvent(mux, conn)
+	disconnected.Reason = "keepalive timeout"
+	self.publishClientEvent("disconnected", disconnected)
+
+	if mux.ShouldClearSession() {
+		self.discardSession(mux)
+	} else {
+		self.keepOfflineSession(mux)
+	}
+
+	// the disconnect path of detached connections doesn't touch the session.
+	closeConnection(conn, disconnected.Reason)
+}
@@ -0,0 +1,205 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+package server
+
+import (
+	. "github.com/chobie/momonga/common"
+	"github.com/chobie/momonga/encoding/mqtt"
+	log "github.com/chobie/momonga/logger"
+	"github.com/chobie/momonga/util"
+	"sync"
+)
+
+// LocalConnection delivers PUBLISH messages to a Go callback without a socket.
+// The callback runs on its own goroutine, so a slow callback doesn't block fan-out workers
+// (it is treated as a slow consumer instead).
+type LocalConnection struct {
+	Identity string
+	callback func(*mqtt.PublishMessage)
+	engine   *Momonga
+	queue    chan *mqtt.PublishMessage
+	stop     chan bool
+	// guarded by mutex.
+	state State
+	mutex sync.RWMutex
+	// the OutGoingTable of the session. retained messages reserve their packet identifiers there.
+	table *util.MessageTable
+	guid  util.Guid
+	once  sync.Once
+}
+
+func NewLocalConnection(engine *Momonga, id string, callback func(*mqtt.PublishMessage)) *LocalConnection {
+	c := &LocalConnection{
+		Identity: id,
+		callback: callback,
+		engine:   engine,
+		queue:    make(chan *mqtt.PublishMessage, 1024),
+		stop:     make(chan bool),
+		state:    STATE_CONNECTED,
+	}
+
+	go c.run()
+	return c
+}
+
+func (self *LocalConnection) run() {
+	for {
+		select {
+		case <-self.stop:
+			return
+		case p := <-self.queue:
+			// prefer stop when both are ready
+			select {
+			case <-self.stop:
+				return
+			default:
+			}
+			self.callback(p)
+		}
+	}
+}
+
+func (self *LocalConnection) accept(request mqtt.Message) (*mqtt.PublishMessage, bool) {
+	p, ok := request.(*mqtt.PublishMessage)
+	if !ok {
+		return nil, false
+	}
+
+	// there is nobody to send PUBACK / PUBREC. acknowledge it here (see DummyPlug)
+	if p.QosLevel > 0 {
+		release(self.table, p)
+	}
+	return p, true
+}
+
+// release unrefs the packet identifier of p when it is registered for p in table.
+// the same identifier may belong to another message in another table.
+func release(table *util.MessageTable, p *mqtt.PublishMessage) {
+	if table == nil {
+		return
+	}
+	if m, err := table.Get(p.PacketIdentifier); err == nil && m == mqtt.Message(p) {
+		table.Unref(p.PacketIdentifier)
+	}
+}
+
+func (self *LocalConnection) WriteMessageQueue(request mqtt.Message) {
+	if p, ok := self.accept(request); ok {
+		select {
+		case self.queue <- p:
+		case <-self.stop:
+		}
+	}
+}
+
+func (self *LocalConnection) TryWriteMessageQueue(request mqtt.Message) error {
+	if _, ok := request.(*mqtt.PublishMessage); !ok {
+		return nil
+	}
+	if len(self.queue) >= cap(self.queue) {
+		return ErrQueueFull
+	}
+
+	p, _ := self.accept(request)
+	select {
+	case self.queue <- p:
+		return nil
+	default:
+		log.Debug("local connection %s is busy", self.Identity)
+		return ErrQueueFull
+	}
+}
+
+func (self *LocalConnection) WriteMessageQueue2(msg []byte) {
+}
+
+func (self *LocalConnection) Close() error {
+	self.once.Do(func() {
+		self.SetState(STATE_CLOSED)
+		close(self.stop)
+	})
+	return nil
+}
+
+func (self *LocalConnection) SetState(state State) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.state = state
+}
+
+func (self *LocalConnection) GetState() State {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return self.state
+}
+
+func (self *LocalConnection) ResetState() {
+}
+
+func (self *LocalConnection) ReadMessage() (mqtt.Message, error) {
+	return nil, nil
+}
+
+func (self *LocalConnection) IsAlived() bool {
+	return self.GetState() != STATE_CLOSED
+}
+
+func (self *LocalConnection) SetWillMessage(mqtt.WillMessage) {
+}
+
+func (self *LocalConnection) GetWillMessage() *mqtt.WillMessage {
+	return nil
+}
+
+func (self *LocalConnection) HasWillMessage() bool {
+	return false
+}
+
+func (self *LocalConnection) GetOutGoingTable() *util.MessageTable {
+	return nil
+}
+
+func (self *LocalConnection) GetSubscribedTopics() map[string]*SubscribeSet {
+	panic("deprecated")
+}
+
+func (self *LocalConnection) AppendSubscribedTopic(string, *SubscribeSet) {
+	panic("deprecated")
+}
+
+func (self *LocalConnection) RemoveSubscribedTopic(string) {
+	panic("deprecated")
+}
+
+func (self *LocalConnection) SetKeepaliveInterval(int) {
+}
+
+func (self *LocalConnection) GetId() string {
+	return self.Identity
+}
+
+func (self *LocalConnection) GetRealId() string {
+	return self.Identity
+}
+
+func (self *LocalConnection) SetId(id string) {
+	self.Identity = id
+}
+
+func (self *LocalConnection) DisableClearSession() {
+}
+
+func (self *LocalConnection) ShouldClearSession() bool {
+	return true
+}
+
+func (self *LocalConnection) GetGuid() util.Guid {
+	return self.guid
+}
+
+func (self *LocalConnection) SetGuid(id util.Guid) {
+	self.guid = id
+}
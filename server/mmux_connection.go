@@ -12,6 +12,7 @@ import (
 	. "github.com/chobie/momonga/flags"
 	log "github.com/chobie/momonga/logger"
 	"github.com/chobie/momonga/util"
+	"sort"
 	"sync"
 	"time"
 )
@@ -25,12 +26,14 @@ import (
 // 下のコネクションとかは純粋に接続周りだけにしておきたいんだけどなー
 //
 type MmuxConnection struct {
-	// Primary
+	// Primary. guarded by Mutex, use primary() to read it.
 	PrimaryConnection Connection
 	OfflineQueue      []mqtt.Message
 	Connections       map[string]Connection
 	MaxOfflineQueue   int
 	Identifier        string
+	UserName          string
+	Tenant            *Tenant
 	CleanSession      bool
 	OutGoingTable     *util.MessageTable
 	SubscribeMap      map[string]bool
@@ -38,7 +41,18 @@ type MmuxConnection struct {
 	Hash              uint32
 	Mutex             sync.RWMutex
 	SubscribedTopics  map[string]*SubscribeSet
-	guid              util.Guid
+	// slow consumer metrics
+	SlowCount    int
+	DroppedCount int
+	LastSlow     time.Time
+	// when the last connection was detached.
+	Disconnected time.Time
+	// overrides session_expiry when > 0.
+	// NOTE: this will be the Session Expiry Interval of MQTT 5 CONNECT. the codec only speaks 3.1.1 for now.
+	SessionExpiry time.Duration
+	// clients of the default namespace don't reach tenants. set for in-process subscribers of Broker.
+	Admin bool
+	guid  util.Guid
 }
 
 func NewMmuxConnection() *MmuxConnection {
@@ -91,10 +105,15 @@ func (self *MmuxConnection) Attach(conn Connection) {
 		} else {
 			if len(self.OfflineQueue) > 0 {
 				log.Info("Process Offline Queue: Playback: %d, %d", len(self.OfflineQueue), len(self.Connections))
-				for i := 0; i < len(self.OfflineQueue); i++ {
-					self.WriteMessageQueue(self.OfflineQueue[i])
+				if cn, ok := conn.(nonBlockingWriter); ok {
+					// keep the inflight window. the rest is sent as the client acknowledges messages.
+					self.flushOfflineQueue(cn)
+				} else {
+					for i := 0; i < len(self.OfflineQueue); i++ {
+						conn.WriteMessageQueue(self.OfflineQueue[i])
+					}
+					self.OfflineQueue = self.OfflineQueue[:0]
 				}
-				self.OfflineQueue = self.OfflineQueue[:0]
 			}
 		}
 	}
@@ -102,11 +121,28 @@ func (self *MmuxConnection) Attach(conn Connection) {
 	self.Connections[conn.GetRealId()] = conn
 }
 
+// primary returns the connection messages go to. nil while the client is offline.
+func (self *MmuxConnection) primary() Connection {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
+	return self.PrimaryConnection
+}
+
 func (self *MmuxConnection) GetRealId() string {
 	return self.Identifier
 }
 
-func (self *MmuxConnection) Detach(conn Connection) {
+// Detach removes conn from this session. it returns false when conn is not attached
+// (e.g. it has been taken over by a newer connection with the same client identifier).
+func (self *MmuxConnection) Detach(conn Connection) bool {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	if v, ok := self.Connections[conn.GetRealId()]; !ok || v != conn {
+		return false
+	}
+
 	if self.PrimaryConnection == conn {
 		self.PrimaryConnection = nil
 	}
@@ -114,81 +150,269 @@ func (self *MmuxConnection) Detach(conn Connection) {
 	delete(self.Connections, conn.GetRealId())
 	if len(self.Connections) == 0 {
 		self.PrimaryConnection = nil
+		self.Disconnected = time.Now()
 	} else {
 		for _, v := range self.Connections {
 			self.PrimaryConnection = v
 			break
 		}
 	}
+	return true
+}
+
+// DetachAll removes every attached connection and returns them.
+// The session itself (subscriptions, offline queue, inflight messages) is kept as is.
+func (self *MmuxConnection) DetachAll() []Connection {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	var conns []Connection
+	for _, v := range self.Connections {
+		conns = append(conns, v)
+	}
+	self.Connections = make(map[string]Connection)
+	self.PrimaryConnection = nil
+	if len(conns) > 0 {
+		self.Disconnected = time.Now()
+	}
+
+	return conns
 }
 
 func (self *MmuxConnection) WriteMessageQueue(request mqtt.Message) {
-	if self.PrimaryConnection == nil {
-		if request.GetType() == mqtt.PACKET_TYPE_PUBLISH {
-			if c, ok := request.(*mqtt.PublishMessage); ok {
-				// 配送されないと思うけど念のため
-				if c.Retain > 0 {
-					// Don't keep retain message
-					return
-				}
+	self.Mutex.Lock()
+	cn := self.PrimaryConnection
+	if cn == nil {
+		self.queueOffline(request)
+	}
+	self.Mutex.Unlock()
 
-				self.OfflineQueue = append(self.OfflineQueue, request)
+	// the outbound queue might block. don't hold the lock.
+	if cn != nil {
+		cn.WriteMessageQueue(request)
+	}
+}
+
+// queueOffline keeps request until the client connects again. the caller holds Mutex.
+func (self *MmuxConnection) queueOffline(request mqtt.Message) {
+	if request.GetType() == mqtt.PACKET_TYPE_PUBLISH {
+		if c, ok := request.(*mqtt.PublishMessage); ok {
+			// 配送されないと思うけど念のため
+			if c.Retain > 0 {
+				// Don't keep retain message
+				return
 			}
-		} else {
+
 			self.OfflineQueue = append(self.OfflineQueue, request)
 		}
-		return
+	} else {
+		self.OfflineQueue = append(self.OfflineQueue, request)
 	}
+}
 
-	self.PrimaryConnection.WriteMessageQueue(request)
+// nonBlockingWriter is implemented by connections which have a bounded outbound queue.
+type nonBlockingWriter interface {
+	TryWriteMessageQueue(request mqtt.Message) error
 }
 
-func (self *MmuxConnection) WriteMessageQueue2(msg []byte) {
+// TryWriteMessageQueue writes request without blocking the caller. Messages spilled to
+// the offline queue are flushed first so that the order is kept.
+// It returns ErrQueueFull when the primary connection can't take request.
+func (self *MmuxConnection) TryWriteMessageQueue(request mqtt.Message) error {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
 	if self.PrimaryConnection == nil {
+		self.queueOffline(request)
+		return nil
+	}
+
+	cn, ok := self.PrimaryConnection.(nonBlockingWriter)
+	if !ok {
+		self.PrimaryConnection.WriteMessageQueue(request)
+		return nil
+	}
+
+	if err := self.flushOfflineQueue(cn); err != nil {
+		return err
+	}
+	return cn.TryWriteMessageQueue(request)
+}
+
+// FlushOfflineQueue moves spilled messages to the connected primary connection as long as it has room.
+func (self *MmuxConnection) FlushOfflineQueue() {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	if cn, ok := self.PrimaryConnection.(nonBlockingWriter); ok {
+		self.flushOfflineQueue(cn)
+	}
+}
+
+func (self *MmuxConnection) flushOfflineQueue(cn nonBlockingWriter) error {
+	for len(self.OfflineQueue) > 0 {
+		if err := cn.TryWriteMessageQueue(self.OfflineQueue[0]); err != nil {
+			return err
+		}
+		self.OfflineQueue = self.OfflineQueue[1:]
+	}
+	return nil
+}
+
+// Spill keeps request in the offline queue until the client catches up.
+// It returns false (and drops request) when the offline queue is full.
+func (self *MmuxConnection) Spill(request mqtt.Message) bool {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	if len(self.OfflineQueue) >= self.MaxOfflineQueue {
+		self.DroppedCount++
+		return false
+	}
+	self.OfflineQueue = append(self.OfflineQueue, request)
+	return true
+}
+
+// MarkSlow records that the outbound queue of this session was full.
+func (self *MmuxConnection) MarkSlow() {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	self.SlowCount++
+	self.LastSlow = time.Now()
+}
+
+// MarkDropped records that a message for this session was discarded.
+func (self *MmuxConnection) MarkDropped() {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	self.DroppedCount++
+}
+
+// QueueStats returns the number of queued messages, queued bytes and spilled messages.
+func (self *MmuxConnection) QueueStats() (int, int64, int) {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
+	var messages int
+	var size int64
+	if cn, ok := self.PrimaryConnection.(*MyConnection); ok {
+		messages = cn.QueuedMessages()
+		size = cn.QueuedBytes()
+	}
+	return messages, size, len(self.OfflineQueue)
+}
+
+// SlowStats returns how often the session was a slow consumer, the number of dropped messages
+// and when it was slow the last time.
+func (self *MmuxConnection) SlowStats() (int, int, time.Time) {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
+	return self.SlowCount, self.DroppedCount, self.LastSlow
+}
+
+// IsDrained reports whether every outbound message of the connected client has been written and acknowledged.
+// Offline sessions are always drained.
+func (self *MmuxConnection) IsDrained() bool {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
+	cn, ok := self.PrimaryConnection.(*MyConnection)
+	if !ok {
+		return true
+	}
+	return len(self.OfflineQueue) == 0 && cn.QueuedMessages() == 0 && cn.InflightTable.Len() == 0
+}
+
+// PendingMessages returns PUBLISH messages which haven't been acknowledged by the connected client
+// (marked as duplicate) followed by the offline queue.
+func (self *MmuxConnection) PendingMessages() []mqtt.Message {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
+	var result []mqtt.Message
+	if cn, ok := self.PrimaryConnection.(*MyConnection); ok {
+		cn.InflightTable.RLock()
+		ids := make([]int, 0, len(cn.InflightTable.Hash))
+		for id := range cn.InflightTable.Hash {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			if p, ok := cn.InflightTable.Hash[uint16(id)].Message.(*mqtt.PublishMessage); ok {
+				x, _ := mqtt.CopyPublishMessage(p)
+				x.Dupe = true
+				result = append(result, x)
+			}
+		}
+		cn.InflightTable.RUnlock()
+	}
+
+	for _, m := range self.OfflineQueue {
+		if m.GetType() == mqtt.PACKET_TYPE_PUBLISH {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func (self *MmuxConnection) WriteMessageQueue2(msg []byte) {
+	self.Mutex.Lock()
+	cn := self.PrimaryConnection
+	if cn == nil {
 		// めんどくせ
 		r, _ := mqtt.ParseMessage(bytes.NewReader(msg), 0)
 		self.OfflineQueue = append(self.OfflineQueue, r)
-		return
 	}
+	self.Mutex.Unlock()
 
-	self.PrimaryConnection.WriteMessageQueue2(msg)
+	if cn != nil {
+		cn.WriteMessageQueue2(msg)
+	}
 }
 
 func (self *MmuxConnection) Close() error {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return nil
 	}
-	return self.PrimaryConnection.Close()
+	return cn.Close()
 }
 func (self *MmuxConnection) SetState(state State) {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return
 	}
-	self.PrimaryConnection.SetState(state)
+	cn.SetState(state)
 }
 
 func (self *MmuxConnection) GetState() State {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return STATE_DETACHED
 	}
 
-	return self.PrimaryConnection.GetState()
+	return cn.GetState()
 }
 
 func (self *MmuxConnection) ResetState() {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return
 	}
 
-	self.PrimaryConnection.ResetState()
+	cn.ResetState()
 }
 
 func (self *MmuxConnection) ReadMessage() (mqtt.Message, error) {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return nil, nil
 	}
 
-	return self.PrimaryConnection.ReadMessage()
+	return cn.ReadMessage()
 }
 
 //func (self *MmuxConnection) Write(reader *bytes.Reader) error {
@@ -200,33 +424,37 @@ func (self *MmuxConnection) ReadMessage() (mqtt.Message, error) {
 //}
 
 func (self *MmuxConnection) IsAlived() bool {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return true
 	}
 
-	return self.PrimaryConnection.IsAlived()
+	return cn.IsAlived()
 }
 
 func (self *MmuxConnection) SetWillMessage(msg mqtt.WillMessage) {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return
 	}
 
-	self.PrimaryConnection.SetWillMessage(msg)
+	cn.SetWillMessage(msg)
 }
 
 func (self *MmuxConnection) GetWillMessage() *mqtt.WillMessage {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return nil
 	}
-	return self.PrimaryConnection.GetWillMessage()
+	return cn.GetWillMessage()
 }
 
 func (self *MmuxConnection) HasWillMessage() bool {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return false
 	}
-	return self.PrimaryConnection.HasWillMessage()
+	return cn.HasWillMessage()
 
 }
 
@@ -275,17 +503,21 @@ func (self *MmuxConnection) RemoveSubscribedTopic(topic string) {
 }
 
 func (self *MmuxConnection) SetKeepaliveInterval(interval int) {
-	if self.PrimaryConnection == nil {
+	cn := self.primary()
+	if cn == nil {
 		return
 	}
 
-	self.PrimaryConnection.SetKeepaliveInterval(interval)
+	cn.SetKeepaliveInterval(interval)
 }
 
 func (self *MmuxConnection) DisableClearSession() {
 }
 
 func (self *MmuxConnection) ShouldClearSession() bool {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
 	if self.PrimaryConnection == nil {
 		return self.CleanSession
 	}
@@ -0,0 +1,185 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/chobie/momonga/datastore"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	log "github.com/chobie/momonga/logger"
+	"strings"
+	"time"
+)
+
+var ErrBrokenRetainedMessage = errors.New("broken retained message")
+
+// RetainedMessage is the export / import format of retained messages.
+type RetainedMessage struct {
+	Topic     string    `json:"topic"`
+	Payload   []byte    `json:"payload"`
+	QoS       int       `json:"qos"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// retained messages are stored as 8 bytes of the stored time (unix nano) followed by the encoded PUBLISH message.
+func encodeRetained(msg *codec.PublishMessage, at time.Time) []byte {
+	buffer := bytes.NewBuffer(nil)
+	binary.Write(buffer, binary.BigEndian, at.UnixNano())
+	codec.WriteMessageTo(msg, buffer)
+	return buffer.Bytes()
+}
+
+func decodeRetained(data []byte) (*codec.PublishMessage, time.Time, error) {
+	if len(data) < 8 {
+		return nil, time.Time{}, ErrBrokenRetainedMessage
+	}
+
+	at := time.Unix(0, int64(binary.BigEndian.Uint64(data[0:8])))
+	p, err := codec.ParseMessage(bytes.NewReader(data[8:]), 0)
+	if err != nil {
+		return nil, at, err
+	}
+	msg, ok := p.(*codec.PublishMessage)
+	if !ok {
+		return nil, at, ErrBrokenRetainedMessage
+	}
+	return msg, at, nil
+}
+
+// retainedPrefix returns the literal part of filter before the first wildcard. topics which filter matches
+// start with it, so retained messages are looked up with datastore.Prefix instead of scanning all of them.
+func retainedPrefix(filter string) string {
+	offset := strings.IndexAny(filter, "+#")
+	if offset < 0 {
+		return filter
+	}
+	// "sport/#" matches "sport" as well.
+	if filter[offset] == '#' {
+		return strings.TrimSuffix(filter[:offset], "/")
+	}
+	return filter[:offset]
+}
+
+// retainedIterator iterates over retained messages which filter might match.
+func (self *Momonga) retainedIterator(filter string) datastore.Iterator {
+	return datastore.Prefix(self.DataStore, []byte(retainedPrefix(filter)))
+}
+
+// RetainedMessages returns retained messages which match filter. "" returns all of them.
+func (self *Momonga) RetainedMessages(filter string) ([]*RetainedMessage, error) {
+	if filter != "" {
+		if err := codec.ValidateTopicFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+
+	result := []*RetainedMessage{}
+	itr := self.retainedIterator(filter)
+	for ; itr.Valid(); itr.Next() {
+		topic := string(itr.Key())
+		if filter != "" && !codec.TopicMatch(filter, topic) {
+			continue
+		}
+
+		msg, at, err := decodeRetained(itr.Value())
+		if err != nil {
+			log.Error("broken retained message %s: %s", topic, err)
+			continue
+		}
+		result = append(result, &RetainedMessage{
+			Topic:     msg.TopicName,
+			Payload:   msg.Payload,
+			QoS:       msg.QosLevel,
+			Timestamp: at,
+		})
+	}
+	return result, nil
+}
+
+// ImportRetained stores messages as retained messages without delivering them.
+// existing retained messages of the same topic are replaced. nothing is stored when a message is invalid.
+func (self *Momonga) ImportRetained(messages []*RetainedMessage) (int, error) {
+	for i, m := range messages {
+		if err := codec.ValidateTopicName(m.Topic); err != nil {
+			return 0, fmt.Errorf("message %d: %s: %s", i, m.Topic, err)
+		}
+		if m.QoS < 0 || m.QoS > 2 {
+			return 0, fmt.Errorf("message %d: %s: invalid QoS %d", i, m.Topic, m.QoS)
+		}
+	}
+
+	count := 0
+	for _, m := range messages {
+		// zero length payload removes the retained message. see SendPublishMessage
+		if len(m.Payload) == 0 {
+			self.DataStore.Del([]byte(m.Topic), []byte(m.Topic))
+			continue
+		}
+
+		msg := codec.NewPublishMessage()
+		msg.TopicName = m.Topic
+		msg.Payload = m.Payload
+		msg.QosLevel = m.QoS
+		msg.Retain = 1
+
+		at := m.Timestamp
+		if at.IsZero() {
+			at = time.Now()
+		}
+		if err := self.DataStore.Put([]byte(m.Topic), encodeRetained(msg, at)); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	log.Info("imported %d retained messages", count)
+	return count, nil
+}
+
+// DeleteRetained removes retained messages which match filter and returns the number of removed messages.
+func (self *Momonga) DeleteRetained(filter string) (int, error) {
+	if err := codec.ValidateTopicFilter(filter); err != nil {
+		return 0, err
+	}
+
+	// "sport/tennis/#" is "sport/tennis" and the range of keys starting with "sport/tennis/".
+	if prefix := strings.TrimSuffix(filter, "/#"); prefix != filter && !strings.ContainsAny(prefix, "+#") {
+		count := 0
+		if _, err := self.DataStore.Get([]byte(prefix)); err == nil {
+			if err := self.DataStore.Del([]byte(prefix), []byte(prefix)); err != nil {
+				return 0, err
+			}
+			count++
+		}
+		n, err := datastore.DelPrefix(self.DataStore, []byte(prefix+"/"))
+		if err != nil {
+			return count, err
+		}
+		count += n
+
+		log.Info("deleted %d retained messages matching %s", count, filter)
+		return count, nil
+	}
+
+	var targets []string
+	itr := self.retainedIterator(filter)
+	for ; itr.Valid(); itr.Next() {
+		if topic := string(itr.Key()); codec.TopicMatch(filter, topic) {
+			targets = append(targets, topic)
+		}
+	}
+
+	for _, topic := range targets {
+		if err := self.DataStore.Del([]byte(topic), []byte(topic)); err != nil {
+			return 0, err
+		}
+	}
+
+	log.Info("deleted %d retained messages matching %s", len(targets), filter)
+	return len(targets), nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"github.com/chobie/momonga/configuration"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	"regexp"
+	"strings"
+)
+
+type rewriteRule struct {
+	from        []string
+	to          []string
+	regexp      *regexp.Regexp
+	replacement string
+}
+
+// TopicRewriter rewrites topic names and topic filters with configured rules.
+// the first matching rule wins.
+type TopicRewriter struct {
+	rules []*rewriteRule
+}
+
+func NewTopicRewriter(rules []configuration.RewriteRule) (*TopicRewriter, error) {
+	rewriter := &TopicRewriter{}
+
+	for _, r := range rules {
+		if r.Regexp != "" {
+			reg, err := regexp.Compile(r.Regexp)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rewrite regexp %q: %s", r.Regexp, err)
+			}
+			rewriter.rules = append(rewriter.rules, &rewriteRule{
+				regexp:      reg,
+				replacement: r.Replacement,
+			})
+			continue
+		}
+
+		if err := codec.ValidateTopicFilter(r.From); err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule from %q: %s", r.From, err)
+		}
+		if err := codec.ValidateTopicFilter(r.To); err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule to %q: %s", r.To, err)
+		}
+		if strings.Count(r.From, "+") != strings.Count(r.To, "+") ||
+			strings.HasSuffix(r.From, "#") != strings.HasSuffix(r.To, "#") {
+			return nil, fmt.Errorf("rewrite rule %q -> %q must have the same wildcards", r.From, r.To)
+		}
+
+		rewriter.rules = append(rewriter.rules, &rewriteRule{
+			from: strings.Split(r.From, "/"),
+			to:   strings.Split(r.To, "/"),
+		})
+	}
+
+	return rewriter, nil
+}
+
+func (self *TopicRewriter) Len() int {
+	if self == nil {
+		return 0
+	}
+	return len(self.rules)
+}
+
+// Publish rewrites a topic name. the topic is kept when the result isn't a valid topic name.
+func (self *TopicRewriter) Publish(topic string) string {
+	if result, ok := self.rewrite(topic); ok && codec.ValidateTopicName(result) == nil {
+		return result
+	}
+	return topic
+}
+
+// Filter rewrites a topic filter. wildcards in filter are treated as plain levels,
+// so "dev/+/t" is rewritten by a rule from "dev/+/t" but "dev/#" isn't.
+func (self *TopicRewriter) Filter(filter string) string {
+	if result, ok := self.rewrite(filter); ok && codec.ValidateTopicFilter(result) == nil {
+		return result
+	}
+	return filter
+}
+
+// Reverse maps a rewritten topic name back to the namespace of filter, the filter the client subscribed to.
+func (self *TopicRewriter) Reverse(topic, filter string) string {
+	if self == nil {
+		return topic
+	}
+
+	levels := strings.Split(topic, "/")
+	for _, r := range self.rules {
+		if r.regexp != nil {
+			continue
+		}
+		captures, ok := capture(r.to, levels)
+		if !ok {
+			continue
+		}
+		result := substitute(r.from, captures)
+		if codec.TopicMatch(filter, result) {
+			return result
+		}
+	}
+	return topic
+}
+
+func (self *TopicRewriter) rewrite(topic string) (string, bool) {
+	if self == nil {
+		return topic, false
+	}
+
+	levels := strings.Split(topic, "/")
+	for _, r := range self.rules {
+		if r.regexp != nil {
+			if r.regexp.MatchString(topic) {
+				return r.regexp.ReplaceAllString(topic, r.replacement), true
+			}
+			continue
+		}
+		if captures, ok := capture(r.from, levels); ok {
+			return substitute(r.to, captures), true
+		}
+	}
+	return topic, false
+}
+
+// capture matches levels against pattern and returns levels matched by its wildcards.
+func capture(pattern, levels []string) ([]string, bool) {
+	var captures []string
+
+	// [MQTT-4.7.2-1] wildcards at the first level don't match topics beginning with $
+	if len(levels[0]) > 0 && levels[0][0] == '$' && (pattern[0] == "+" || pattern[0] == "#") {
+		return nil, false
+	}
+
+	for i, p := range pattern {
+		if p == "#" {
+			return append(captures, strings.Join(levels[i:], "/")), true
+		}
+		if i >= len(levels) {
+			return nil, false
+		}
+		if p == "+" {
+			if levels[i] == "#" {
+				return nil, false
+			}
+			captures = append(captures, levels[i])
+		} else if p != levels[i] {
+			return nil, false
+		}
+	}
+
+	if len(pattern) != len(levels) {
+		return nil, false
+	}
+	return captures, true
+}
+
+func substitute(pattern, captures []string) string {
+	var result []string
+
+	for _, p := range pattern {
+		if p == "+" || p == "#" {
+			p, captures = captures[0], captures[1:]
+		}
+		result = append(result, p)
+	}
+
+	// "a/#" matches "a". drop the empty level
+	if len(result) > 1 && pattern[len(pattern)-1] == "#" && result[len(result)-1] == "" {
+		result = result[:len(result)-1]
+	}
+	return strings.Join(result, "/")
+}
@@ -0,0 +1,415 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/chobie/momonga/common"
+	"github.com/chobie/momonga/configuration"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	log "github.com/chobie/momonga/logger"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// PayloadError describes a payload which doesn't match the schema of its topic.
+type PayloadError struct {
+	// topic filter of the schema
+	Filter          string
+	DeadLetterTopic string
+	Err             error
+}
+
+func (self *PayloadError) Error() string {
+	return fmt.Sprintf("payload doesn't match the schema of %s: %s", self.Filter, self.Err)
+}
+
+// DeadLetter is the payload of messages forwarded to a dead letter topic.
+type DeadLetter struct {
+	Timestamp time.Time `json:"timestamp"`
+	Topic     string    `json:"topic"`
+	ClientId  string    `json:"client_id,omitempty"`
+	QoS       int       `json:"qos"`
+	Retain    bool      `json:"retain"`
+	Error     string    `json:"error"`
+	Payload   []byte    `json:"payload"`
+}
+
+type payloadSchema struct {
+	filter     string
+	schema     *jsonSchema
+	deadLetter string
+}
+
+// PayloadValidator validates payloads of PUBLISH messages with the schema of their topic.
+// the first matching schema is used.
+type PayloadValidator struct {
+	schemas []*payloadSchema
+}
+
+func NewPayloadValidator(schemas []configuration.Schema, deadLetterTopic string) (*PayloadValidator, error) {
+	validator := &PayloadValidator{}
+
+	for _, s := range schemas {
+		if err := codec.ValidateTopicFilter(s.Topic); err != nil {
+			return nil, fmt.Errorf("invalid schema topic %q: %s", s.Topic, err)
+		}
+
+		schema, err := loadSchema(s)
+		if err != nil {
+			return nil, fmt.Errorf("schema of %s: %s", s.Topic, err)
+		}
+
+		deadLetter := s.DeadLetterTopic
+		if deadLetter == "" {
+			deadLetter = deadLetterTopic
+		}
+		if deadLetter != "" {
+			if err := codec.ValidateTopicName(deadLetter); err != nil {
+				return nil, fmt.Errorf("invalid dead letter topic %q: %s", deadLetter, err)
+			}
+		}
+
+		validator.schemas = append(validator.schemas, &payloadSchema{
+			filter:     s.Topic,
+			schema:     schema,
+			deadLetter: deadLetter,
+		})
+	}
+
+	// rejected dead letters would be forwarded again and again.
+	for _, s := range validator.schemas {
+		for _, other := range validator.schemas {
+			if other.deadLetter != "" && codec.TopicMatch(s.filter, other.deadLetter) {
+				return nil, fmt.Errorf("schema of %s matches the dead letter topic %s", s.filter, other.deadLetter)
+			}
+		}
+	}
+
+	return validator, nil
+}
+
+func loadSchema(s configuration.Schema) (*jsonSchema, error) {
+	var data []byte
+	var err error
+
+	switch {
+	case s.Schema != "" && s.SchemaFile == "" && len(s.Fields) == 0:
+		data = []byte(s.Schema)
+	case s.SchemaFile != "" && s.Schema == "" && len(s.Fields) == 0:
+		if data, err = ioutil.ReadFile(s.SchemaFile); err != nil {
+			return nil, err
+		}
+	case len(s.Fields) > 0 && s.Schema == "" && s.SchemaFile == "":
+		return fieldsSchema(s.Fields)
+	default:
+		return nil, fmt.Errorf("set one of schema, schema_file or fields")
+	}
+
+	schema := &jsonSchema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, err
+	}
+	if err := schema.compile(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// fieldsSchema builds the schema of a JSON object from typed fields. see configuration.Schema
+func fieldsSchema(fields map[string]string) (*jsonSchema, error) {
+	schema := &jsonSchema{
+		Type:       schemaTypes{"object"},
+		Properties: make(map[string]*jsonSchema),
+	}
+	for name, typ := range fields {
+		if strings.HasSuffix(typ, "?") {
+			typ = strings.TrimSuffix(typ, "?")
+		} else {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = &jsonSchema{Type: schemaTypes{typ}}
+	}
+	sort.Strings(schema.Required)
+
+	if err := schema.compile(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (self *PayloadValidator) Len() int {
+	if self == nil {
+		return 0
+	}
+	return len(self.schemas)
+}
+
+// Validate returns a *PayloadError when payload doesn't match the schema of topic.
+func (self *PayloadValidator) Validate(topic string, payload []byte) error {
+	if self == nil {
+		return nil
+	}
+
+	for _, s := range self.schemas {
+		if !codec.TopicMatch(s.filter, topic) {
+			continue
+		}
+
+		var v interface{}
+		err := json.Unmarshal(payload, &v)
+		if err != nil {
+			err = fmt.Errorf("invalid JSON: %s", err)
+		} else {
+			err = s.schema.validate(v, "$")
+		}
+		if err != nil {
+			return &PayloadError{Filter: s.filter, DeadLetterTopic: s.deadLetter, Err: err}
+		}
+		return nil
+	}
+	return nil
+}
+
+// rejectPublish drops msg and forwards it to the dead letter topic when it is configured.
+// NOTE: QoS 1 and 2 messages are already acknowledged. MQTT 3.1.1 can't tell the publisher.
+func (self *Momonga) rejectPublish(msg *codec.PublishMessage, err *PayloadError) {
+	var clientId string
+	if conn, ok := msg.Opaque.(Connection); ok {
+		clientId = conn.GetId()
+	}
+	log.Info("rejected a message to %s (client: %q): %s", msg.TopicName, clientId, err)
+	atomic.AddInt64(&self.System.Broker.Messages.Publish.Rejected, 1)
+
+	if err.DeadLetterTopic == "" {
+		return
+	}
+
+	b, _ := json.Marshal(&DeadLetter{
+		Timestamp: time.Now(),
+		Topic:     msg.TopicName,
+		ClientId:  clientId,
+		QoS:       msg.QosLevel,
+		Retain:    msg.Retain > 0,
+		Error:     err.Err.Error(),
+		Payload:   msg.Payload,
+	})
+	dead := codec.NewPublishMessage()
+	dead.TopicName = err.DeadLetterTopic
+	dead.QosLevel = msg.QosLevel
+	dead.Payload = b
+	self.SendPublishMessage(dead)
+}
+
+// jsonSchema is the subset of JSON Schema which PayloadValidator supports:
+// type, enum, properties, required, additionalProperties, items, minimum, maximum,
+// minLength, maxLength, pattern, minItems and maxItems.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+
+	pattern      *regexp.Regexp
+	additional   *jsonSchema
+	noAdditional bool
+}
+
+// schemaTypes is "type" of JSON Schema: a type name or a list of them.
+type schemaTypes []string
+
+func (self *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*self = schemaTypes{name}
+		return nil
+	}
+
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*self = schemaTypes(names)
+	return nil
+}
+
+func (self *jsonSchema) compile() error {
+	for _, t := range self.Type {
+		switch t {
+		case "string", "number", "integer", "boolean", "object", "array", "null":
+		default:
+			return fmt.Errorf("unknown type %q", t)
+		}
+	}
+
+	if self.Pattern != "" {
+		reg, err := regexp.Compile(self.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", self.Pattern, err)
+		}
+		self.pattern = reg
+	}
+
+	switch strings.TrimSpace(string(self.AdditionalProperties)) {
+	case "", "true":
+	case "false":
+		self.noAdditional = true
+	default:
+		self.additional = &jsonSchema{}
+		if err := json.Unmarshal(self.AdditionalProperties, self.additional); err != nil {
+			return fmt.Errorf("additionalProperties: %s", err)
+		}
+	}
+
+	children := []*jsonSchema{self.Items, self.additional}
+	for _, s := range self.Properties {
+		children = append(children, s)
+	}
+	for _, s := range children {
+		if s == nil {
+			continue
+		}
+		if err := s.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks v (decoded by encoding/json) at path.
+func (self *jsonSchema) validate(v interface{}, path string) error {
+	if len(self.Type) > 0 {
+		matched := false
+		for _, t := range self.Type {
+			if isSchemaType(v, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(self.Type, " or "), schemaTypeOf(v))
+		}
+	}
+
+	if len(self.Enum) > 0 {
+		matched := false
+		for _, e := range self.Enum {
+			if reflect.DeepEqual(v, e) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: not one of the enum values", path)
+		}
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if self.Minimum != nil && v < *self.Minimum {
+			return fmt.Errorf("%s: %v is less than %v", path, v, *self.Minimum)
+		}
+		if self.Maximum != nil && v > *self.Maximum {
+			return fmt.Errorf("%s: %v is greater than %v", path, v, *self.Maximum)
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if self.MinLength != nil && length < *self.MinLength {
+			return fmt.Errorf("%s: shorter than %d", path, *self.MinLength)
+		}
+		if self.MaxLength != nil && length > *self.MaxLength {
+			return fmt.Errorf("%s: longer than %d", path, *self.MaxLength)
+		}
+		if self.pattern != nil && !self.pattern.MatchString(v) {
+			return fmt.Errorf("%s: doesn't match %s", path, self.Pattern)
+		}
+	case []interface{}:
+		if self.MinItems != nil && len(v) < *self.MinItems {
+			return fmt.Errorf("%s: fewer than %d items", path, *self.MinItems)
+		}
+		if self.MaxItems != nil && len(v) > *self.MaxItems {
+			return fmt.Errorf("%s: more than %d items", path, *self.MaxItems)
+		}
+		if self.Items != nil {
+			for i, item := range v {
+				if err := self.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range self.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+
+		// sort names, so that the same payload always reports the same error.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			s, ok := self.Properties[name]
+			if !ok {
+				if self.noAdditional {
+					return fmt.Errorf("%s: unknown property %q", path, name)
+				}
+				s = self.additional
+			}
+			if s == nil {
+				continue
+			}
+			if err := s.validate(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isSchemaType(v interface{}, t string) bool {
+	if t == "integer" {
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	}
+	return schemaTypeOf(v) == t
+}
+
+func schemaTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,63 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	log "github.com/chobie/momonga/logger"
+	"sync/atomic"
+	"time"
+)
+
+// sessionExpiry returns how long mux is kept after its last connection went away. 0 means forever.
+func (self *Momonga) sessionExpiry(mux *MmuxConnection) time.Duration {
+	if mux.SessionExpiry > 0 {
+		return mux.SessionExpiry
+	}
+	return self.config.GetSessionExpiry()
+}
+
+// expireSessions destroys persistent sessions which have been disconnected for longer than
+// their expiry interval. their subscriptions, offline queue and inflight messages are discarded.
+func (self *Momonga) expireSessions(now time.Time) int {
+	expired := 0
+	for _, mux := range self.Sessions() {
+		if self.expireSession(mux, now) {
+			expired++
+		}
+	}
+
+	if expired > 0 {
+		atomic.AddInt64(&self.System.Broker.Clients.Expired, int64(expired))
+		log.Info("expired %d sessions", expired)
+	}
+	return expired
+}
+
+func (self *Momonga) expireSession(mux *MmuxConnection, now time.Time) bool {
+	expiry := self.sessionExpiry(mux)
+	if expiry <= 0 {
+		return false
+	}
+
+	lock := self.getSessionLock(mux.Identifier)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// the client might have come back (or the session might have been replaced) in the meantime.
+	if current, err := self.GetConnectionByClientId(mux.Identifier); err != nil || current != mux {
+		return false
+	}
+
+	mux.Mutex.RLock()
+	idle := len(mux.Connections) == 0 && !mux.Disconnected.IsZero() && now.Sub(mux.Disconnected) >= expiry
+	mux.Mutex.RUnlock()
+	if !idle {
+		return false
+	}
+
+	log.Debug("session %s expired (disconnected at %s)", mux.Identifier, mux.Disconnected)
+	self.discardSession(mux)
+	return true
+}
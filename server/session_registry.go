@@ -0,0 +1,107 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/chobie/momonga/util"
+	"sync"
+)
+
+// SessionRegistry maps client identifiers to sessions. it is split into shards,
+// each of them has its own lock. a session might be registered under two keys (see registerSession).
+type SessionRegistry struct {
+	shards []*registryShard
+}
+
+type registryShard struct {
+	sync.RWMutex
+	sessions map[string]*MmuxConnection
+}
+
+func NewSessionRegistry(shards int) *SessionRegistry {
+	if shards < 1 {
+		shards = 1
+	}
+
+	self := &SessionRegistry{
+		shards: make([]*registryShard, shards),
+	}
+	for i := range self.shards {
+		self.shards[i] = &registryShard{
+			sessions: make(map[string]*MmuxConnection),
+		}
+	}
+	return self
+}
+
+func (self *SessionRegistry) shard(clientId string) *registryShard {
+	return self.shards[util.MurmurHash([]byte(clientId))%uint32(len(self.shards))]
+}
+
+func (self *SessionRegistry) Get(clientId string) (*MmuxConnection, bool) {
+	shard := self.shard(clientId)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	mux, ok := shard.sessions[clientId]
+	return mux, ok
+}
+
+// Swap registers mux under clientId and returns the session it replaced (nil when there was none).
+func (self *SessionRegistry) Swap(clientId string, mux *MmuxConnection) *MmuxConnection {
+	shard := self.shard(clientId)
+	shard.Lock()
+	defer shard.Unlock()
+
+	old := shard.sessions[clientId]
+	shard.sessions[clientId] = mux
+	return old
+}
+
+func (self *SessionRegistry) Delete(clientId string) {
+	shard := self.shard(clientId)
+	shard.Lock()
+	defer shard.Unlock()
+
+	delete(shard.sessions, clientId)
+}
+
+// CompareAndDelete removes clientId only when it still points to mux.
+func (self *SessionRegistry) CompareAndDelete(clientId string, mux *MmuxConnection) bool {
+	shard := self.shard(clientId)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if shard.sessions[clientId] != mux {
+		return false
+	}
+	delete(shard.sessions, clientId)
+	return true
+}
+
+// Snapshot returns every session once. each shard is copied under its lock,
+// so callers can iterate the result while sessions come and go.
+func (self *SessionRegistry) Snapshot() []*MmuxConnection {
+	var result []*MmuxConnection
+	seen := make(map[*MmuxConnection]bool)
+
+	for _, shard := range self.shards {
+		shard.RLock()
+		for _, mux := range shard.sessions {
+			if seen[mux] {
+				continue
+			}
+			seen[mux] = true
+			result = append(result, mux)
+		}
+		shard.RUnlock()
+	}
+	return result
+}
+
+// Len returns the number of sessions.
+func (self *SessionRegistry) Len() int {
+	return len(self.Snapshot())
+}
@@ -0,0 +1,120 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/chobie/momonga/datastore"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	log "github.com/chobie/momonga/logger"
+	"time"
+)
+
+// sessionRecord is the persisted form of a session which has CleanSession set to 0.
+type sessionRecord struct {
+	Identifier    string         `json:"identifier"`
+	Tenant        string         `json:"tenant,omitempty"`
+	Subscriptions map[string]int `json:"subscriptions"`
+	// when the client went away, session_expiry counts from here.
+	Disconnected  time.Time     `json:"disconnected"`
+	SessionExpiry time.Duration `json:"session_expiry,omitempty"`
+	// encoded PUBLISH messages which haven't been delivered or acknowledged yet.
+	Messages [][]byte `json:"messages"`
+}
+
+// persistSessions replaces the contents of SessionStore with current persistent sessions.
+func (self *Momonga) persistSessions() error {
+	if _, err := datastore.DelPrefix(self.SessionStore, nil); err != nil {
+		return err
+	}
+
+	count := 0
+	for _, mux := range self.Sessions() {
+		if mux.CleanSession {
+			continue
+		}
+
+		record := sessionRecord{
+			Identifier:    mux.Identifier,
+			Tenant:        mux.Tenant.GetName(),
+			Subscriptions: make(map[string]int),
+			Disconnected:  mux.Disconnected,
+			SessionExpiry: mux.SessionExpiry,
+		}
+		if record.Disconnected.IsZero() {
+			// still connected while shutting down.
+			record.Disconnected = time.Now()
+		}
+		for filter, set := range mux.GetSubscribedTopics() {
+			record.Subscriptions[filter] = set.QoS
+		}
+		for _, m := range mux.PendingMessages() {
+			buffer := bytes.NewBuffer(nil)
+			codec.WriteMessageTo(m, buffer)
+			record.Messages = append(record.Messages, buffer.Bytes())
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := self.SessionStore.Put([]byte(mux.Identifier), data); err != nil {
+			return err
+		}
+		count++
+	}
+
+	log.Info("persisted %d sessions", count)
+	return nil
+}
+
+// restoreSessions registers sessions saved by persistSessions as offline sessions.
+func (self *Momonga) restoreSessions() {
+	itr := self.SessionStore.Iterator()
+	for ; itr.Valid(); itr.Next() {
+		var record sessionRecord
+		if err := json.Unmarshal(itr.Value(), &record); err != nil {
+			log.Error("broken session record %q: %s", itr.Key(), err)
+			continue
+		}
+
+		mux := NewMmuxConnection()
+		mux.SetId(record.Identifier)
+		mux.CleanSession = false
+		mux.Disconnected = record.Disconnected
+		mux.SessionExpiry = record.SessionExpiry
+		if mux.Disconnected.IsZero() {
+			// records written by older versions.
+			mux.Disconnected = time.Now()
+		}
+		i, _ := self.guidFactory.NewGUID(int64(mux.GetHash()))
+		mux.SetGuid(i)
+		if record.Tenant != "" {
+			if mux.Tenant = self.tenantByName(record.Tenant); mux.Tenant == nil {
+				log.Error("tenant %s of session %s is no longer defined. discard it", record.Tenant, record.Identifier)
+				continue
+			}
+		}
+
+		// offline sessions are looked up by the bare client identifier. see HandleConnection
+		for filter, qos := range record.Subscriptions {
+			set := self.newSubscribeSet(mux.Identifier, mux.Tenant, filter, qos)
+			set.Handle = self.Subscriptions.Add(set.TopicFilter, set)
+			mux.AppendSubscribedTopic(filter, set)
+		}
+		for _, b := range record.Messages {
+			m, err := codec.ParseMessage(bytes.NewReader(b), 0)
+			if err != nil {
+				log.Error("broken message in session %s: %s", record.Identifier, err)
+				continue
+			}
+			mux.OfflineQueue = append(mux.OfflineQueue, m)
+		}
+
+		self.SetConnectionByClientId(mux.Identifier, mux)
+		log.Debug("restored session %s (%d subscriptions, %d messages)", record.Identifier, len(record.Subscriptions), len(mux.OfflineQueue))
+	}
+}
@@ -5,6 +5,7 @@
 package server
 
 // NOTE: $SYS structures
+// counters are updated with sync/atomic.
 type System struct {
 	Broker SystemBroker
 }
@@ -22,36 +23,41 @@ type SystemBrokerLoad struct {
 }
 
 type SystemBrokerLoadBytes struct {
-	Received int
-	Sent     int
+	Received int64
+	Sent     int64
 }
 
 type SystemBrokerClients struct {
-	Connected    int
-	Disconnected int
-	Maximum      int
-	Total        int
+	Connected    int64
+	Disconnected int64
+	Maximum      int64
+	Total        int64
+	// persistent sessions destroyed by session_expiry
+	Expired int64
 }
 
 type SystemBrokerMessages struct {
-	Inflight int
-	Received int
-	Sent     int
-	Stored   int
+	Inflight int64
+	Received int64
+	Sent     int64
+	Stored   int64
 	Publish  SystemBrokerMessagesPublish
 	Retained SystemBrokerMessagesRetained
 }
 
 type SystemBrokerMessagesPublish struct {
-	Sent  int
-	Count int
+	Sent    int64
+	Count   int64
+	Dropped int64
+	// payloads which didn't match their schema
+	Rejected int64
 }
 
 type SystemBrokerMessagesRetained struct {
-	Count int
+	Count int64
 }
 type SystemBrokerSubscriptions struct {
-	Count int
+	Count int64
 }
 
 type SystemBrokerBroker struct {
@@ -4,7 +4,6 @@
 package server
 
 import (
-	"fmt"
 	. "github.com/chobie/momonga/common"
 	"github.com/chobie/momonga/configuration"
 	log "github.com/chobie/momonga/logger"
@@ -52,10 +51,11 @@ func (self *TcpServer) ListenAndServe() error {
 		self.listener = &MyListener{Listener: listener}
 	} else {
 		addr, err := net.ResolveTCPAddr("tcp4", self.ListenAddress)
+		if err != nil {
+			return err
+		}
 		listener, err := net.ListenTCP("tcp", addr)
-
 		if err != nil {
-			panic(fmt.Sprintf("Error: %s", err))
 			return err
 		}
 
@@ -114,6 +114,7 @@ Accept:
 			conn := NewMyConnection()
 			conn.SetMyConnection(client)
 			conn.SetId(client.RemoteAddr().String())
+			conn.Listener = "tcp"
 
 			log.Debug("Accepted: %s", conn.GetId())
 			go self.Engine.HandleConnection(conn)
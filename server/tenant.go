@@ -0,0 +1,237 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	. "github.com/chobie/momonga/common"
+	"github.com/chobie/momonga/configuration"
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	log "github.com/chobie/momonga/logger"
+	"strings"
+)
+
+// Tenant is a topic namespace. a nil *Tenant is the default (global) namespace.
+type Tenant struct {
+	Name           string
+	Mountpoint     string
+	MaxConnections int
+	// -1 refuses every subscription
+	MaxQos     int
+	users      map[string]bool
+	userPrefix string
+	listener   string
+}
+
+func NewTenants(configs []configuration.Tenant) ([]*Tenant, error) {
+	var tenants []*Tenant
+
+	for _, c := range configs {
+		if c.Name == "" || strings.ContainsAny(c.Name, "/+#") {
+			return nil, fmt.Errorf("invalid tenant name %q", c.Name)
+		}
+
+		tenant := &Tenant{
+			Name:           c.Name,
+			Mountpoint:     c.Mountpoint,
+			MaxConnections: c.MaxConnections,
+			MaxQos:         2,
+			users:          make(map[string]bool),
+			userPrefix:     c.UserPrefix,
+			listener:       c.Listener,
+		}
+		if tenant.Mountpoint == "" {
+			tenant.Mountpoint = "$tenant/" + c.Name + "/"
+		}
+		if c.MaxQos != nil {
+			tenant.MaxQos = *c.MaxQos
+		}
+		for _, user := range c.Users {
+			tenant.users[user] = true
+		}
+
+		if !strings.HasSuffix(tenant.Mountpoint, "/") || codec.ValidateTopicName(tenant.Mountpoint) != nil {
+			return nil, fmt.Errorf("tenant %s: invalid mountpoint %q", c.Name, tenant.Mountpoint)
+		}
+		for _, other := range tenants {
+			if other.Name == tenant.Name {
+				return nil, fmt.Errorf("tenant %s is defined twice", c.Name)
+			}
+			// a client identifier or a topic of one tenant must not be able to reach another one.
+			if strings.HasPrefix(other.Mountpoint, tenant.Mountpoint) || strings.HasPrefix(tenant.Mountpoint, other.Mountpoint) {
+				return nil, fmt.Errorf("mountpoints of tenant %s and %s overlap", other.Name, c.Name)
+			}
+		}
+
+		tenants = append(tenants, tenant)
+	}
+
+	return tenants, nil
+}
+
+func (self *Tenant) GetName() string {
+	if self == nil {
+		return ""
+	}
+	return self.Name
+}
+
+func (self *Tenant) GetMountpoint() string {
+	if self == nil {
+		return ""
+	}
+	return self.Mountpoint
+}
+
+// MountTopic prefixes topic with the mountpoint. $delayed/<seconds>/<topic> keeps its prefix.
+func (self *Tenant) MountTopic(topic string) string {
+	if self == nil {
+		return topic
+	}
+
+	if strings.HasPrefix(topic, DELAYED_TOPIC_PREFIX) {
+		rest := strings.TrimPrefix(topic, DELAYED_TOPIC_PREFIX)
+		if offset := strings.Index(rest, "/"); offset >= 0 {
+			return DELAYED_TOPIC_PREFIX + rest[:offset+1] + self.Mountpoint + rest[offset+1:]
+		}
+	}
+	return self.Mountpoint + topic
+}
+
+// MountId scopes a client identifier to the tenant.
+func (self *Tenant) MountId(id string) string {
+	if self == nil {
+		return id
+	}
+	return self.Mountpoint + id
+}
+
+func (self *Tenant) UnmountId(id string) string {
+	if self == nil {
+		return id
+	}
+	return strings.TrimPrefix(id, self.Mountpoint)
+}
+
+// resolveTenant returns the tenant of a client. see configuration.Tenant
+func (self *Momonga) resolveTenant(username, listener string) *Tenant {
+	for _, t := range self.Tenants {
+		if t.users[username] {
+			return t
+		}
+	}
+	for _, t := range self.Tenants {
+		if t.userPrefix != "" && strings.HasPrefix(username, t.userPrefix) {
+			return t
+		}
+	}
+	for _, t := range self.Tenants {
+		if t.listener != "" && t.listener == listener {
+			return t
+		}
+	}
+	return nil
+}
+
+func (self *Momonga) tenantByName(name string) *Tenant {
+	for _, t := range self.Tenants {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// isReservedId reports whether a client of the default namespace uses an identifier of a tenant.
+func (self *Momonga) isReservedId(id string) bool {
+	for _, t := range self.Tenants {
+		if strings.HasPrefix(id, t.Mountpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantOf returns the tenant whose mountpoint topic (a topic name or a topic filter) is under.
+func (self *Momonga) tenantOf(topic string) *Tenant {
+	if strings.HasPrefix(topic, DELAYED_TOPIC_PREFIX) {
+		rest := strings.TrimPrefix(topic, DELAYED_TOPIC_PREFIX)
+		if offset := strings.Index(rest, "/"); offset >= 0 {
+			topic = rest[offset+1:]
+		}
+	}
+	for _, t := range self.Tenants {
+		if strings.HasPrefix(topic, t.Mountpoint) {
+			return t
+		}
+	}
+	return nil
+}
+
+// tenantConnections counts connected clients of tenant except identifier.
+func (self *Momonga) tenantConnections(tenant *Tenant, identifier string) int {
+	count := 0
+	for _, mux := range self.Sessions() {
+		if mux.Tenant == tenant && mux.Identifier != identifier && mux.primary() != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// inboundTopic maps a topic a client of tenant published to the global namespace.
+// SendPublishMessage rewrites it later. see rewriteTopic
+func (self *Momonga) inboundTopic(tenant *Tenant, topic string) string {
+	return tenant.MountTopic(topic)
+}
+
+// rewriteTopic applies rewrite rules to topic. rules are written against client-visible topics,
+// so a topic under the mountpoint of a tenant is rewritten without the mountpoint.
+func (self *Momonga) rewriteTopic(topic string) string {
+	for _, tenant := range self.Tenants {
+		if strings.HasPrefix(topic, tenant.Mountpoint) {
+			return tenant.Mountpoint + self.Rewriter().Publish(strings.TrimPrefix(topic, tenant.Mountpoint))
+		}
+	}
+	return self.Rewriter().Publish(topic)
+}
+
+// subscriptionFilter returns the filter stored in Subscriptions for filter of a client in tenant.
+func (self *Momonga) subscriptionFilter(tenant *Tenant, filter string) string {
+	return tenant.GetMountpoint() + self.Rewriter().Filter(filter)
+}
+
+// newSubscribeSet creates the subscription of filter, which a client in tenant subscribed to.
+func (self *Momonga) newSubscribeSet(clientId string, tenant *Tenant, filter string, qos int) *SubscribeSet {
+	set := &SubscribeSet{
+		TopicFilter: self.subscriptionFilter(tenant, filter),
+		ClientId:    clientId,
+		QoS:         qos,
+		Mountpoint:  tenant.GetMountpoint(),
+	}
+	if set.TopicFilter != filter {
+		set.OriginalFilter = filter
+	}
+	return set
+}
+
+// remapSubscriptions stores subscriptions of every session under the filters of the current rewrite rules.
+func (self *Momonga) remapSubscriptions() {
+	for _, mux := range self.Sessions() {
+		mux.Mutex.Lock()
+		for filter, old := range mux.SubscribedTopics {
+			set := self.newSubscribeSet(old.ClientId, mux.Tenant, filter, old.QoS)
+			if set.TopicFilter == old.TopicFilter && set.OriginalFilter == old.OriginalFilter {
+				continue
+			}
+			log.Debug("rewrite topic filter %s -> %s", filter, set.TopicFilter)
+			set.Admin = old.Admin
+			self.Subscriptions.Remove(old.Handle)
+			set.Handle = self.Subscriptions.Add(set.TopicFilter, set)
+			mux.SubscribedTopics[filter] = set
+		}
+		mux.Mutex.Unlock()
+	}
+}
@@ -4,7 +4,6 @@
 package server
 
 import (
-	"fmt"
 	. "github.com/chobie/momonga/common"
 	"github.com/chobie/momonga/configuration"
 	log "github.com/chobie/momonga/logger"
@@ -50,9 +49,7 @@ func (self *UnixServer) ListenAndServe() error {
 		self.listener = &MyListener{Listener: listener}
 	} else {
 		listener, err := net.Listen("unix", self.Address)
-
 		if err != nil {
-			panic(fmt.Sprintf("Error: %s", err))
 			return err
 		}
 		self.listener = &MyListener{Listener: listener}
@@ -104,6 +101,7 @@ Accept:
 			conn := NewMyConnection()
 			conn.SetMyConnection(client)
 			conn.SetId(client.RemoteAddr().String())
+			conn.Listener = "unix"
 
 			log.Debug("Accepted: %s", conn.GetId())
 			go self.Engine.HandleConnection(conn)
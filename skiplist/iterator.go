@@ -61,6 +61,18 @@ func (self *SkipListIterator) Next() {
 	}
 }
 
+// Prev moves to the previous node. the iterator becomes invalid at the first node.
+func (self *SkipListIterator) Prev() {
+	if self.Node != nil {
+		self.Node = self.Node.Backward
+	}
+}
+
 func (self *SkipListIterator) Rewind() {
 	self.Node = self.Parent.Header.Level[0].Forward
 }
+
+// SeekToLast moves to the last node.
+func (self *SkipListIterator) SeekToLast() {
+	self.Node = self.Parent.Tail
+}
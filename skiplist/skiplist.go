@@ -36,6 +36,8 @@ type SkipListNode struct {
 	Score interface{}
 	Data  interface{}
 	Level map[int]*SkipListLevel
+	// previous node. nil for the first node
+	Backward *SkipListNode
 }
 
 type SkipList struct {
@@ -116,6 +118,15 @@ func (self *SkipList) Insert(score, data interface{}) {
 	for i := level; i < self.Level; i++ {
 		update[i].Level[i].Span++
 	}
+
+	if update[0] != self.Header {
+		add.Backward = update[0]
+	}
+	if add.Level[0].Forward != nil {
+		add.Level[0].Forward.Backward = add
+	} else {
+		self.Tail = add
+	}
 	self.Length++
 }
 
@@ -148,6 +159,12 @@ func (self *SkipList) deleteNode(node *SkipListNode, score interface{}, update m
 		}
 	}
 
+	if node.Level[0].Forward != nil {
+		node.Level[0].Forward.Backward = node.Backward
+	} else {
+		self.Tail = node.Backward
+	}
+
 	for self.Level > 1 && self.Header.Level[self.Level-1].Forward == nil {
 		self.Level--
 	}
@@ -177,4 +194,5 @@ func freeSkipListNode(node *SkipListNode) {
 	node.Score = nil
 	node.Data = nil
 	node.Level = nil
+	node.Backward = nil
 }
@@ -0,0 +1,134 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package util
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MatchCacheStats is a snapshot of the counters of a match cache.
+type MatchCacheStats struct {
+	Size          int
+	Capacity      int
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+type matchCacheEntry[T any] struct {
+	topic  string
+	words  []string
+	result []T
+}
+
+// matchCache is a LRU cache of topic to the result of Match (Qlobber and SubscriptionTrie).
+type matchCache[T any] struct {
+	capacity      int
+	entries       map[string]*list.Element
+	lru           *list.List
+	mutex         sync.Mutex
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	invalidations uint64
+}
+
+func newMatchCache[T any](capacity int) *matchCache[T] {
+	return &matchCache[T]{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (self *matchCache[T]) get(topic string) ([]T, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	e, ok := self.entries[topic]
+	if !ok {
+		atomic.AddUint64(&self.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&self.hits, 1)
+	self.lru.MoveToFront(e)
+	return e.Value.(*matchCacheEntry[T]).result, true
+}
+
+func (self *matchCache[T]) put(topic string, words []string, result []T) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if e, ok := self.entries[topic]; ok {
+		e.Value.(*matchCacheEntry[T]).result = result
+		self.lru.MoveToFront(e)
+		return
+	}
+
+	self.entries[topic] = self.lru.PushFront(&matchCacheEntry[T]{topic: topic, words: words, result: result})
+	for self.lru.Len() > self.capacity {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.entries, oldest.Value.(*matchCacheEntry[T]).topic)
+		atomic.AddUint64(&self.evictions, 1)
+	}
+}
+
+// invalidate drops cached topics which filter could match. a nil filter drops everything.
+func (self *matchCache[T]) invalidate(filter []string, wildcardOne, wildcardSome string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var next *list.Element
+	for e := self.lru.Front(); e != nil; e = next {
+		next = e.Next()
+		entry := e.Value.(*matchCacheEntry[T])
+		if filter != nil && !couldMatch(filter, entry.words, wildcardOne, wildcardSome) {
+			continue
+		}
+		self.lru.Remove(e)
+		delete(self.entries, entry.topic)
+		atomic.AddUint64(&self.invalidations, 1)
+	}
+}
+
+func (self *matchCache[T]) stats() MatchCacheStats {
+	self.mutex.Lock()
+	size := self.lru.Len()
+	self.mutex.Unlock()
+
+	return MatchCacheStats{
+		Size:          size,
+		Capacity:      self.capacity,
+		Hits:          atomic.LoadUint64(&self.hits),
+		Misses:        atomic.LoadUint64(&self.misses),
+		Evictions:     atomic.LoadUint64(&self.evictions),
+		Invalidations: atomic.LoadUint64(&self.invalidations),
+	}
+}
+
+// couldMatch reports whether filter matches topic.
+func couldMatch(filter, topic []string, wildcardOne, wildcardSome string) bool {
+	if strings.HasPrefix(topic[0], "$") && (filter[0] == wildcardOne || filter[0] == wildcardSome) {
+		return false
+	}
+
+	for i, f := range filter {
+		if f == wildcardSome {
+			return true
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if f != wildcardOne && f != topic[i] {
+			return false
+		}
+	}
+	return len(filter) == len(topic)
+}
@@ -12,6 +12,8 @@ import (
 	"time"
 )
 
+var ErrNoIdentifier = errors.New("all packet identifiers are in use")
+
 type MessageContainer struct {
 	Message  codec.Message
 	Refcount int
@@ -40,30 +42,70 @@ func (self *MessageTable) SetOnFinish(callback func(uint16, codec.Message, inter
 	self.OnFinish = callback
 }
 
-func (self *MessageTable) NewId() uint16 {
+// Add reserves an unused packet identifier (1-65535), sets it to message and registers message with
+// refcount count. it doesn't wait for identifiers to be released: ErrNoIdentifier is returned when all
+// of them are in use. the identifier is released by Unref, Remove or Clean.
+func (self *MessageTable) Add(message codec.Message, count int, opaque interface{}) (uint16, error) {
 	self.Lock()
-	if self.Id == 65535 {
-		self.Id = 0
+	defer self.Unlock()
+
+	id, err := self.nextId()
+	if err != nil {
+		return 0, err
+	}
+
+	setPacketIdentifier(message, id)
+	self.used[id] = true
+	self.Hash[id] = &MessageContainer{
+		Message:  message,
+		Refcount: count,
+		Created:  time.Now(),
+		Updated:  time.Now(),
+		Opaque:   opaque,
 	}
+	return id, nil
+}
 
-	var id uint16
-	ok := false
-	for !ok {
-		if _, ok = self.used[self.Id]; !ok {
-			id = self.Id
-			self.used[self.Id] = true
+// nextId returns an unused packet identifier. the caller holds the lock.
+func (self *MessageTable) nextId() (uint16, error) {
+	// [MQTT-2.3.1-1] packet identifiers are non-zero.
+	for i := 0; i < 65535; i++ {
+		id := self.Id
+		if self.Id == 65535 {
+			self.Id = 1
+		} else {
 			self.Id++
-			break
+		}
+
+		if id != 0 && !self.used[id] {
+			return id, nil
 		}
 	}
+	return 0, ErrNoIdentifier
+}
 
-	self.Unlock()
-	return id
+func setPacketIdentifier(message codec.Message, id uint16) {
+	switch m := message.(type) {
+	case *codec.PublishMessage:
+		m.PacketIdentifier = id
+	case *codec.SubscribeMessage:
+		m.PacketIdentifier = id
+	case *codec.UnsubscribeMessage:
+		m.PacketIdentifier = id
+	}
+}
+
+func (self *MessageTable) Len() int {
+	self.RLock()
+	defer self.RUnlock()
+
+	return len(self.Hash)
 }
 
 func (self *MessageTable) Clean() {
 	self.Lock()
 	self.Hash = make(map[uint16]*MessageContainer)
+	self.used = make(map[uint16]bool)
 	self.Unlock()
 }
 
@@ -80,6 +122,7 @@ func (self *MessageTable) Get(id uint16) (codec.Message, error) {
 
 func (self *MessageTable) Register(id uint16, message codec.Message, opaque interface{}) {
 	self.Lock()
+	self.used[id] = true
 	self.Hash[id] = &MessageContainer{
 		Message:  message,
 		Refcount: 1,
@@ -92,6 +135,7 @@ func (self *MessageTable) Register(id uint16, message codec.Message, opaque inte
 
 func (self *MessageTable) Register2(id uint16, message codec.Message, count int, opaque interface{}) {
 	self.Lock()
+	self.used[id] = true
 	self.Hash[id] = &MessageContainer{
 		Message:  message,
 		Refcount: count,
@@ -122,6 +166,7 @@ func (self *MessageTable) Remove(id uint16) {
 	self.Lock()
 	if _, ok := self.Hash[id]; ok {
 		delete(self.Hash, id)
+		delete(self.used, id)
 	}
 	self.Unlock()
 }
@@ -0,0 +1,46 @@
+package util
+
+import (
+	codec "github.com/chobie/momonga/encoding/mqtt"
+	. "gopkg.in/check.v1"
+)
+
+type MessageTableSuite struct{}
+
+var _ = Suite(&MessageTableSuite{})
+
+func (s *MessageTableSuite) TestAdd(c *C) {
+	table := NewMessageTable()
+	seen := make(map[uint16]bool)
+	for i := 0; i < 65535; i++ {
+		msg := codec.NewPublishMessage()
+		id, err := table.Add(msg, 1, nil)
+		c.Assert(err, Equals, nil)
+		c.Assert(id, Not(Equals), uint16(0))
+		c.Assert(msg.PacketIdentifier, Equals, id)
+		c.Assert(seen[id], Equals, false)
+		seen[id] = true
+	}
+
+	// every identifier is in use. nothing is registered then.
+	msg := codec.NewPublishMessage()
+	_, err := table.Add(msg, 1, nil)
+	c.Assert(err, Equals, ErrNoIdentifier)
+	c.Assert(msg.PacketIdentifier, Equals, uint16(0))
+	c.Assert(table.Len(), Equals, 65535)
+
+	table.Unref(42)
+	table.Remove(7)
+	id, err := table.Add(codec.NewPublishMessage(), 1, nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(id == 7 || id == 42, Equals, true)
+	id2, err := table.Add(codec.NewSubscribeMessage(), 1, nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(id2 != id && (id2 == 7 || id2 == 42), Equals, true)
+	m, _ := table.Get(id2)
+	c.Assert(m.(*codec.SubscribeMessage).PacketIdentifier, Equals, id2)
+
+	table.Clean()
+	_, err = table.Add(codec.NewPublishMessage(), 1, nil)
+	c.Assert(err, Equals, nil)
+}
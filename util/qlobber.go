@@ -42,7 +42,8 @@ type Qlobber struct {
 	WildcardOne  string
 	QlobberTrie  *QlobberTrie
 	Mutex        *sync.RWMutex
-	Cache        map[string][]interface{}
+	// nil unless SetCacheSize enables it.
+	cache *matchCache[interface{}]
 }
 
 func NewQlobber() *Qlobber {
@@ -51,7 +52,6 @@ func NewQlobber() *Qlobber {
 			Collections: make([]interface{}, 0),
 			Trie:        make(map[string]*QlobberTrie),
 		},
-		Cache: make(map[string][]interface{}),
 		Mutex: &sync.RWMutex{},
 	}
 	q.Separator = "/"
@@ -60,23 +60,57 @@ func NewQlobber() *Qlobber {
 	return q
 }
 
+// SetCacheSize enables the LRU cache of Match results which holds up to size topics. 0 disables it.
+func (self *Qlobber) SetCacheSize(size int) {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	if size <= 0 {
+		self.cache = nil
+		return
+	}
+	self.cache = newMatchCache[interface{}](size)
+}
+
+func (self *Qlobber) CacheStats() MatchCacheStats {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+
+	if self.cache == nil {
+		return MatchCacheStats{}
+	}
+	return self.cache.stats()
+}
+
+// Match returns values of filters which match Topic. the result might be shared by callers
+// (see SetCacheSize), don't modify it.
 func (self *Qlobber) Match(Topic string) []interface{} {
 	self.Mutex.RLock()
-	//	if v, ok := self.Cache[Topic]; ok && v != nil {
-	//		self.Mutex.Unlock()
-	//		return v
-	//	}
+	defer self.Mutex.RUnlock()
+
+	if self.cache != nil {
+		if v, ok := self.cache.get(Topic); ok {
+			return v
+		}
+	}
 
 	var v []interface{}
-	result := self.match(v, 0, strings.Split(Topic, self.Separator), self.QlobberTrie)
+	words := strings.Split(Topic, self.Separator)
+	result := self.match(v, 0, words, self.QlobberTrie)
 
-	//	self.Cache[Topic] = result
-	self.Mutex.RUnlock()
+	// Add and Remove wait for the read lock, so they invalidate this entry if needed.
+	if self.cache != nil {
+		self.cache.put(Topic, words, result)
+	}
 	return result
 }
 
 func (self *Qlobber) match(v []interface{}, length int, words []string, sub_trie *QlobberTrie) []interface{} {
-	if st, ok := sub_trie.Trie[self.WildcardSome]; ok {
+	// [MQTT-4.7.2-1] The Server MUST NOT match Topic Filters starting with a wildcard character (# or +)
+	// with Topic Names beginning with a $ character
+	wildcards := length > 0 || sub_trie != self.QlobberTrie || !strings.HasPrefix(words[0], "$")
+
+	if st, ok := sub_trie.Trie[self.WildcardSome]; ok && wildcards {
 		for offset := range st.Collections {
 			w := st.Collections[offset]
 			if w != self.Separator {
@@ -99,7 +133,7 @@ func (self *Qlobber) match(v []interface{}, length int, words []string, sub_trie
 			}
 		}
 
-		if st, ok := sub_trie.Trie[self.WildcardOne]; ok {
+		if st, ok := sub_trie.Trie[self.WildcardOne]; ok && wildcards {
 			v = self.match(v, length+1, words, st)
 		}
 	}
@@ -109,9 +143,12 @@ func (self *Qlobber) match(v []interface{}, length int, words []string, sub_trie
 
 func (self *Qlobber) Add(Topic string, Value interface{}) {
 	self.Mutex.Lock()
-	self.Cache[Topic] = nil
+	words := strings.Split(Topic, self.Separator)
+	if self.cache != nil {
+		self.cache.invalidate(words, self.WildcardOne, self.WildcardSome)
+	}
 
-	self.add(Value, 0, strings.Split(Topic, self.Separator), self.QlobberTrie)
+	self.add(Value, 0, words, self.QlobberTrie)
 	self.Mutex.Unlock()
 }
 
@@ -187,9 +224,17 @@ func (self *Qlobber) remove(val interface{}, i int, words []string, sub_trie *Ql
 
 func (self *Qlobber) Remove(Topic string, val interface{}) {
 	self.Mutex.Lock()
-	self.Cache[Topic] = nil
+	words := strings.Split(Topic, self.Separator)
+	if self.cache != nil {
+		if val == nil {
+			// removes every filter below Topic as well.
+			self.cache.invalidate(nil, self.WildcardOne, self.WildcardSome)
+		} else {
+			self.cache.invalidate(words, self.WildcardOne, self.WildcardSome)
+		}
+	}
 
-	self.remove(val, 0, strings.Split(Topic, self.Separator), self.QlobberTrie)
+	self.remove(val, 0, words, self.QlobberTrie)
 	self.Mutex.Unlock()
 }
 
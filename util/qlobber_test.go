@@ -28,6 +28,32 @@ func (s *QlobberSuite) TestQlobber(c *C) {
 	q.Dump(os.Stdout)
 }
 
+func (s *QlobberSuite) TestDollarTopics(c *C) {
+	q := NewQlobber()
+	q.Add("$SYS/debug/chobie", "a")
+	q.Add("+/debug/chobie", "b")
+	q.Add("#", "c")
+	q.Add("$SYS/#", "d")
+	q.Add("$SYS/+/chobie", "e")
+
+	// [MQTT-4.7.2-1] wildcards at the first level don't match topics beginning with $
+	r := q.Match("$SYS/debug/chobie")
+	c.Assert(len(r), Equals, 3)
+	c.Assert(r[0], Equals, "d") // NOTE: Don't care order
+	c.Assert(r[1], Equals, "a")
+	c.Assert(r[2], Equals, "e")
+
+	r = q.Match("/debug/chobie")
+	c.Assert(len(r), Equals, 2)
+	c.Assert(r[0], Equals, "c")
+	c.Assert(r[1], Equals, "b")
+
+	// only the first level is special.
+	r = q.Match("debug/$SYS")
+	c.Assert(len(r), Equals, 1)
+	c.Assert(r[0], Equals, "c")
+}
+
 func (s *QlobberSuite) BenchmarkQlobber(c *C) {
 	q := NewQlobber()
 	q.Add("/debug/chobie", "a")
@@ -38,3 +64,39 @@ func (s *QlobberSuite) BenchmarkQlobber(c *C) {
 		q.Match("/debug/chobie")
 	}
 }
+
+func (s *QlobberSuite) TestMatchCache(c *C) {
+	q := NewQlobber()
+	q.SetCacheSize(2)
+	q.Add("a/b", "a")
+
+	c.Assert(q.Match("a/b"), DeepEquals, []interface{}{"a"})
+	c.Assert(q.Match("a/b"), DeepEquals, []interface{}{"a"})
+	c.Assert(q.Match("x/y"), HasLen, 0)
+	stats := q.CacheStats()
+	c.Assert(stats.Hits, Equals, uint64(1))
+	c.Assert(stats.Misses, Equals, uint64(2))
+	c.Assert(stats.Size, Equals, 2)
+
+	// only topics the filter could match are dropped.
+	q.Add("x/+", "b")
+	c.Assert(q.CacheStats().Invalidations, Equals, uint64(1))
+	c.Assert(q.Match("x/y"), DeepEquals, []interface{}{"b"})
+	c.Assert(q.Match("a/b"), DeepEquals, []interface{}{"a"})
+	c.Assert(q.CacheStats().Hits, Equals, uint64(2))
+
+	q.Match("$SYS/a")
+	c.Assert(q.CacheStats().Evictions, Equals, uint64(1))
+	q.Add("#", "c")
+	c.Assert(q.Match("$SYS/a"), HasLen, 0)
+	c.Assert(q.CacheStats().Size, Equals, 1)
+	q.Add("$SYS/#", "d")
+	c.Assert(q.Match("$SYS/a"), DeepEquals, []interface{}{"d"})
+
+	q.Remove("$SYS/#", "d")
+	c.Assert(q.Match("$SYS/a"), HasLen, 0)
+	c.Assert(q.Match("a/b"), DeepEquals, []interface{}{"c", "a"})
+	q.Remove("a", nil)
+	c.Assert(q.CacheStats().Size, Equals, 0)
+	c.Assert(q.Match("a/b"), DeepEquals, []interface{}{"c"})
+}
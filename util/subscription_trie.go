@@ -0,0 +1,303 @@
+// Copyright 2014, Shuhei Tanuma. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package util
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	trieSeparator    = "/"
+	trieWildcardOne  = "+"
+	trieWildcardSome = "#"
+)
+
+// SubscriptionTrie maps MQTT topic filters to subscribers of type T.
+// unlike Qlobber, subscribers are removed by the handle Add returned.
+type SubscriptionTrie[T comparable] struct {
+	root  *trieNode[T]
+	count int
+	mutex sync.RWMutex
+	// nil unless SetCacheSize enables it.
+	cache *matchCache[T]
+}
+
+type trieNode[T comparable] struct {
+	parent   *trieNode[T]
+	word     string
+	children map[string]*trieNode[T]
+	handles  []*TrieHandle[T]
+}
+
+// TrieHandle is a subscriber added to a SubscriptionTrie.
+type TrieHandle[T comparable] struct {
+	Filter string
+	Value  T
+	trie   *SubscriptionTrie[T]
+	node   *trieNode[T]
+	// position in node.handles
+	index int
+}
+
+// TrieFilter is a topic filter and its subscribers. see SubscriptionTrie.Dump
+type TrieFilter[T comparable] struct {
+	Filter string `json:"filter"`
+	Values []T    `json:"values"`
+}
+
+func NewSubscriptionTrie[T comparable]() *SubscriptionTrie[T] {
+	return &SubscriptionTrie[T]{
+		root: newTrieNode[T](nil, ""),
+	}
+}
+
+func newTrieNode[T comparable](parent *trieNode[T], word string) *trieNode[T] {
+	return &trieNode[T]{
+		parent:   parent,
+		word:     word,
+		children: make(map[string]*trieNode[T]),
+	}
+}
+
+// SetCacheSize enables the LRU cache of Match results which holds up to size topics. 0 disables it.
+func (self *SubscriptionTrie[T]) SetCacheSize(size int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if size <= 0 {
+		self.cache = nil
+		return
+	}
+	self.cache = newMatchCache[T](size)
+}
+
+func (self *SubscriptionTrie[T]) CacheStats() MatchCacheStats {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	if self.cache == nil {
+		return MatchCacheStats{}
+	}
+	return self.cache.stats()
+}
+
+// Add subscribes value to filter. the returned handle removes it.
+func (self *SubscriptionTrie[T]) Add(filter string, value T) *TrieHandle[T] {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	words := strings.Split(filter, trieSeparator)
+	if self.cache != nil {
+		self.cache.invalidate(words, trieWildcardOne, trieWildcardSome)
+	}
+
+	node := self.root
+	for _, word := range words {
+		child, ok := node.children[word]
+		if !ok {
+			child = newTrieNode(node, word)
+			node.children[word] = child
+		}
+		node = child
+	}
+
+	handle := &TrieHandle[T]{
+		Filter: filter,
+		Value:  value,
+		trie:   self,
+		node:   node,
+		index:  len(node.handles),
+	}
+	node.handles = append(node.handles, handle)
+	self.count++
+	return handle
+}
+
+// Remove unsubscribes handle. it returns false when handle has already been removed.
+func (self *SubscriptionTrie[T]) Remove(handle *TrieHandle[T]) bool {
+	if handle == nil {
+		return false
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	node := handle.node
+	if handle.trie != self || node == nil {
+		return false
+	}
+
+	if self.cache != nil {
+		self.cache.invalidate(strings.Split(handle.Filter, trieSeparator), trieWildcardOne, trieWildcardSome)
+	}
+
+	// the order of subscribers doesn't matter, move the last one to the hole.
+	last := len(node.handles) - 1
+	node.handles[handle.index] = node.handles[last]
+	node.handles[handle.index].index = handle.index
+	node.handles[last] = nil
+	node.handles = node.handles[:last]
+	handle.node = nil
+	self.count--
+
+	for node.parent != nil && len(node.handles) == 0 && len(node.children) == 0 {
+		delete(node.parent.children, node.word)
+		node = node.parent
+	}
+	return true
+}
+
+// RemoveFilter unsubscribes every subscriber of filter and returns how many of them were removed.
+func (self *SubscriptionTrie[T]) RemoveFilter(filter string) int {
+	self.mutex.RLock()
+	node := self.root
+	for _, word := range strings.Split(filter, trieSeparator) {
+		if node = node.children[word]; node == nil {
+			break
+		}
+	}
+	var handles []*TrieHandle[T]
+	if node != nil {
+		handles = append(handles, node.handles...)
+	}
+	self.mutex.RUnlock()
+
+	removed := 0
+	for _, handle := range handles {
+		if self.Remove(handle) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Match returns subscribers of filters which match topic. the result might be shared by callers
+// (see SetCacheSize), don't modify it.
+func (self *SubscriptionTrie[T]) Match(topic string) []T {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	if self.cache != nil {
+		if v, ok := self.cache.get(topic); ok {
+			return v
+		}
+	}
+
+	words := strings.Split(topic, trieSeparator)
+	result := self.match(nil, self.root, words, 0)
+
+	// Add and Remove wait for the read lock, so they invalidate this entry if needed.
+	if self.cache != nil {
+		self.cache.put(topic, words, result)
+	}
+	return result
+}
+
+func (self *SubscriptionTrie[T]) match(result []T, node *trieNode[T], words []string, level int) []T {
+	// [MQTT-4.7.2-1] The Server MUST NOT match Topic Filters starting with a wildcard character (# or +)
+	// with Topic Names beginning with a $ character
+	wildcards := level > 0 || !strings.HasPrefix(words[0], "$")
+
+	// "#" matches the parent level as well. "sport/#" matches "sport"
+	if child, ok := node.children[trieWildcardSome]; ok && wildcards {
+		result = appendValues(result, child)
+	}
+
+	if level == len(words) {
+		return appendValues(result, node)
+	}
+
+	if child, ok := node.children[words[level]]; ok {
+		result = self.match(result, child, words, level+1)
+	}
+	if child, ok := node.children[trieWildcardOne]; ok && wildcards {
+		result = self.match(result, child, words, level+1)
+	}
+	return result
+}
+
+func appendValues[T comparable](result []T, node *trieNode[T]) []T {
+	for _, handle := range node.handles {
+		result = append(result, handle.Value)
+	}
+	return result
+}
+
+// Count returns the number of subscribers.
+func (self *SubscriptionTrie[T]) Count() int {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return self.count
+}
+
+// Walk calls fn for each subscriber, level by level in the order of words, until fn returns false.
+// fn must not modify the trie.
+func (self *SubscriptionTrie[T]) Walk(fn func(filter string, value T) bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	self.walk(self.root, fn)
+}
+
+func (self *SubscriptionTrie[T]) walk(node *trieNode[T], fn func(filter string, value T) bool) bool {
+	for _, handle := range node.handles {
+		if !fn(handle.Filter, handle.Value) {
+			return false
+		}
+	}
+
+	words := make([]string, 0, len(node.children))
+	for word := range node.children {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	for _, word := range words {
+		if !self.walk(node.children[word], fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filters returns the topic filters which have subscribers.
+func (self *SubscriptionTrie[T]) Filters() []string {
+	filters := []string{}
+	self.Walk(func(filter string, value T) bool {
+		if len(filters) == 0 || filters[len(filters)-1] != filter {
+			filters = append(filters, filter)
+		}
+		return true
+	})
+	return filters
+}
+
+// Dump writes filters and their subscribers as JSON.
+func (self *SubscriptionTrie[T]) Dump(writer io.Writer) error {
+	dump := struct {
+		Count   int             `json:"count"`
+		Filters []TrieFilter[T] `json:"filters"`
+	}{
+		Filters: []TrieFilter[T]{},
+	}
+
+	self.Walk(func(filter string, value T) bool {
+		dump.Count++
+		if n := len(dump.Filters); n > 0 && dump.Filters[n-1].Filter == filter {
+			dump.Filters[n-1].Values = append(dump.Filters[n-1].Values, value)
+		} else {
+			dump.Filters = append(dump.Filters, TrieFilter[T]{Filter: filter, Values: []T{value}})
+		}
+		return true
+	})
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
@@ -0,0 +1,136 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"sort"
+)
+
+type SubscriptionTrieSuite struct{}
+
+var _ = Suite(&SubscriptionTrieSuite{})
+
+func sorted(values []string) []string {
+	result := append([]string{}, values...)
+	sort.Strings(result)
+	return result
+}
+
+func (s *SubscriptionTrieSuite) TestSubscriptionTrie(c *C) {
+	t := NewSubscriptionTrie[string]()
+	t.Add("/debug/chobie", "a")
+	b := t.Add("/+/chobie", "b")
+	t.Add("/#", "c")
+
+	c.Assert(sorted(t.Match("/debug/chobie")), DeepEquals, []string{"a", "b", "c"})
+	// "#" matches the parent level as well.
+	c.Assert(t.Match("/"), DeepEquals, []string{"c"})
+	c.Assert(t.Match("debug"), HasLen, 0)
+
+	c.Assert(t.Remove(b), Equals, true)
+	c.Assert(t.Remove(b), Equals, false)
+	c.Assert(sorted(t.Match("/debug/chobie")), DeepEquals, []string{"a", "c"})
+	c.Assert(t.Count(), Equals, 2)
+}
+
+func (s *SubscriptionTrieSuite) TestDollarTopics(c *C) {
+	t := NewSubscriptionTrie[string]()
+	t.Add("$SYS/debug/chobie", "a")
+	t.Add("+/debug/chobie", "b")
+	t.Add("#", "c")
+	t.Add("$SYS/#", "d")
+	t.Add("$SYS/+/chobie", "e")
+
+	// [MQTT-4.7.2-1] wildcards at the first level don't match topics beginning with $
+	c.Assert(sorted(t.Match("$SYS/debug/chobie")), DeepEquals, []string{"a", "d", "e"})
+	c.Assert(sorted(t.Match("/debug/chobie")), DeepEquals, []string{"b", "c"})
+	c.Assert(t.Match("debug/$SYS"), DeepEquals, []string{"c"})
+}
+
+func (s *SubscriptionTrieSuite) TestRemove(c *C) {
+	t := NewSubscriptionTrie[string]()
+	handles := []*TrieHandle[string]{
+		t.Add("a/b", "1"),
+		t.Add("a/b", "2"),
+		t.Add("a/b", "3"),
+	}
+	t.Add("a/+", "4")
+
+	// the last subscriber of a/b takes the place of the removed one.
+	t.Remove(handles[0])
+	c.Assert(sorted(t.Match("a/b")), DeepEquals, []string{"2", "3", "4"})
+	t.Remove(handles[2])
+	t.Remove(handles[1])
+	c.Assert(t.Match("a/b"), DeepEquals, []string{"4"})
+	c.Assert(t.Filters(), DeepEquals, []string{"a/+"})
+
+	t.Add("a/+", "5")
+	c.Assert(t.RemoveFilter("a/+"), Equals, 2)
+	c.Assert(t.Count(), Equals, 0)
+	c.Assert(t.Filters(), HasLen, 0)
+
+	// handles of another trie are ignored.
+	other := NewSubscriptionTrie[string]()
+	c.Assert(other.Remove(t.Add("a", "6")), Equals, false)
+	c.Assert(t.Count(), Equals, 1)
+}
+
+func (s *SubscriptionTrieSuite) TestIntrospection(c *C) {
+	t := NewSubscriptionTrie[string]()
+	t.Add("b/#", "1")
+	t.Add("a/b", "2")
+	t.Add("a", "3")
+	t.Add("a/b", "4")
+
+	c.Assert(t.Count(), Equals, 4)
+	c.Assert(t.Filters(), DeepEquals, []string{"a", "a/b", "b/#"})
+
+	var walked []string
+	t.Walk(func(filter string, value string) bool {
+		walked = append(walked, filter+"="+value)
+		return len(walked) < 3
+	})
+	c.Assert(walked, DeepEquals, []string{"a=3", "a/b=2", "a/b=4"})
+
+	buffer := bytes.NewBuffer(nil)
+	c.Assert(t.Dump(buffer), IsNil)
+	var dump struct {
+		Count   int                  `json:"count"`
+		Filters []TrieFilter[string] `json:"filters"`
+	}
+	c.Assert(json.Unmarshal(buffer.Bytes(), &dump), IsNil)
+	c.Assert(dump.Count, Equals, 4)
+	c.Assert(dump.Filters, DeepEquals, []TrieFilter[string]{
+		{Filter: "a", Values: []string{"3"}},
+		{Filter: "a/b", Values: []string{"2", "4"}},
+		{Filter: "b/#", Values: []string{"1"}},
+	})
+}
+
+func (s *SubscriptionTrieSuite) TestMatchCache(c *C) {
+	t := NewSubscriptionTrie[string]()
+	t.SetCacheSize(10)
+	a := t.Add("a/b", "a")
+
+	c.Assert(t.Match("a/b"), DeepEquals, []string{"a"})
+	c.Assert(t.Match("a/b"), DeepEquals, []string{"a"})
+	c.Assert(t.CacheStats().Hits, Equals, uint64(1))
+
+	t.Add("x/+", "x")
+	c.Assert(t.CacheStats().Invalidations, Equals, uint64(0))
+	t.Remove(a)
+	c.Assert(t.CacheStats().Invalidations, Equals, uint64(1))
+	c.Assert(t.Match("a/b"), HasLen, 0)
+}
+
+func (s *SubscriptionTrieSuite) BenchmarkSubscriptionTrie(c *C) {
+	t := NewSubscriptionTrie[string]()
+	t.Add("/debug/chobie", "a")
+	t.Add("/+/chobie", "b")
+	t.Add("/#", "c")
+
+	for i := 0; i < c.N; i++ {
+		t.Match("/debug/chobie")
+	}
+}